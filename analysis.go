@@ -0,0 +1,527 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The analysis contract: every analysis is validated against schemas/analysis.v1.json before it
+// is stored. A new incompatible version gets a new file and a new analysisSchemaVersion.
+const (
+	analysisSchemaVersion = 1
+	analysisSchemaPath    = "/schemas/analysis.v1.json"
+	unspecified           = "unspecified" // severity or category set by repairs when the model left it out
+)
+
+//go:embed schemas/analysis.v1.json
+var analysisSchemaJSON []byte
+
+var analysisSchema = mustParseSchema(analysisSchemaJSON)
+
+// modelSchema is the analysis schema shown to the model: unspecified is left to the repairs
+var modelSchema = withoutRepairValues(analysisSchema)
+
+var modelSchemaJSON = mustMarshalSchema(modelSchema)
+
+// analysisResponseSchema is the analysis schema in the form of the Gemini JSON mode
+var analysisResponseSchema = geminiResponseSchema(modelSchema)
+
+// GeminiResponse is the analysis Gemini writes for a chunk of reviews
+type GeminiResponse struct {
+	SchemaVersion int              `json:"schema_version"`
+	Summary       string           `json:"summary"`
+	Details       []AnalysisDetail `json:"details"`
+}
+
+// AnalysisDetail is the analysis of one negative review
+type AnalysisDetail struct {
+	CommentID string   `json:"comment_id"`
+	Tags      []string `json:"tags"`
+	Severity  string   `json:"severity"` // low, medium, high, critical or unspecified
+	Category  string   `json:"category"`
+}
+
+// QuarantinedAnalysis is a model answer that could not be repaired into a valid analysis
+type QuarantinedAnalysis struct {
+	ID        string    `bigquery:"id" json:"id"`
+	AppName   string    `bigquery:"app_name" json:"package_name"`
+	Version   string    `bigquery:"version" json:"version"`
+	Response  string    `bigquery:"raw_response" json:"raw_response"`
+	Reason    string    `bigquery:"reason" json:"reason"`
+	Attempts  int64     `bigquery:"attempts" json:"attempts"` // model calls, including re-asks
+	Source    string    `bigquery:"source" json:"source"`     // pipeline or procedure
+	CreatedAt time.Time `bigquery:"created_at" json:"created_at"`
+}
+
+// StoredAnalysis is a row of the reviews_to_process table
+type StoredAnalysis struct {
+	AppName   string
+	Version   string
+	Response  string
+	CreatedAt time.Time
+}
+
+func mustParseSchema(data []byte) map[string]any {
+	var schema map[string]any
+	if err := json.Unmarshal(data, &schema); err != nil {
+		panic(fmt.Sprintf("invalid embedded schema: %v", err))
+	}
+	return schema
+}
+
+func mustMarshalSchema(schema map[string]any) []byte {
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		panic(fmt.Sprintf("invalid schema: %v", err))
+	}
+	return data
+}
+
+// withoutRepairValues copies a schema without the unspecified enum values and the comments
+func withoutRepairValues(schema map[string]any) map[string]any {
+	out := map[string]any{}
+	for key, value := range schema {
+		switch v := value.(type) {
+		case map[string]any:
+			out[key] = withoutRepairValues(v)
+		case []any:
+			if key != "enum" {
+				out[key] = v
+				continue
+			}
+			var kept []any
+			for _, allowed := range v {
+				if allowed != unspecified {
+					kept = append(kept, allowed)
+				}
+			}
+			out[key] = kept
+		default:
+			if key != "$comment" {
+				out[key] = v
+			}
+		}
+	}
+	return out
+}
+
+// decodeAnalysis validates a model answer against the analysis schema, after repairing what can
+// be repaired without guessing: the JSON is extracted from markdown or chatter, comma separated
+// tags are split, values are trimmed and lowercased, missing severities and categories become
+// unspecified, unknown categories become other, and details of reviews that are not in
+// reviewIDs (when set), duplicated or without tags are dropped. The repairs made are returned.
+func decodeAnalysis(raw string, reviewIDs map[string]bool) (*GeminiResponse, []string, error) {
+	var repairs []string
+	text := strings.TrimSpace(raw)
+
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(text), &doc); err != nil {
+		start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+		if start < 0 || end < start {
+			return nil, nil, fmt.Errorf("the answer holds no JSON object")
+		}
+		doc = nil
+		if err := json.Unmarshal([]byte(text[start:end+1]), &doc); err != nil {
+			return nil, nil, fmt.Errorf("the answer is not valid JSON: %v", err)
+		}
+		repairs = append(repairs, "extracted the JSON object from the answer")
+	}
+	if doc == nil {
+		return nil, nil, fmt.Errorf("the answer is not a JSON object")
+	}
+
+	doc["schema_version"] = analysisSchemaVersion
+	for key := range doc {
+		if key != "schema_version" && key != "summary" && key != "details" {
+			delete(doc, key)
+			repairs = append(repairs, "removed the unknown field "+key)
+		}
+	}
+	if summary, ok := doc["summary"].(string); ok {
+		doc["summary"] = strings.TrimSpace(summary)
+	}
+
+	if doc["details"] == nil {
+		doc["details"] = []any{}
+		repairs = append(repairs, "added the missing details")
+	}
+	if details, ok := doc["details"].([]any); ok {
+		kept := []any{}
+		seen := map[string]bool{}
+		for i, d := range details {
+			detail, ok := d.(map[string]any)
+			if !ok {
+				repairs = append(repairs, fmt.Sprintf("dropped detail %d, not an object", i))
+				continue
+			}
+			id := strings.TrimSpace(fmt.Sprint(detail["comment_id"]))
+			switch {
+			case detail["comment_id"] == nil || id == "":
+				repairs = append(repairs, fmt.Sprintf("dropped detail %d, no comment_id", i))
+				continue
+			case reviewIDs != nil && !reviewIDs[id]:
+				repairs = append(repairs, "dropped the detail of unknown review "+id)
+				continue
+			case seen[id]:
+				repairs = append(repairs, "dropped a duplicate detail of review "+id)
+				continue
+			}
+			seen[id] = true
+			detail["comment_id"] = id
+
+			if tags, ok := repairTags(detail["tags"]); ok {
+				if _, isString := detail["tags"].(string); isString {
+					repairs = append(repairs, "split the comma separated tags of review "+id)
+				}
+				if len(tags) == 0 {
+					repairs = append(repairs, "dropped the detail of review "+id+", no tags")
+					continue
+				}
+				detail["tags"] = tags
+			}
+			for _, field := range []string{"severity", "category"} {
+				value, ok := detail[field].(string)
+				if detail[field] == nil || (ok && strings.TrimSpace(value) == "") {
+					detail[field] = unspecified
+					repairs = append(repairs, fmt.Sprintf("set the missing %s of review %s to %s", field, id, unspecified))
+				} else if ok {
+					detail[field] = strings.ToLower(strings.TrimSpace(value))
+				}
+			}
+			if category, ok := detail["category"].(string); ok && !schemaAllows(analysisSchema, category, "details", "category") {
+				detail["category"] = "other"
+				repairs = append(repairs, fmt.Sprintf("replaced the unknown category %q of review %s with other", category, id))
+			}
+			for key := range detail {
+				if key != "comment_id" && key != "tags" && key != "severity" && key != "category" {
+					delete(detail, key)
+					repairs = append(repairs, fmt.Sprintf("removed the unknown field %s of review %s", key, id))
+				}
+			}
+			kept = append(kept, detail)
+		}
+		doc["details"] = kept
+	}
+
+	if err := validateSchema(analysisSchema, doc, "$"); err != nil {
+		return nil, repairs, err
+	}
+
+	// The document is valid, so it decodes
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, repairs, err
+	}
+	var analysis GeminiResponse
+	if err := json.Unmarshal(data, &analysis); err != nil {
+		return nil, repairs, err
+	}
+	return &analysis, repairs, nil
+}
+
+// repairTags trims and deduplicates tags given as an array or a comma separated string, as
+// decoded JSON. ok is false for other types, left to the validation.
+func repairTags(v any) (tags []any, ok bool) {
+	var raw []string
+	switch v := v.(type) {
+	case string:
+		raw = strings.Split(v, ",")
+	case []any:
+		for _, tag := range v {
+			s, isString := tag.(string)
+			if !isString {
+				return nil, false
+			}
+			raw = append(raw, s)
+		}
+	default:
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	tags = []any{}
+	for _, tag := range raw {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags, true
+}
+
+// schemaAllows reports whether value is in the enum of the property at path (through arrays)
+func schemaAllows(schema map[string]any, value string, path ...string) bool {
+	for _, name := range path {
+		if items, ok := schema["items"].(map[string]any); ok {
+			schema = items
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		schema, _ = properties[name].(map[string]any)
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		schema = items
+	}
+	enum, ok := schema["enum"].([]any)
+	if !ok {
+		return true
+	}
+	for _, allowed := range enum {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSchema checks a value decoded by encoding/json against the subset of JSON Schema used
+// in schemas/: type, enum, properties, required, additionalProperties, items, minLength,
+// maxLength, minItems and maxItems. It returns the first violation, with its JSON path.
+func validateSchema(schema map[string]any, v any, path string) error {
+	if typ, ok := schema["type"].(string); ok && !hasJSONType(v, typ) {
+		return fmt.Errorf("%s must be of type %s", path, typ)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == v || (isNumber(allowed) && isNumber(v) && toFloat(allowed) == toFloat(v)) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s must be one of %v, not %v", path, enum, v)
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := len([]rune(v))
+		if min, ok := schema["minLength"].(float64); ok && float64(length) < min {
+			return fmt.Errorf("%s must be at least %v characters long", path, min)
+		}
+		if max, ok := schema["maxLength"].(float64); ok && float64(length) > max {
+			return fmt.Errorf("%s must be at most %v characters long", path, max)
+		}
+	case []any:
+		if min, ok := schema["minItems"].(float64); ok && float64(len(v)) < min {
+			return fmt.Errorf("%s must have at least %v items", path, min)
+		}
+		if max, ok := schema["maxItems"].(float64); ok && float64(len(v)) > max {
+			return fmt.Errorf("%s must have at most %v items", path, max)
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if _, present := v[name.(string)]; !present {
+					return fmt.Errorf("%s.%s is required", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]any)
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names) // report the same violation every time
+		for _, name := range names {
+			property, known := properties[name].(map[string]any)
+			if !known {
+				if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := validateSchema(property, v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func hasJSONType(v any, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		return isNumber(v)
+	case "integer":
+		return isNumber(v) && toFloat(v) == math.Trunc(toFloat(v))
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func isNumber(v any) bool {
+	switch v.(type) {
+	case float64, int:
+		return true
+	}
+	return false
+}
+
+func toFloat(v any) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return math.NaN()
+}
+
+// geminiResponseSchema converts a JSON Schema to the OpenAPI subset of the responseSchema of
+// Gemini: uppercase types, only the keywords it knows, and string enums only. The schema
+// version is left out, it is stamped on write.
+func geminiResponseSchema(schema map[string]any) map[string]any {
+	out := map[string]any{}
+	if typ, ok := schema["type"].(string); ok {
+		out["type"] = strings.ToUpper(typ)
+	}
+	if description, ok := schema["description"].(string); ok {
+		out["description"] = description
+	}
+	if enum, ok := schema["enum"].([]any); ok && schema["type"] == "string" {
+		out["enum"] = enum
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		out["items"] = geminiResponseSchema(items)
+	}
+	if properties, ok := schema["properties"].(map[string]any); ok {
+		converted := map[string]any{}
+		for name, property := range properties {
+			if name != "schema_version" {
+				converted[name] = geminiResponseSchema(property.(map[string]any))
+			}
+		}
+		out["properties"] = converted
+	}
+	if required, ok := schema["required"].([]any); ok {
+		var kept []any
+		for _, name := range required {
+			if name != "schema_version" {
+				kept = append(kept, name)
+			}
+		}
+		out["required"] = kept
+	}
+	return out
+}
+
+// reaskPrompt asks the model again after an invalid answer, telling it what was wrong
+func reaskPrompt(prompt, answer string, problem error) string {
+	return fmt.Sprintf("%s\n\nYour previous answer was:\n%s\n\nIt is invalid: %v. Answer again with only a JSON object that follows this JSON Schema, without the schema_version field:\n%s",
+		prompt, answer, problem, modelSchemaJSON)
+}
+
+// checkStoredAnalyses validates the analyses of a package written without validation, by the
+// stored procedure or before the schema existed. Valid and repaired ones are stored in their
+// normalized form, the others are moved to the quarantine. They are not re-asked: the reviews
+// of the chunk the procedure sent are not known here.
+func checkStoredAnalyses(ctx context.Context, store ReviewStore, packageName string) error {
+	unchecked, err := store.UncheckedAnalyses(ctx, packageName)
+	if err != nil {
+		return newError(KindStorage, "failed to list unchecked analyses", err)
+	}
+
+	for _, stored := range unchecked {
+		analysis, repairs, err := decodeAnalysis(stored.Response, nil)
+		if err != nil {
+			q := &QuarantinedAnalysis{
+				ID:        newID(),
+				AppName:   stored.AppName,
+				Version:   stored.Version,
+				Response:  stored.Response,
+				Reason:    err.Error(),
+				Attempts:  1,
+				Source:    "procedure",
+				CreatedAt: time.Now().UTC(),
+			}
+			if err := store.QuarantineAnalysis(ctx, q); err != nil {
+				return newError(KindStorage, "failed to quarantine analysis", err)
+			}
+			if err := store.ReplaceAnalysis(ctx, stored, ""); err != nil {
+				return newError(KindStorage, "failed to remove quarantined analysis", err)
+			}
+			log.Printf("Quarantined an analysis of %s version %s: %v", stored.AppName, stored.Version, err)
+			continue
+		}
+
+		normalized, err := json.Marshal(analysis)
+		if err != nil {
+			return newError(KindInternal, "failed to encode analysis", err)
+		}
+		if err := store.ReplaceAnalysis(ctx, stored, string(normalized)); err != nil {
+			return newError(KindStorage, "failed to store normalized analysis", err)
+		}
+		if len(repairs) > 0 {
+			log.Printf("Repaired an analysis of %s version %s: %s", stored.AppName, stored.Version, strings.Join(repairs, "; "))
+		}
+	}
+	return nil
+}
+
+func (a *App) analysisSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(analysisSchemaJSON)
+}
+
+func (a *App) quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("package_name")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	quarantined, err := a.store.QuarantinedAnalyses(r.Context(), packageName)
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to list quarantined analyses", err))
+		return
+	}
+	if quarantined == nil {
+		quarantined = []*QuarantinedAnalysis{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quarantined)
+}
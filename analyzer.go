@@ -0,0 +1,304 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// analysisPrompt is kept identical to the one of bq-schema/bq_review_analysis.sql, %d is the highest negative star rating
+const analysisPrompt = `You are a app review summarizer. From the following text that contains user reviews/comments, create a summary with the overall sentiment outlining positives and negatives. Also, for any negative comments (star_rating <= %d), generate tags describing what is wrong.  The output should be a single JSON object with two fields: "summary" and "details". The "summary" field contains the overall summary, and the "details" field is an array of JSON objects, each with "comment_id", "tags" (an array of short tags), "severity" (one of low, medium, high, critical) and "category" (one of stability, performance, usability, functionality, account, billing, ads, privacy, content, other). Format the output strictly as a JSON object.  You cannot return empty for summary because you know how to pick up sensible data from following input text: `
+
+// maxAnalysisAttempts bounds the model calls for a chunk: the first answer and the re-asks
+const maxAnalysisAttempts = 3
+
+// analysisSettings bound the reviews of an analysis
+type analysisSettings struct {
+	window    time.Duration // only reviews modified in the window
+	maxStars  int64         // a version is analyzed if it has at least one review with star_rating <= maxStars
+	chunkSize int           // reviews sent to Gemini per request
+}
+
+// analysisSettings returns the analysis defaults of the configuration
+func (c *Config) analysisSettings() analysisSettings {
+	return analysisSettings{window: c.analysisWindow(), maxStars: c.AnalysisMaxStars, chunkSize: c.AnalysisChunkSize}
+}
+
+// settingsFor returns the settings of a package: registered apps have their own window and threshold
+func (s analysisSettings) settingsFor(ctx context.Context, store ReviewStore, packageName string) (analysisSettings, error) {
+	app, err := store.App(ctx, packageName)
+	switch {
+	case err == nil:
+		s.window, s.maxStars = app.analysisWindow(), app.AnalysisMaxStars
+	case !errors.Is(err, ErrNotFound):
+		return s, newError(KindStorage, "failed to read registered app", err)
+	}
+	return s, nil
+}
+
+// Analyzer produces the per-version Gemini analyses (reviews_to_process table) for a package
+type Analyzer interface {
+	// Analyze reports one progress step per analyzed version, when the implementation can tell
+	Analyze(ctx context.Context, packageName string, progress ProgressFunc) error
+}
+
+// newAnalyzer builds the analyzer selected by cfg.Analyzer.
+// "procedure" runs the pre_process_reviews_in_bq stored procedure, "pipeline" runs the
+// same logic in Go against any ReviewStore. By default the stored procedure is used
+// when reviews are in BigQuery (bqClient is set) and the Go pipeline otherwise.
+// The pipeline sends its prompts to llm.
+func newAnalyzer(cfg Config, store ReviewStore, bqClient *bigquery.Client, llm LLMClient) (Analyzer, error) {
+	kind := cfg.Analyzer
+	if kind == "" {
+		kind = "pipeline"
+		if bqClient != nil {
+			kind = "procedure"
+		}
+	}
+
+	switch kind {
+	case "procedure":
+		if bqClient == nil {
+			return nil, fmt.Errorf("the procedure analyzer requires the BigQuery store")
+		}
+		return &procedureAnalyzer{client: bqClient, store: store, llm: llm, dataset: cfg.DatasetID, settings: cfg.analysisSettings()}, nil
+	case "pipeline":
+		if llm == nil {
+			return nil, fmt.Errorf("the pipeline analyzer requires an LLM client")
+		}
+		return newPipelineAnalyzer(store, llm, cfg.analysisSettings()), nil
+	default:
+		return nil, fmt.Errorf("unknown analyzer %q (expected procedure or pipeline)", kind)
+	}
+}
+
+// procedureAnalyzer delegates the whole analysis to the BigQuery stored procedure
+type procedureAnalyzer struct {
+	client   *bigquery.Client
+	store    ReviewStore
+	llm      LLMClient // consolidates the summaries of the chunks
+	dataset  string
+	settings analysisSettings
+}
+
+func (a *procedureAnalyzer) Analyze(ctx context.Context, packageName string, progress ProgressFunc) error {
+	// start timer
+	start := time.Now()
+
+	settings, err := a.settings.settingsFor(ctx, a.store, packageName)
+	if err != nil {
+		return err
+	}
+
+	q := a.client.Query(fmt.Sprintf("CALL `%s.pre_process_reviews_in_bq`(@package_name, @window_days, @max_stars, @chunk_size)", a.dataset))
+	q.Parameters = []bigquery.QueryParameter{
+		{Name: "package_name", Value: packageName},
+		{Name: "window_days", Value: int64(settings.window / (24 * time.Hour))},
+		{Name: "max_stars", Value: settings.maxStars},
+		{Name: "chunk_size", Value: int64(settings.chunkSize)},
+	}
+
+	job, err := q.Run(ctx)
+	if err != nil {
+		return newError(KindStorage, "error running stored procedure", err)
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return newError(KindStorage, "error waiting for job completion", err)
+	}
+
+	if err := status.Err(); err != nil {
+		return newError(KindStorage, "stored procedure execution failed", err)
+	}
+
+	// The procedure stores the answers as they come, they are validated here
+	if err := processAnalyses(ctx, a.store, a.llm, packageName); err != nil {
+		return err
+	}
+	progress.report(1, 1, "Stored procedure completed")
+
+	log.Printf("Review pre-processing with Gemini completed in %.2f seconds.", time.Since(start).Seconds())
+	return nil
+}
+
+// pipelineAnalyzer is the Go port of pre_process_reviews_in_bq: for every recent version
+// with negative reviews, it sends the reviews to Gemini in chunks and stores each answer.
+type pipelineAnalyzer struct {
+	store    ReviewStore
+	llm      LLMClient
+	settings analysisSettings
+	now      func() time.Time
+}
+
+func newPipelineAnalyzer(store ReviewStore, llm LLMClient, settings analysisSettings) *pipelineAnalyzer {
+	return &pipelineAnalyzer{store: store, llm: llm, settings: settings, now: time.Now}
+}
+
+func (a *pipelineAnalyzer) Analyze(ctx context.Context, packageName string, progress ProgressFunc) error {
+	start := time.Now()
+
+	settings, err := a.settings.settingsFor(ctx, a.store, packageName)
+	if err != nil {
+		return err
+	}
+	since := a.now().Add(-settings.window)
+
+	versions, err := a.store.VersionsToAnalyze(ctx, packageName, since, settings.maxStars)
+	if err != nil {
+		return newError(KindStorage, "failed to list versions to analyze", err)
+	}
+
+	for i, version := range versions {
+		chunks, err := a.analyzeVersion(ctx, packageName, version, since, settings)
+		if err != nil {
+			return newError(KindInternal, "version "+version, err)
+		}
+		progress.report(i+1, len(versions), fmt.Sprintf("Analyzed version %s (%d chunks)", version, chunks))
+	}
+
+	if err := processAnalyses(ctx, a.store, a.llm, packageName); err != nil {
+		return err
+	}
+
+	log.Printf("Review pre-processing with Gemini completed in %.2f seconds.", time.Since(start).Seconds())
+	return nil
+}
+
+// analyzeVersion returns the number of chunks sent to the model
+func (a *pipelineAnalyzer) analyzeVersion(ctx context.Context, packageName, version string, since time.Time, settings analysisSettings) (int, error) {
+	// The chunks left by a run that failed before processing would be reduced with these
+	if err := a.store.SupersedeAnalyses(ctx, packageName, version); err != nil {
+		return 0, newError(KindStorage, "failed to supersede analyses", err)
+	}
+
+	chunks := 0
+	for offset := 0; ; offset += settings.chunkSize {
+		reviews, err := a.store.ReviewsForVersion(ctx, packageName, version, since, settings.chunkSize, offset)
+		if err != nil {
+			return chunks, newError(KindStorage, "failed to read reviews", err)
+		}
+		if len(reviews) == 0 {
+			return chunks, nil
+		}
+
+		prompt, err := buildAnalysisPrompt(reviews, settings.maxStars)
+		if err != nil {
+			return chunks, err
+		}
+
+		analysis, err := a.generateAnalysis(ctx, packageName, version, prompt, reviews)
+		if err != nil {
+			return chunks, err
+		}
+		chunks++
+
+		// A quarantined chunk is skipped, the next ones may still be analyzed
+		if analysis != nil {
+			response, err := json.Marshal(analysis)
+			if err != nil {
+				return chunks, newError(KindInternal, "failed to encode analysis", err)
+			}
+			if err := a.store.SaveAnalysis(ctx, packageName, version, string(response)); err != nil {
+				return chunks, newError(KindStorage, "failed to save analysis", err)
+			}
+			log.Printf("Analyzed %d reviews of %s version %s", len(reviews), packageName, version)
+		}
+
+		if len(reviews) < settings.chunkSize {
+			return chunks, nil
+		}
+	}
+}
+
+// generateAnalysis asks the model to analyze a chunk of reviews, in JSON mode when the client
+// has one. An invalid answer is repaired when possible, otherwise the model is asked again with
+// the problem. After maxAnalysisAttempts the last answer is quarantined and nil is returned.
+func (a *pipelineAnalyzer) generateAnalysis(ctx context.Context, packageName, version, prompt string, reviews []*Review) (*GeminiResponse, error) {
+	reviewIDs := make(map[string]bool, len(reviews))
+	for _, r := range reviews {
+		reviewIDs[r.ReviewID] = true
+	}
+
+	current := prompt
+	var answer string
+	var problem error
+	for attempt := 1; attempt <= maxAnalysisAttempts; attempt++ {
+		var err error
+		if generator, ok := a.llm.(JSONGenerator); ok {
+			answer, err = generator.GenerateJSON(ctx, current, analysisResponseSchema)
+		} else {
+			answer, err = a.llm.Generate(ctx, current)
+		}
+		if err != nil {
+			return nil, newError(KindLLM, "failed to generate analysis", err)
+		}
+
+		analysis, repairs, err := decodeAnalysis(answer, reviewIDs)
+		if err == nil {
+			if len(repairs) > 0 {
+				log.Printf("Repaired an analysis of %s version %s: %s", packageName, version, strings.Join(repairs, "; "))
+			}
+			return analysis, nil
+		}
+		problem = err
+		log.Printf("Invalid analysis of %s version %s (attempt %d of %d): %v", packageName, version, attempt, maxAnalysisAttempts, err)
+		current = reaskPrompt(prompt, answer, err)
+	}
+
+	q := &QuarantinedAnalysis{
+		ID:        newID(),
+		AppName:   packageName,
+		Version:   version,
+		Response:  answer,
+		Reason:    problem.Error(),
+		Attempts:  maxAnalysisAttempts,
+		Source:    "pipeline",
+		CreatedAt: a.now().UTC(),
+	}
+	if err := a.store.QuarantineAnalysis(ctx, q); err != nil {
+		return nil, newError(KindStorage, "failed to quarantine analysis", err)
+	}
+	return nil, nil
+}
+
+// buildAnalysisPrompt renders reviews the same way the stored procedure does with
+// STRING_AGG(TO_JSON_STRING(STRUCT(review_id, star_rating, comments)), ' ')
+func buildAnalysisPrompt(reviews []*Review, maxStars int64) (string, error) {
+	type promptReview struct {
+		ReviewID   string `json:"review_id"`
+		StarRating int64  `json:"star_rating"`
+		Comments   string `json:"comments"`
+	}
+
+	parts := make([]string, 0, len(reviews))
+	for _, r := range reviews {
+		b, err := json.Marshal(promptReview{ReviewID: r.ReviewID, StarRating: r.StarRating, Comments: r.Comments})
+		if err != nil {
+			return "", fmt.Errorf("failed to encode review %s: %w", r.ReviewID, err)
+		}
+		parts = append(parts, string(b))
+	}
+
+	return fmt.Sprintf(analysisPrompt, maxStars) + strings.Join(parts, " "), nil
+}
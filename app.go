@@ -0,0 +1,236 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/NucleusEngineering/play-gemini/playapi"
+	"golang.org/x/oauth2/google"
+)
+
+// templateFiles are built into the binary, so that commands run from any directory
+//
+//go:embed templates/index.html
+var templateFiles embed.FS
+
+// App owns the clients shared by the HTTP handlers and the fetch pipeline.
+// It is built once in main and closed on shutdown.
+type App struct {
+	cfg       Config
+	bqClient  *bigquery.Client // nil unless the BigQuery store is used
+	play      *playapi.Client  // Play Developer API, or the mock
+	store     ReviewStore
+	llm       LLMClient // nil when no model is available
+	analyzer  Analyzer  // nil when reviews cannot be analyzed
+	jobs      *jobQueue
+	scheduler *scheduler
+	templates *template.Template
+	draftsMu  sync.Mutex // serializes decisions on reply drafts
+	appsMu    sync.Mutex // serializes changes to the registered apps
+
+	taxonomyMu   sync.Mutex      // serializes changes to the taxonomy
+	taxonomyFile []TaxonomyLabel // labels of the taxonomy file, until applied to the store
+
+	cancel context.CancelFunc // stops the background jobs
+}
+
+func newApp(ctx context.Context, cfg Config) (*App, error) {
+	app := &App{cfg: cfg}
+
+	var err error
+	if cfg.ReviewStore == "" || cfg.ReviewStore == "bigquery" {
+		if cfg.ProjectID == "" {
+			return nil, fmt.Errorf("a project must be set with PROJECT_ID, project_id or --project")
+		}
+		app.bqClient, err = bigquery.NewClient(ctx, cfg.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("bigquery.NewClient: %w", err)
+		}
+		app.bqClient.Location = cfg.Location
+	}
+
+	// The taxonomy file is checked at startup, it is applied on first use
+	app.taxonomyFile, err = loadTaxonomyFile(cfg.TaxonomyFile)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+
+	app.store, err = newReviewStore(cfg, app.bqClient)
+	if err != nil {
+		app.Close()
+		return nil, fmt.Errorf("unable to create review store: %w", err)
+	}
+
+	app.llm, err = newLLMClient(ctx, cfg, app.bqClient)
+	if err != nil {
+		if cfg.LLMProvider != "" {
+			app.Close()
+			return nil, fmt.Errorf("unable to create LLM client: %w", err)
+		}
+		log.Printf("No LLM available: %v", err)
+	}
+
+	app.analyzer, err = newAnalyzer(cfg, app.store, app.bqClient, app.llm)
+	if err != nil {
+		if cfg.Analyzer != "" {
+			app.Close()
+			return nil, fmt.Errorf("unable to create analyzer: %w", err)
+		}
+		log.Printf("Reviews will not be analyzed: %v", err)
+	}
+
+	httpClient, err := google.DefaultClient(ctx, playapi.Scope)
+	if err != nil {
+		// The mock Play API does not check credentials, so allow running without them locally
+		if cfg.PlayAPIURL == playapi.DefaultBaseURL {
+			app.Close()
+			return nil, fmt.Errorf("unable to create client: %w", err)
+		}
+		log.Printf("No Google credentials found, calling %s unauthenticated: %v", cfg.PlayAPIURL, err)
+		httpClient = http.DefaultClient
+	}
+	app.play = playapi.New(httpClient, playapi.Options{BaseURL: cfg.PlayAPIURL, RequestsPerHour: cfg.PlayAPIRequestsPerHour})
+
+	app.templates, err = template.ParseFS(templateFiles, "templates/index.html")
+	if err != nil {
+		app.Close()
+		return nil, fmt.Errorf("unable to parse templates: %w", err)
+	}
+
+	jobsCtx, cancel := context.WithCancel(context.Background())
+	app.cancel = cancel
+	app.jobs = newJobQueue(jobsCtx, app, cfg.FetchWorkers, 100)
+	app.scheduler = newScheduler(jobsCtx, app.store, app.jobs, time.Duration(cfg.ScheduleJitter), cfg.DefaultFetchCount)
+	if cfg.RunScheduler {
+		go app.scheduler.Run(jobsCtx)
+	}
+
+	return app, nil
+}
+
+// Close stops the background jobs and releases the clients
+func (a *App) Close() error {
+	if a.cancel != nil {
+		a.cancel()
+	}
+
+	var firstErr error
+	if a.store != nil {
+		firstErr = a.store.Close()
+	}
+	if a.bqClient != nil {
+		if err := a.bqClient.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *App) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.homeHandler)
+	mux.HandleFunc("/fetch", a.fetchHandler)
+	mux.HandleFunc("GET /debug/config", a.debugConfigHandler)
+	mux.HandleFunc("GET /apps", a.appsHandler)
+	mux.HandleFunc("POST /apps", a.createAppHandler)
+	mux.HandleFunc("GET /apps/{package}", a.appHandler)
+	mux.HandleFunc("PUT /apps/{package}", a.updateAppHandler)
+	mux.HandleFunc("DELETE /apps/{package}", a.deleteAppHandler)
+	mux.HandleFunc("GET /portfolio", a.portfolioHandler)
+	mux.HandleFunc("GET /schedules", a.schedulesHandler)
+	mux.HandleFunc("POST /schedules/run", a.runSchedulesHandler)
+	mux.HandleFunc("GET /schedules/{package}", a.scheduleHandler)
+	mux.HandleFunc("PUT /schedules/{package}", a.putScheduleHandler)
+	mux.HandleFunc("DELETE /schedules/{package}", a.deleteScheduleHandler)
+	mux.HandleFunc("POST /schedules/{package}/run", a.runScheduleHandler)
+	mux.HandleFunc("GET /jobs/{id}", a.jobHandler)
+	mux.HandleFunc("GET /jobs/{id}/events", a.jobEventsHandler)
+	mux.HandleFunc("/analyze", a.analyzeHandler)
+	mux.HandleFunc("/versionAnalysis", a.versionAnalysisHandler)
+	mux.HandleFunc("/comment", a.commentHandler)
+	mux.HandleFunc("GET /compare", a.compareHandler)
+	mux.HandleFunc("GET /tags", a.tagsHandler)
+	mux.HandleFunc("GET /taxonomy", a.taxonomyHandler)
+	mux.HandleFunc("GET /taxonomy/unmapped", a.unmappedTagsHandler)
+	mux.HandleFunc("PUT /taxonomy/mappings", a.putTagMappingHandler)
+	mux.HandleFunc("PUT /taxonomy/{category}/{issue}", a.putTaxonomyLabelHandler)
+	mux.HandleFunc("DELETE /taxonomy/{category}/{issue}", a.deleteTaxonomyLabelHandler)
+	mux.HandleFunc("GET /quarantine", a.quarantineHandler)
+	mux.HandleFunc("GET "+analysisSchemaPath, a.analysisSchemaHandler)
+	mux.HandleFunc("POST /reply", a.replyHandler)
+	mux.HandleFunc("GET /replies", a.repliesHandler)
+	mux.HandleFunc("GET /drafts", a.draftsHandler)
+	mux.HandleFunc("POST /drafts", a.createDraftHandler)
+	mux.HandleFunc("PUT /drafts/{id}", a.draftDecisionHandler(DraftPending))
+	mux.HandleFunc("POST /drafts/{id}/approve", a.draftDecisionHandler(DraftApproved))
+	mux.HandleFunc("POST /drafts/{id}/reject", a.draftDecisionHandler(DraftRejected))
+	return mux
+}
+
+// Fetch, Insert, Analyze and Draft are the stages of a fetch job (see jobPipeline)
+
+func (a *App) Fetch(ctx context.Context, packageName string, count int, incremental bool, opts fetchOptions, progress ProgressFunc) (*fetchResult, error) {
+	if incremental {
+		return a.syncReviews(ctx, packageName, count, opts.TranslationLanguage, progress)
+	}
+	reviews, _, err := fetchReviews(ctx, a.play, packageName, count, opts, progress)
+	if err != nil {
+		return nil, err
+	}
+	return &fetchResult{Reviews: reviews}, nil
+}
+
+// Insert stores the fetched reviews, then moves the sync checkpoint so that a failed
+// insert is fetched again by the next sync
+func (a *App) Insert(ctx context.Context, fetched *fetchResult, progress ProgressFunc) error {
+	if err := pushReviews(ctx, a.store, fetched.Reviews, progress); err != nil {
+		return err
+	}
+	if fetched.Checkpoint != nil {
+		if err := a.store.SaveSyncCheckpoint(ctx, fetched.Checkpoint); err != nil {
+			return newError(KindStorage, "failed to save sync checkpoint", err)
+		}
+	}
+	return nil
+}
+
+func (a *App) Analyze(ctx context.Context, packageName string, progress ProgressFunc) error {
+	if a.analyzer == nil {
+		return nil
+	}
+	if err := a.analyzer.Analyze(ctx, packageName, progress); err != nil {
+		return err
+	}
+	// Tags of a failed mapping are mapped by the next run, those matching no label stay in the
+	// unmapped bucket until the taxonomy changes
+	if err := a.mapTags(ctx, packageName); err != nil {
+		log.Printf("Failed to map the tags of %s to the taxonomy: %v", packageName, err)
+	}
+	return nil
+}
+
+func (a *App) Draft(ctx context.Context, packageName string, progress ProgressFunc) error {
+	return a.draftReplies(ctx, packageName, progress)
+}
@@ -0,0 +1,322 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Bounds of the settings of a registered app, their defaults are in the Config
+const (
+	maxFetchCount    = 10000
+	maxWindowDays    = 365
+	maxAppTextLength = 100 // display name and team
+)
+
+// RegisteredApp is an app of the portfolio we follow (apps table). Its settings replace the
+// defaults when fetching and analyzing its reviews.
+type RegisteredApp struct {
+	PackageName string `bigquery:"app_name" json:"package_name"`
+	DisplayName string `bigquery:"display_name" json:"display_name"`
+	Team        string `bigquery:"team" json:"team"` // owning team
+
+	FetchCount         int64 `bigquery:"fetch_count" json:"fetch_count"`                   // reviews per fetch when the request has no count
+	AnalysisWindowDays int64 `bigquery:"analysis_window_days" json:"analysis_window_days"` // only reviews modified in the last days are analyzed
+	AnalysisMaxStars   int64 `bigquery:"analysis_max_stars" json:"analysis_max_stars"`     // versions with a review this bad or worse are analyzed
+
+	CreatedAt time.Time `bigquery:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bigquery:"updated_at" json:"updated_at"`
+}
+
+// AppStats sums up the stored reviews and analyses of an app
+type AppStats struct {
+	ReviewCount       int64      `json:"review_count"`
+	AverageRating     float64    `json:"average_rating"`
+	RecentReviewCount int64      `json:"recent_review_count"` // modified within the analysis window of the app
+	RecentRating      float64    `json:"recent_rating"`       // average of the recent reviews, 0 if there are none
+	LatestReviewAt    *time.Time `json:"latest_review_at"`
+	LastAnalysisAt    *time.Time `json:"last_analysis_at"`
+}
+
+// PortfolioEntry is a row of the portfolio overview
+type PortfolioEntry struct {
+	RegisteredApp
+	AppStats
+}
+
+// withDefaults fills the unset settings from the configuration
+func (r RegisteredApp) withDefaults(cfg *Config) RegisteredApp {
+	if r.DisplayName == "" {
+		r.DisplayName = r.PackageName
+	}
+	if r.FetchCount == 0 {
+		r.FetchCount = int64(cfg.DefaultFetchCount)
+	}
+	if r.AnalysisWindowDays == 0 {
+		r.AnalysisWindowDays = int64(cfg.AnalysisWindowDays)
+	}
+	if r.AnalysisMaxStars == 0 {
+		r.AnalysisMaxStars = cfg.AnalysisMaxStars
+	}
+	return r
+}
+
+// analysisWindow returns the window of the analysis of the app
+func (r *RegisteredApp) analysisWindow() time.Duration {
+	return time.Duration(r.AnalysisWindowDays) * 24 * time.Hour
+}
+
+func validateRegisteredApp(r *RegisteredApp) error {
+	if err := validatePackageName(r.PackageName); err != nil {
+		return err
+	}
+	if utf8.RuneCountInString(r.DisplayName) > maxAppTextLength || utf8.RuneCountInString(r.Team) > maxAppTextLength {
+		return invalidArgument(fmt.Sprintf("display name and team are limited to %d characters", maxAppTextLength))
+	}
+	if r.FetchCount < 1 || r.FetchCount > maxFetchCount {
+		return invalidArgument(fmt.Sprintf("fetch count must be between 1 and %d", maxFetchCount))
+	}
+	if r.AnalysisWindowDays < 1 || r.AnalysisWindowDays > maxWindowDays {
+		return invalidArgument(fmt.Sprintf("analysis window must be between 1 and %d days", maxWindowDays))
+	}
+	if r.AnalysisMaxStars < 1 || r.AnalysisMaxStars > 5 {
+		return invalidArgument("analysis max stars must be between 1 and 5")
+	}
+	return nil
+}
+
+// registeredApp returns the registration of a package, nil if it is not registered
+func (a *App) registeredApp(ctx context.Context, packageName string) (*RegisteredApp, error) {
+	app, err := a.store.App(ctx, packageName)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read registered app", err)
+	}
+	return app, nil
+}
+
+// portfolio lists the registered apps with the stats of their reviews, by display name
+func (a *App) portfolio(ctx context.Context) ([]PortfolioEntry, error) {
+	apps, err := a.store.Apps(ctx)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to list registered apps", err)
+	}
+
+	// Recent reviews are those of the analysis window of each app, one query per window
+	byWindow := map[time.Duration][]string{}
+	for _, app := range apps {
+		app = app.withDefaults(&a.cfg)
+		window := app.analysisWindow()
+		byWindow[window] = append(byWindow[window], app.PackageName)
+	}
+	stats := map[string]*AppStats{}
+	now := time.Now()
+	for window, packageNames := range byWindow {
+		windowStats, err := a.store.AppStats(ctx, packageNames, now.Add(-window))
+		if err != nil {
+			return nil, newError(KindStorage, "failed to compute app stats", err)
+		}
+		for packageName, st := range windowStats {
+			stats[packageName] = st
+		}
+	}
+
+	entries := make([]PortfolioEntry, 0, len(apps))
+	for _, app := range apps {
+		entry := PortfolioEntry{RegisteredApp: app}
+		if s := stats[app.PackageName]; s != nil {
+			entry.AppStats = *s
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return strings.ToLower(entries[i].DisplayName) < strings.ToLower(entries[j].DisplayName)
+	})
+	return entries, nil
+}
+
+// decodeRegisteredApp reads a RegisteredApp JSON body and applies the defaults
+func (a *App) decodeRegisteredApp(w http.ResponseWriter, r *http.Request) (*RegisteredApp, error) {
+	var app RegisteredApp
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&app); err != nil {
+		return nil, invalidArgument("invalid JSON body")
+	}
+	app.DisplayName = strings.TrimSpace(app.DisplayName)
+	app.Team = strings.TrimSpace(app.Team)
+	app = app.withDefaults(&a.cfg)
+	if err := validateRegisteredApp(&app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+func (a *App) appsHandler(w http.ResponseWriter, r *http.Request) {
+	apps, err := a.store.Apps(r.Context())
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to list registered apps", err))
+		return
+	}
+	if apps == nil {
+		apps = []RegisteredApp{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apps)
+}
+
+// createAppHandler registers an app, it fails if the package is registered already
+func (a *App) createAppHandler(w http.ResponseWriter, r *http.Request) {
+	app, err := a.decodeRegisteredApp(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.appsMu.Lock()
+	defer a.appsMu.Unlock()
+
+	existing, err := a.registeredApp(r.Context(), app.PackageName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if existing != nil {
+		writeError(w, &AppError{Kind: KindConflict, Message: fmt.Sprintf("app %s is registered already", app.PackageName)})
+		return
+	}
+
+	app.CreatedAt = time.Now().UTC()
+	app.UpdatedAt = app.CreatedAt
+	if err := a.store.SaveApp(r.Context(), app); err != nil {
+		writeError(w, newError(KindStorage, "failed to register app", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/apps/"+app.PackageName)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(app)
+}
+
+func (a *App) appHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	app, err := a.store.App(r.Context(), packageName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "app not registered"})
+			return
+		}
+		writeError(w, newError(KindStorage, "failed to read registered app", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app)
+}
+
+// updateAppHandler replaces the settings of a registered app. Omitted settings go back to
+// their defaults, the package name cannot change.
+func (a *App) updateAppHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	app, err := a.decodeRegisteredApp(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if app.PackageName != packageName {
+		writeError(w, invalidArgument("the package name of a registered app cannot change"))
+		return
+	}
+
+	a.appsMu.Lock()
+	defer a.appsMu.Unlock()
+
+	existing, err := a.registeredApp(r.Context(), packageName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if existing == nil {
+		writeError(w, &AppError{Kind: KindNotFound, Message: "app not registered"})
+		return
+	}
+
+	app.CreatedAt = existing.CreatedAt
+	app.UpdatedAt = time.Now().UTC()
+	if err := a.store.SaveApp(r.Context(), app); err != nil {
+		writeError(w, newError(KindStorage, "failed to update app", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(app)
+}
+
+// deleteAppHandler unregisters an app and drops its schedule, its reviews and analyses are kept
+func (a *App) deleteAppHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.appsMu.Lock()
+	defer a.appsMu.Unlock()
+
+	if err := a.store.DeleteApp(r.Context(), packageName); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "app not registered"})
+			return
+		}
+		writeError(w, newError(KindStorage, "failed to unregister app", err))
+		return
+	}
+	if err := a.store.DeleteSchedule(r.Context(), packageName); err != nil && !errors.Is(err, ErrNotFound) {
+		writeError(w, newError(KindStorage, "app unregistered but its schedule could not be deleted", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *App) portfolioHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := a.portfolio(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -1,19 +1,20 @@
-CREATE OR REPLACE PROCEDURE `play_store_reviews_demo.pre_process_reviews_in_bq`(package_name STRING)
+CREATE OR REPLACE PROCEDURE `play_store_reviews_demo.pre_process_reviews_in_bq`(package_name STRING, window_days INT64, max_stars INT64, chunk_size INT64)
 BEGIN
 
   DECLARE done BOOLEAN DEFAULT FALSE;
   DECLARE current_version STRING;
   DECLARE gemini_result STRING;
 
-  DECLARE p_limit INT64 DEFAULT 100;
+  -- window_days, max_stars and chunk_size come from the configuration (30, 3 and 100 by default)
+  DECLARE p_limit INT64 DEFAULT chunk_size;
   DECLARE p_page INT64 DEFAULT 0;
   DECLARE total_rows INT64;
 
   CREATE TEMP TABLE versions AS
   SELECT DISTINCT version, app_name
   FROM `play_store_reviews_demo.raw_reviews`
-  WHERE last_modified >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 30 DAY)
-    AND star_rating <= 3 AND version != '' AND app_name = package_name;
+  WHERE last_modified >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL window_days DAY)
+    AND star_rating <= max_stars AND version != '' AND app_name = package_name;
 
 
   LOOP
@@ -27,27 +28,32 @@ BEGIN
         SELECT COUNT(*)
         FROM `play_store_reviews_demo.raw_reviews`
         WHERE version = current_version
-          AND last_modified >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 30 DAY)
+          AND last_modified >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL window_days DAY)
           AND app_name = package_name
       );
 
+      -- The chunks left by a run that failed before processing would be reduced with these
+      UPDATE `play_store_reviews_demo.reviews_to_process` SET processed_at = CURRENT_TIMESTAMP()
+      WHERE app_name = package_name AND IFNULL(version, '') = current_version AND processed_at IS NULL;
+
       SET p_page = 0;
 
       LOOP
         -- Construct and execute dynamic query for the current version
+        -- Version and package name are passed as parameters, never formatted into the query text
         EXECUTE IMMEDIATE FORMAT("""
         SELECT ml_generate_text_llm_result FROM ML.GENERATE_TEXT(MODEL `play_store_reviews_demo.gemini_model`,
           (
             SELECT 
-            '''You are a app review summarizer. From the following text that contains user reviews/comments, create a summary with the overall sentiment outlining positives and negatives. Also, for any negative comments (star_rating <= 3), generate tags describing what is wrong.  The output should be a single JSON object with two fields: "summary" and "details". The "summary" field contains the overall summary, and the "details" field is an array of JSON objects, each with "comment_id" and "tags" (all tags per comment_id, comma separated). Format the output strictly as a JSON object.  You cannot return empty for summary because you know how to pick up sensible data from following input text: ''' || combined_comments AS prompt
+            '''You are a app review summarizer. From the following text that contains user reviews/comments, create a summary with the overall sentiment outlining positives and negatives. Also, for any negative comments (star_rating <= %d), generate tags describing what is wrong.  The output should be a single JSON object with two fields: "summary" and "details". The "summary" field contains the overall summary, and the "details" field is an array of JSON objects, each with "comment_id", "tags" (an array of short tags), "severity" (one of low, medium, high, critical) and "category" (one of stability, performance, usability, functionality, account, billing, ads, privacy, content, other). Format the output strictly as a JSON object.  You cannot return empty for summary because you know how to pick up sensible data from following input text: ''' || combined_comments AS prompt
             FROM (
                 SELECT STRING_AGG(TO_JSON_STRING(t), ' ') as combined_comments
                 FROM (
                   SELECT struct(review_id, star_rating, comments) AS t
                   FROM `play_store_reviews_demo.raw_reviews`
-                  WHERE version = "%s"
-                    AND last_modified >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL 30 DAY)
-                    AND app_name = "%s"
+                  WHERE version = @version
+                    AND last_modified >= TIMESTAMP_SUB(CURRENT_TIMESTAMP(), INTERVAL @window_days DAY)
+                    AND app_name = @app_name
                     LIMIT %d OFFSET %d
                 )
             )
@@ -58,7 +64,7 @@ BEGIN
                   STRUCT('HARM_CATEGORY_SEXUALLY_EXPLICIT' AS category, 'BLOCK_NONE' AS threshold),
                   STRUCT('HARM_CATEGORY_HARASSMENT' AS category, 'BLOCK_NONE' AS threshold)] AS safety_settings)
         );
-        """, current_version, package_name, p_limit, (p_limit * p_page)) INTO gemini_result;
+        """, max_stars, p_limit, (p_limit * p_page)) INTO gemini_result USING current_version AS version, package_name AS app_name, window_days AS window_days;
         
         INSERT INTO `play_store_reviews_demo.reviews_to_process` (app_name, gemini_response, created_at, processed_at, version)
         VALUES (package_name, gemini_result, CURRENT_TIMESTAMP(), NULL, current_version);
@@ -0,0 +1,475 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// command is a subcommand of the CLI. Commands print their results on stdout, as a table
+// or as JSON, and log their progress on stderr so that the output can be piped.
+type command struct {
+	name    string
+	aliases []string
+	args    []string // names of the positional arguments
+	help    string
+	flags   func(fs *flag.FlagSet) // declares the flags, besides --json
+	run     func(ctx context.Context, app *App, c *commandContext) error
+}
+
+// commandContext holds the parsed arguments of a command
+type commandContext struct {
+	args []string
+	json bool
+	out  io.Writer
+	fs   *flag.FlagSet
+}
+
+var commands = []command{
+	{
+		name: "fetch", args: []string{"package"},
+		help: "fetch reviews from Play and store them",
+		flags: func(fs *flag.FlagSet) {
+			fs.Int("count", 0, "reviews to fetch, the app's fetch_count or the default fetch count when unset")
+			fs.Bool("incremental", false, "only fetch reviews added or edited since the last incremental fetch")
+			fs.String("translation-language", "", "translate the reviews to this language, e.g. en")
+			fs.Bool("analyze", false, "also analyze the reviews and draft replies, like a fetch job")
+		},
+		run: fetchCommand,
+	},
+	{name: "analyze", args: []string{"package"}, help: "analyze the stored reviews with Gemini", run: analyzeCommand},
+	{name: "versions", args: []string{"package"}, help: "list the analyzed versions", run: versionsCommand},
+	{name: "show", args: []string{"package", "version"}, help: "show the latest analysis of a version", run: showCommand},
+	{name: "comment", args: []string{"package", "comment-id"}, help: "show a stored review", run: commentCommand},
+	{
+		name: "export", args: []string{"package"},
+		help: "export the latest analysis of every version, one row per tagged review",
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("csv", false, "write CSV instead of a table")
+		},
+		run: exportCommand,
+	},
+	{
+		name: "init", aliases: []string{"migrate"},
+		help: "create or update the BigQuery dataset, tables, stored procedure and remote model",
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("dry-run", false, "only report what would change")
+		},
+		run: migrateCommand,
+	},
+	{name: "dedup", help: "remove duplicate reviews, keeping the latest edit", run: dedupCommand},
+	{name: "schedule", help: "start the due schedules and wait for their jobs, for one-shot runs", run: scheduleCommand},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+		for _, alias := range commands[i].aliases {
+			if alias == name {
+				return &commands[i]
+			}
+		}
+	}
+	return nil
+}
+
+// isHelp reports whether args ask for the usage, which needs no App
+func isHelp(args []string) bool {
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		return true
+	}
+	return false
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s [options] [command] [arguments] [--json]\n\nWithout a command the HTTP server is started.\n\nCommands:\n", os.Args[0])
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		usage := strings.Join(append([]string{c.name}, c.aliases...), "|")
+		for _, arg := range c.args {
+			usage += " <" + arg + ">"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\n", usage, c.help)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nOptions, that override the config file and the environment:\n")
+	printConfigFlags(w)
+}
+
+// runCommand runs the command named by args[0] with the rest of args
+func runCommand(ctx context.Context, app *App, args []string) error {
+	c := findCommand(args[0])
+	if c == nil {
+		printUsage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	fs := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	if c.flags != nil {
+		c.flags(fs)
+	}
+
+	positional, err := parseInterspersed(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(positional) != len(c.args) {
+		return fmt.Errorf("%s expects %d arguments (%s), got %d", c.name, len(c.args), strings.Join(c.args, ", "), len(positional))
+	}
+
+	return c.run(ctx, app, &commandContext{args: positional, json: *asJSON, out: os.Stdout, fs: fs})
+}
+
+// parseInterspersed parses flags placed before, between or after the positional arguments,
+// which the flag package alone stops at, and returns the positional arguments
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func (c *commandContext) flag(name string) flag.Getter {
+	return c.fs.Lookup(name).Value.(flag.Getter)
+}
+
+// print writes v as JSON with --json, otherwise the rows as a table under header
+func (c *commandContext) print(v any, header []string, rows [][]string) error {
+	if c.json {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		// Tabs and newlines in reviews would break the columns
+		for i := range row {
+			row[i] = strings.Join(strings.Fields(row[i]), " ")
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// logProgress reports the progress of a stage on stderr
+func logProgress(stage string) ProgressFunc {
+	return func(done, total int, message string) {
+		log.Printf("%s: %s (%d/%d)", stage, message, done, total)
+	}
+}
+
+func fetchCommand(ctx context.Context, app *App, c *commandContext) error {
+	packageName := c.args[0]
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+
+	count := c.flag("count").Get().(int)
+	if count <= 0 {
+		count = app.cfg.DefaultFetchCount
+		registered, err := app.registeredApp(ctx, packageName)
+		if err != nil {
+			return err
+		}
+		if registered != nil {
+			count = int(registered.FetchCount)
+		}
+	}
+	incremental := c.flag("incremental").Get().(bool)
+	opts := fetchOptions{TranslationLanguage: c.flag("translation-language").Get().(string)}
+	if opts.TranslationLanguage != "" {
+		if err := validateLanguage(opts.TranslationLanguage); err != nil {
+			return err
+		}
+	}
+
+	fetched, err := app.Fetch(ctx, packageName, count, incremental, opts, logProgress(JobFetching))
+	if err != nil {
+		return err
+	}
+	if err := app.Insert(ctx, fetched, logProgress(JobInserting)); err != nil {
+		return err
+	}
+
+	analyzed := c.flag("analyze").Get().(bool)
+	if analyzed {
+		if err := app.Analyze(ctx, packageName, logProgress(JobAnalyzing)); err != nil {
+			return err
+		}
+		if err := app.Draft(ctx, packageName, logProgress(JobDrafting)); err != nil {
+			return err
+		}
+	}
+
+	result := struct {
+		PackageName string `json:"package_name"`
+		Fetched     int    `json:"fetched"`
+		Incremental bool   `json:"incremental"`
+		Analyzed    bool   `json:"analyzed"`
+	}{packageName, len(fetched.Reviews), incremental, analyzed}
+	return c.print(result, []string{"PACKAGE", "FETCHED", "INCREMENTAL", "ANALYZED"},
+		[][]string{{packageName, strconv.Itoa(result.Fetched), strconv.FormatBool(incremental), strconv.FormatBool(analyzed)}})
+}
+
+func analyzeCommand(ctx context.Context, app *App, c *commandContext) error {
+	packageName := c.args[0]
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+	if app.analyzer == nil {
+		return &AppError{Kind: KindLLM, Message: "no analyzer is configured"}
+	}
+
+	if err := app.Analyze(ctx, packageName, logProgress(JobAnalyzing)); err != nil {
+		return err
+	}
+	return versionsCommand(ctx, app, c)
+}
+
+func versionsCommand(ctx context.Context, app *App, c *commandContext) error {
+	packageName := c.args[0]
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+
+	versions, err := getVersions(ctx, app.store, packageName)
+	if err != nil {
+		return err
+	}
+	if versions == nil {
+		versions = []string{}
+	}
+
+	rows := make([][]string, len(versions))
+	for i, version := range versions {
+		rows[i] = []string{version}
+	}
+	return c.print(versions, []string{"VERSION"}, rows)
+}
+
+func showCommand(ctx context.Context, app *App, c *commandContext) error {
+	packageName, version := c.args[0], c.args[1]
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+	if err := validateVersion(version); err != nil {
+		return err
+	}
+
+	analysis, err := app.latestAnalysis(ctx, packageName, version)
+	if err != nil {
+		return err
+	}
+	if analysis.Summary == "" && len(analysis.Details) == 0 {
+		return &AppError{Kind: KindNotFound, Message: "no analysis found for this version"}
+	}
+
+	if !c.json {
+		fmt.Fprintf(c.out, "Summary: %s\n\n", analysis.Summary)
+	}
+	rows := make([][]string, len(analysis.Details))
+	for i, detail := range analysis.Details {
+		rows[i] = []string{detail.CommentID, strings.Join(detail.Tags, ", "), detail.Severity, detail.Category}
+	}
+	return c.print(analysis, []string{"COMMENT ID", "TAGS", "SEVERITY", "CATEGORY"}, rows)
+}
+
+func commentCommand(ctx context.Context, app *App, c *commandContext) error {
+	packageName, commentID := c.args[0], c.args[1]
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+	if err := validateReviewID(commentID); err != nil {
+		return err
+	}
+
+	comment, err := app.store.Comment(ctx, packageName, commentID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return &AppError{Kind: KindNotFound, Message: "comment not found"}
+		}
+		return newError(KindStorage, "failed to fetch comment", err)
+	}
+
+	rows := [][]string{
+		{"Comment ID", comment.ReviewID},
+		{"Author", comment.AuthorName},
+		{"Version", comment.Version},
+		{"Rating", strconv.FormatInt(comment.StarRating, 10)},
+		{"Last modified", comment.LastModified.Format(lastModifiedLayout)},
+		{"Language", comment.ReviewerLanguage},
+		{"Device", comment.Device},
+		{"Comment", comment.Comments},
+	}
+	if comment.DeveloperComment != nil {
+		rows = append(rows, []string{"Developer reply", comment.DeveloperComment.Text})
+	}
+	return c.print(comment, []string{"FIELD", "VALUE"}, rows)
+}
+
+func exportCommand(ctx context.Context, app *App, c *commandContext) error {
+	packageName := c.args[0]
+	if err := validatePackageName(packageName); err != nil {
+		return err
+	}
+
+	versions, err := getVersions(ctx, app.store, packageName)
+	if err != nil {
+		return err
+	}
+
+	type versionAnalysis struct {
+		Version string `json:"version"`
+		*GeminiResponse
+	}
+	analyses := []versionAnalysis{}
+	header := []string{"VERSION", "COMMENT ID", "TAGS", "SEVERITY", "CATEGORY"}
+	var rows [][]string
+	for _, version := range versions {
+		analysis, err := app.latestAnalysis(ctx, packageName, version)
+		if err != nil {
+			return fmt.Errorf("version %s: %w", version, err)
+		}
+		analyses = append(analyses, versionAnalysis{Version: version, GeminiResponse: analysis})
+		for _, detail := range analysis.Details {
+			rows = append(rows, []string{version, detail.CommentID, strings.Join(detail.Tags, ", "), detail.Severity, detail.Category})
+		}
+	}
+
+	if c.flag("csv").Get().(bool) && !c.json {
+		w := csv.NewWriter(c.out)
+		w.Write(header)
+		w.WriteAll(rows)
+		return w.Error()
+	}
+	return c.print(analyses, header, rows)
+}
+
+// migrateCommand provisions BigQuery, it fails when objects do not match after reporting the diff
+func migrateCommand(ctx context.Context, app *App, c *commandContext) error {
+	if app.bqClient == nil {
+		log.Printf("Nothing to migrate, the %s store creates its tables when opened", app.cfg.ReviewStore)
+		return nil
+	}
+
+	m := &migrator{client: app.bqClient, cfg: app.cfg, dryRun: c.flag("dry-run").Get().(bool)}
+	steps, err := m.Run(ctx)
+	if err != nil {
+		// Report what was done before the failure
+		c.print(steps, migrationHeader, migrationRows(steps))
+		return err
+	}
+	if err := c.print(steps, migrationHeader, migrationRows(steps)); err != nil {
+		return err
+	}
+
+	mismatches := 0
+	for _, step := range steps {
+		if step.Status == MigrationMismatch {
+			mismatches++
+		}
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%d objects do not match their schema, see the diff", mismatches)
+	}
+	return nil
+}
+
+var migrationHeader = []string{"OBJECT", "KIND", "STATUS", "DIFF"}
+
+// migrationRows puts every line of the diff on its own row
+func migrationRows(steps []MigrationStep) [][]string {
+	var rows [][]string
+	for _, step := range steps {
+		row := []string{step.Object, step.Kind, step.Status, ""}
+		if len(step.Diff) > 0 {
+			row[3] = step.Diff[0]
+		}
+		rows = append(rows, row)
+		for _, d := range step.Diff[min(1, len(step.Diff)):] {
+			rows = append(rows, []string{"", "", "", d})
+		}
+	}
+	return rows
+}
+
+func dedupCommand(ctx context.Context, app *App, c *commandContext) error {
+	removed, err := app.store.DedupReviews(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Removed %d duplicate reviews", removed)
+
+	result := struct {
+		Removed int64 `json:"removed"`
+	}{removed}
+	return c.print(result, []string{"REMOVED"}, [][]string{{strconv.FormatInt(removed, 10)}})
+}
+
+// scheduleCommand is the one-shot scheduler, e.g. as a Cloud Run job triggered by Cloud Scheduler
+func scheduleCommand(ctx context.Context, app *App, c *commandContext) error {
+	started, err := app.scheduler.RunDue(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Started %d scheduled runs", len(started))
+	if err := app.scheduler.Wait(ctx); err != nil {
+		return err
+	}
+
+	// Read the schedules back for the outcome of the runs
+	var results []Schedule
+	var rows [][]string
+	for _, sched := range started {
+		current, err := app.store.Schedule(ctx, sched.PackageName)
+		if err != nil {
+			return newError(KindStorage, "failed to read schedule", err)
+		}
+		results = append(results, *current)
+		rows = append(rows, []string{current.PackageName, current.LastJobID, current.LastStatus, current.LastError})
+	}
+	if results == nil {
+		results = []Schedule{}
+	}
+	return c.print(results, []string{"PACKAGE", "JOB", "STATUS", "ERROR"}, rows)
+}
@@ -0,0 +1,267 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// minShareChange is the change of the share of the tagged reviews making an issue growing or shrinking
+const minShareChange = 0.05
+
+// How an issue changed between two versions
+const (
+	IssueNew       = "new"       // only in the target version
+	IssueResolved  = "resolved"  // only in the base version
+	IssueGrowing   = "growing"   // in a larger share of the tagged reviews
+	IssueShrinking = "shrinking" // in a smaller share
+	IssueStable    = "stable"
+)
+
+// issueChangeOrder sorts the issues of a comparison, regressions first
+var issueChangeOrder = map[string]int{IssueNew: 0, IssueGrowing: 1, IssueResolved: 2, IssueShrinking: 3, IssueStable: 4}
+
+// VersionStats sums up the stored reviews of a version
+type VersionStats struct {
+	ReviewCount   int64    `json:"review_count"`
+	AverageRating float64  `json:"average_rating"`
+	StarCounts    [5]int64 `json:"star_counts"` // reviews with 1 to 5 stars
+}
+
+// newVersionStats sums up the number of reviews with 1 to 5 stars
+func newVersionStats(starCounts [5]int64) *VersionStats {
+	st := &VersionStats{StarCounts: starCounts}
+	var stars int64
+	for i, n := range starCounts {
+		st.ReviewCount += n
+		stars += int64(i+1) * n
+	}
+	if st.ReviewCount > 0 {
+		st.AverageRating = float64(stars) / float64(st.ReviewCount)
+	}
+	return st
+}
+
+// VersionSide is one of the two versions of a comparison
+type VersionSide struct {
+	Version string `json:"version"`
+	VersionStats
+	Analyzed          bool   `json:"analyzed"`
+	TaggedReviewCount int    `json:"tagged_review_count"` // negative reviews with at least a tag
+	Summary           string `json:"summary"`             // "" if the version was not analyzed
+}
+
+// IssueChange is the frequency of an issue in both versions. Issues are the taxonomy labels,
+// unmapped tags being compared on their own.
+type IssueChange struct {
+	Issue       string  `json:"issue"`
+	Mapped      bool    `json:"mapped"` // false if the issue is an unmapped tag
+	BaseCount   int     `json:"base_count"`
+	TargetCount int     `json:"target_count"`
+	BaseShare   float64 `json:"base_share"` // of the tagged reviews of the version
+	TargetShare float64 `json:"target_share"`
+	Change      string  `json:"change"`
+}
+
+// VersionComparison is what got better or worse in a version compared to another
+type VersionComparison struct {
+	PackageName      string        `json:"package_name"`
+	Base             VersionSide   `json:"base"`
+	Target           VersionSide   `json:"target"`
+	RatingDelta      float64       `json:"rating_delta"` // target minus base
+	ReviewCountDelta int64         `json:"review_count_delta"`
+	StarDeltas       [5]int64      `json:"star_deltas"`
+	Issues           []IssueChange `json:"issues"`    // regressions first, empty unless both versions were analyzed
+	Narrative        string        `json:"narrative"` // written by Gemini, "" without a model or both analyses
+}
+
+// comparePromptIntro starts the prompt describing a comparison
+const comparePromptIntro = "You are a product analyst comparing the reviews of two versions of an app."
+
+const comparePrompt = comparePromptIntro + ` Below is the comparison of version %s of the Android app %s with version %s: ratings, review volume, issues of the negative reviews with their share of the tagged reviews, and the summary of each version. In one short paragraph for product managers, explain what got worse and what got better in version %s, starting with the regressions. Answer with the text only.
+
+Comparison: %s`
+
+// compareVersions builds the comparison of target with base, and asks llm for its narrative
+func compareVersions(ctx context.Context, store ReviewStore, llm LLMClient, packageName, base, target string) (*VersionComparison, error) {
+	stats, err := store.VersionStats(ctx, packageName, []string{base, target})
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read version stats", err)
+	}
+
+	c := &VersionComparison{PackageName: packageName, Issues: []IssueChange{}}
+	sides := [2]*VersionSide{&c.Base, &c.Target}
+	var analyses [2]*VersionAnalysis
+	for i, version := range []string{base, target} {
+		side := sides[i]
+		side.Version = version
+		if st, ok := stats[version]; ok {
+			side.VersionStats = *st
+		}
+
+		analysis, err := versionAnalysis(ctx, store, packageName, version)
+		if err != nil {
+			return nil, err
+		}
+		if analysis == nil && side.ReviewCount == 0 {
+			return nil, &AppError{Kind: KindNotFound, Message: fmt.Sprintf("no reviews found for version %s", version)}
+		}
+		if analysis != nil {
+			side.Analyzed = true
+			side.Summary = analysis.Summary
+		}
+		analyses[i] = analysis
+	}
+
+	c.RatingDelta = c.Target.AverageRating - c.Base.AverageRating
+	c.ReviewCountDelta = c.Target.ReviewCount - c.Base.ReviewCount
+	for i := range c.StarDeltas {
+		c.StarDeltas[i] = c.Target.StarCounts[i] - c.Base.StarCounts[i]
+	}
+	// Issues missing from a version that was not analyzed would read as resolved or new
+	if !c.Base.Analyzed || !c.Target.Analyzed {
+		return c, nil
+	}
+
+	counts := map[string][2]int{}
+	mapped := map[string]bool{}
+	for i, analysis := range analyses {
+		reviews := map[string]map[string]bool{} // issue -> reviews
+		tagged := map[string]bool{}
+		for _, tag := range analysis.Tags {
+			issue := tag.Label
+			if issue == unmappedLabel {
+				issue = tagKey(tag.Tag)
+			} else {
+				mapped[issue] = true
+			}
+			if reviews[issue] == nil {
+				reviews[issue] = map[string]bool{}
+			}
+			reviews[issue][tag.ReviewID] = true
+			tagged[tag.ReviewID] = true
+		}
+		sides[i].TaggedReviewCount = len(tagged)
+		for issue, ids := range reviews {
+			n := counts[issue]
+			n[i] = len(ids)
+			counts[issue] = n
+		}
+	}
+
+	for issue, n := range counts {
+		change := IssueChange{
+			Issue:       issue,
+			Mapped:      mapped[issue],
+			BaseCount:   n[0],
+			TargetCount: n[1],
+			BaseShare:   share(n[0], c.Base.TaggedReviewCount),
+			TargetShare: share(n[1], c.Target.TaggedReviewCount),
+		}
+		switch delta := change.TargetShare - change.BaseShare; {
+		case n[0] == 0:
+			change.Change = IssueNew
+		case n[1] == 0:
+			change.Change = IssueResolved
+		case delta >= minShareChange:
+			change.Change = IssueGrowing
+		case delta <= -minShareChange:
+			change.Change = IssueShrinking
+		default:
+			change.Change = IssueStable
+		}
+		c.Issues = append(c.Issues, change)
+	}
+	sort.Slice(c.Issues, func(i, j int) bool {
+		a, b := c.Issues[i], c.Issues[j]
+		if issueChangeOrder[a.Change] != issueChangeOrder[b.Change] {
+			return issueChangeOrder[a.Change] < issueChangeOrder[b.Change]
+		}
+		if da, db := math.Abs(a.TargetShare-a.BaseShare), math.Abs(b.TargetShare-b.BaseShare); da != db {
+			return da > db
+		}
+		return a.Issue < b.Issue
+	})
+
+	// The figures are useful on their own, a failed narrative is only logged
+	if llm != nil {
+		if c.Narrative, err = compareNarrative(ctx, llm, c); err != nil {
+			log.Printf("Failed to write the comparison of %s %s with %s: %v", packageName, target, base, err)
+		}
+	}
+	return c, nil
+}
+
+func share(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+// compareNarrative asks the model to explain a comparison
+func compareNarrative(ctx context.Context, llm LLMClient, c *VersionComparison) (string, error) {
+	comparison, err := json.Marshal(c)
+	if err != nil {
+		return "", newError(KindInternal, "failed to encode the comparison", err)
+	}
+
+	answer, err := llm.Generate(ctx, fmt.Sprintf(comparePrompt, c.Target.Version, c.PackageName, c.Base.Version, c.Target.Version, comparison))
+	if err != nil {
+		return "", newError(KindLLM, "failed to write the comparison", err)
+	}
+	return strings.TrimSpace(answer), nil
+}
+
+func (a *App) compareHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("package_name")
+	base := r.URL.Query().Get("base")
+	target := r.URL.Query().Get("target")
+
+	if packageName == "" || base == "" || target == "" {
+		writeError(w, invalidArgument("package name, base and target versions are required"))
+		return
+	}
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, version := range []string{base, target} {
+		if err := validateVersion(version); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	if base == target {
+		writeError(w, invalidArgument("base and target must be different versions"))
+		return
+	}
+
+	comparison, err := compareVersions(r.Context(), a.store, a.llm, packageName, base, target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comparison)
+}
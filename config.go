@@ -0,0 +1,351 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/NucleusEngineering/play-gemini/playapi"
+)
+
+// Bounds of the analysis settings, also enforced on registered apps
+const (
+	maxAnalysisChunkSize = 1000
+	maxPort              = 65535
+)
+
+var (
+	// bigQueryLocationRegex matches multi-regions (US, EU) and regions (us-central1)
+	bigQueryLocationRegex = regexp.MustCompile(`^[a-zA-Z]+(-[a-z]+[0-9]+)?$`)
+	// connectionRegex matches connection IDs, optionally qualified with the location (us.gemini_analysis) and project
+	connectionRegex = regexp.MustCompile(`^([a-z][a-z0-9-]*[a-z0-9]\.)?([a-zA-Z]+(-[a-z]+[0-9]+)?\.)?[a-zA-Z0-9_-]+$`)
+	// geminiModelRegex matches model names like gemini-2.0-flash-001
+	geminiModelRegex = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+)
+
+// Config holds everything needed to build an App. Every setting is read from, by increasing
+// precedence: its default, the YAML config file, its environment variable and its flag.
+type Config struct {
+	Port       string `yaml:"port" json:"port"`
+	ProjectID  string `yaml:"project_id" json:"project_id"`
+	DatasetID  string `yaml:"dataset" json:"dataset"`
+	TableID    string `yaml:"table" json:"table"`
+	Location   string `yaml:"location" json:"location"`     // of the dataset, where BigQuery jobs run
+	Connection string `yaml:"connection" json:"connection"` // BigQuery connection to Vertex AI of the gemini_model remote model
+
+	ReviewStore      string `yaml:"review_store" json:"review_store"` // bigquery, memory or sqlite
+	SQLitePath       string `yaml:"sqlite_path" json:"sqlite_path"`
+	ReviewInsertMode string `yaml:"review_insert_mode" json:"review_insert_mode"` // merge or stream, how the BigQuery store inserts reviews
+
+	Analyzer       string `yaml:"analyzer" json:"analyzer"`         // procedure or pipeline, empty to pick from the store
+	LLMProvider    string `yaml:"llm_provider" json:"llm_provider"` // bigquery, vertex, gemini or fake, empty to pick from the store
+	GeminiModel    string `yaml:"gemini_model" json:"gemini_model"`
+	VertexLocation string `yaml:"vertex_location" json:"vertex_location"`
+	GeminiAPIKey   string `yaml:"gemini_api_key" json:"gemini_api_key"` // secret
+	LLMFakeFile    string `yaml:"llm_fake_response_file" json:"llm_fake_response_file"`
+
+	// Defaults of the analysis, registered apps can have their own
+	AnalysisWindowDays int    `yaml:"analysis_window_days" json:"analysis_window_days"` // only reviews modified in the last days
+	AnalysisMaxStars   int64  `yaml:"analysis_max_stars" json:"analysis_max_stars"`     // a version is analyzed if it has at least one review with star_rating <= it
+	AnalysisChunkSize  int    `yaml:"analysis_chunk_size" json:"analysis_chunk_size"`   // reviews sent to Gemini per request
+	TaxonomyFile       string `yaml:"taxonomy_file" json:"taxonomy_file"`               // canonical labels of the tags, the built-in taxonomy if empty
+
+	PlayAPIURL             string `yaml:"play_api_url" json:"play_api_url"`                             // base URL of the Play Developer API, or of the mock
+	PlayAPIRequestsPerHour int    `yaml:"play_api_requests_per_hour" json:"play_api_requests_per_hour"` // per app, negative for no limit
+
+	DefaultFetchCount int `yaml:"default_fetch_count" json:"default_fetch_count"` // reviews fetched when a request does not say
+	FetchWorkers      int `yaml:"fetch_workers" json:"fetch_workers"`
+
+	RunScheduler   bool     `yaml:"scheduler" json:"scheduler"`             // start the scheduler loop in the server
+	ScheduleJitter Duration `yaml:"schedule_jitter" json:"schedule_jitter"` // longest random delay added to scheduled runs
+}
+
+// Duration is a time.Duration written like "5m" in the config file, the environment and JSON
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:                   "8080",
+		DatasetID:              "play_store_reviews_demo",
+		TableID:                "raw_reviews",
+		Location:               "US",
+		Connection:             "gemini_analysis",
+		SQLitePath:             "reviews.db",
+		ReviewInsertMode:       "merge",
+		GeminiModel:            defaultGeminiModel,
+		VertexLocation:         defaultVertexLocation,
+		AnalysisWindowDays:     30,
+		AnalysisMaxStars:       3,
+		AnalysisChunkSize:      100,
+		PlayAPIURL:             playapi.DefaultBaseURL,
+		PlayAPIRequestsPerHour: 200,
+		DefaultFetchCount:      200,
+		FetchWorkers:           2,
+		ScheduleJitter:         Duration(5 * time.Minute),
+	}
+}
+
+// configEnv maps the flags to their environment variables
+var configEnv = []struct{ flag, env string }{
+	{"port", "PORT"},
+	{"project", "PROJECT_ID"},
+	{"dataset", "BQ_DATASET"},
+	{"table", "BQ_TABLE"},
+	{"location", "BQ_LOCATION"},
+	{"connection", "BQ_CONNECTION"},
+	{"review-store", "REVIEW_STORE"},
+	{"sqlite-path", "SQLITE_PATH"},
+	{"review-insert-mode", "REVIEW_INSERT_MODE"},
+	{"analyzer", "ANALYZER"},
+	{"llm-provider", "LLM_PROVIDER"},
+	{"gemini-model", "GEMINI_MODEL"},
+	{"vertex-location", "VERTEX_LOCATION"},
+	{"gemini-api-key", "GEMINI_API_KEY"},
+	{"llm-fake-response-file", "LLM_FAKE_RESPONSE_FILE"},
+	{"analysis-window-days", "ANALYSIS_WINDOW_DAYS"},
+	{"analysis-max-stars", "ANALYSIS_MAX_STARS"},
+	{"analysis-chunk-size", "ANALYSIS_CHUNK_SIZE"},
+	{"taxonomy-file", "TAXONOMY_FILE"},
+	{"play-api-url", "PLAY_API_URL"},
+	{"play-api-requests-per-hour", "PLAY_API_REQUESTS_PER_HOUR"},
+	{"default-fetch-count", "DEFAULT_FETCH_COUNT"},
+	{"fetch-workers", "FETCH_WORKERS"},
+	{"scheduler", "SCHEDULER"},
+	{"schedule-jitter", "SCHEDULE_JITTER"},
+}
+
+// configFlags binds the flags of the settings to cfg, their defaults are the values in cfg
+func configFlags(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("play-gemini", flag.ContinueOnError)
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "HTTP port of the server")
+	fs.StringVar(&cfg.ProjectID, "project", cfg.ProjectID, "Google Cloud project")
+	fs.StringVar(&cfg.DatasetID, "dataset", cfg.DatasetID, "BigQuery dataset")
+	fs.StringVar(&cfg.TableID, "table", cfg.TableID, "BigQuery table of the raw reviews")
+	fs.StringVar(&cfg.Location, "location", cfg.Location, "BigQuery location of the dataset")
+	fs.StringVar(&cfg.Connection, "connection", cfg.Connection, "BigQuery connection of the remote model, in the dataset location unless qualified")
+	fs.StringVar(&cfg.ReviewStore, "review-store", cfg.ReviewStore, "where reviews are stored: bigquery, memory or sqlite")
+	fs.StringVar(&cfg.SQLitePath, "sqlite-path", cfg.SQLitePath, "database file of the sqlite store")
+	fs.StringVar(&cfg.ReviewInsertMode, "review-insert-mode", cfg.ReviewInsertMode, "how the BigQuery store inserts reviews: merge or stream")
+	fs.StringVar(&cfg.Analyzer, "analyzer", cfg.Analyzer, "procedure or pipeline, picked from the store by default")
+	fs.StringVar(&cfg.LLMProvider, "llm-provider", cfg.LLMProvider, "bigquery, vertex, gemini or fake, picked from the store by default")
+	fs.StringVar(&cfg.GeminiModel, "gemini-model", cfg.GeminiModel, "Gemini model of the vertex and gemini providers")
+	fs.StringVar(&cfg.VertexLocation, "vertex-location", cfg.VertexLocation, "Vertex AI location")
+	fs.StringVar(&cfg.GeminiAPIKey, "gemini-api-key", cfg.GeminiAPIKey, "Gemini API key, prefer the environment variable")
+	fs.StringVar(&cfg.LLMFakeFile, "llm-fake-response-file", cfg.LLMFakeFile, "canned answer of the fake provider")
+	fs.IntVar(&cfg.AnalysisWindowDays, "analysis-window-days", cfg.AnalysisWindowDays, "days of reviews analyzed")
+	fs.Int64Var(&cfg.AnalysisMaxStars, "analysis-max-stars", cfg.AnalysisMaxStars, "highest star rating of a negative review")
+	fs.IntVar(&cfg.AnalysisChunkSize, "analysis-chunk-size", cfg.AnalysisChunkSize, "reviews sent to Gemini per request")
+	fs.StringVar(&cfg.TaxonomyFile, "taxonomy-file", cfg.TaxonomyFile, "YAML file of the tag taxonomy, the built-in one by default")
+	fs.StringVar(&cfg.PlayAPIURL, "play-api-url", cfg.PlayAPIURL, "base URL of the Play Developer API, or of the mock")
+	fs.IntVar(&cfg.PlayAPIRequestsPerHour, "play-api-requests-per-hour", cfg.PlayAPIRequestsPerHour, "Play Developer API calls per app and hour, negative for no limit")
+	fs.IntVar(&cfg.DefaultFetchCount, "default-fetch-count", cfg.DefaultFetchCount, "reviews fetched when a request does not say")
+	fs.IntVar(&cfg.FetchWorkers, "fetch-workers", cfg.FetchWorkers, "fetch jobs processed at once")
+	fs.BoolVar(&cfg.RunScheduler, "scheduler", cfg.RunScheduler, "run the scheduled fetches from the server")
+	fs.TextVar(&cfg.ScheduleJitter, "schedule-jitter", cfg.ScheduleJitter, "longest random delay added to scheduled runs")
+	return fs
+}
+
+// printConfigFlags prints the flags of the settings with their defaults
+func printConfigFlags(w io.Writer) {
+	cfg := defaultConfig()
+	fs := configFlags(&cfg)
+	fs.String("config", "", "YAML config file, CONFIG_FILE by default")
+	fs.SetOutput(w)
+	fs.PrintDefaults()
+}
+
+// loadConfig builds the configuration from the defaults, the config file (--config or
+// CONFIG_FILE), the environment and the flags in args. It returns the arguments left
+// after the flags, the command if any.
+func loadConfig(args []string) (Config, []string, error) {
+	// Flags are parsed first to find the config file, and applied last
+	var parsed Config
+	fs := configFlags(&parsed)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	cfg := defaultConfig()
+	if *configFile != "" {
+		if err := readConfigFile(*configFile, &cfg); err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	layer := configFlags(&cfg)
+	for _, e := range configEnv {
+		if value := os.Getenv(e.env); value != "" {
+			if err := layer.Set(e.flag, value); err != nil {
+				return Config{}, nil, fmt.Errorf("invalid %s: %w", e.env, err)
+			}
+		}
+	}
+	// MOCK_URI was the former, host only, way to point at the mock
+	if os.Getenv("MOCK_URI") != "" {
+		log.Printf("MOCK_URI is no longer read, set PLAY_API_URL to the URL of the mock with its scheme")
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" && err == nil {
+			err = layer.Set(f.Name, f.Value.String())
+		}
+	})
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return Config{}, nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	return cfg, fs.Args(), nil
+}
+
+// readConfigFile applies the settings of a YAML file to cfg, unknown keys are errors
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > maxPort {
+		return fmt.Errorf("port must be a number between 1 and %d", maxPort)
+	}
+	if err := validateDatasetID(c.DatasetID); err != nil {
+		return fmt.Errorf("dataset: %w", err)
+	}
+	if err := validateDatasetID(c.TableID); err != nil {
+		return fmt.Errorf("table: %w", err)
+	}
+	if !bigQueryLocationRegex.MatchString(c.Location) {
+		return fmt.Errorf("invalid BigQuery location %q", c.Location)
+	}
+	if !connectionRegex.MatchString(c.Connection) {
+		return fmt.Errorf("invalid BigQuery connection %q", c.Connection)
+	}
+
+	if err := oneOf("review store", c.ReviewStore, "", "bigquery", "memory", "sqlite"); err != nil {
+		return err
+	}
+	if err := oneOf("review insert mode", c.ReviewInsertMode, "merge", "stream"); err != nil {
+		return err
+	}
+	if err := oneOf("analyzer", c.Analyzer, "", "procedure", "pipeline"); err != nil {
+		return err
+	}
+	if err := oneOf("LLM provider", c.LLMProvider, "", "bigquery", "vertex", "gemini", "fake"); err != nil {
+		return err
+	}
+	if !geminiModelRegex.MatchString(c.GeminiModel) {
+		return fmt.Errorf("invalid Gemini model %q", c.GeminiModel)
+	}
+	if c.LLMProvider == "gemini" && c.GeminiAPIKey == "" {
+		return fmt.Errorf("the gemini LLM provider needs a Gemini API key")
+	}
+
+	if c.AnalysisWindowDays < 1 || c.AnalysisWindowDays > maxWindowDays {
+		return fmt.Errorf("analysis window must be between 1 and %d days", maxWindowDays)
+	}
+	if c.AnalysisMaxStars < 1 || c.AnalysisMaxStars > 5 {
+		return fmt.Errorf("analysis max stars must be between 1 and 5")
+	}
+	if c.AnalysisChunkSize < 1 || c.AnalysisChunkSize > maxAnalysisChunkSize {
+		return fmt.Errorf("analysis chunk size must be between 1 and %d", maxAnalysisChunkSize)
+	}
+
+	if u, err := url.Parse(c.PlayAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("play API URL must be an http(s) URL")
+	}
+	if c.PlayAPIRequestsPerHour == 0 {
+		return fmt.Errorf("play API requests per hour cannot be 0, use a negative value for no limit")
+	}
+	if c.DefaultFetchCount < 1 || c.DefaultFetchCount > maxFetchCount {
+		return fmt.Errorf("default fetch count must be between 1 and %d", maxFetchCount)
+	}
+	if c.FetchWorkers < 1 {
+		return fmt.Errorf("fetch workers must be at least 1")
+	}
+	if c.ScheduleJitter < 0 {
+		return fmt.Errorf("schedule jitter cannot be negative")
+	}
+	return nil
+}
+
+func oneOf(setting, value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown %s %q", setting, value)
+}
+
+// redacted returns a copy of the configuration that is safe to show
+func (c Config) redacted() Config {
+	if c.GeminiAPIKey != "" {
+		c.GeminiAPIKey = "REDACTED"
+	}
+	if u, err := url.Parse(c.PlayAPIURL); err == nil {
+		c.PlayAPIURL = u.Redacted()
+	}
+	return c
+}
+
+// analysisWindow returns the default window of the analysis
+func (c *Config) analysisWindow() time.Duration {
+	return time.Duration(c.AnalysisWindowDays) * 24 * time.Hour
+}
+
+func (a *App) debugConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.cfg.redacted())
+}
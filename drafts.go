@@ -0,0 +1,367 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Statuses of a reply draft
+const (
+	DraftPending  = "pending"
+	DraftApproved = "approved" // and posted to Play
+	DraftRejected = "rejected"
+)
+
+// Model calls made by a single draftReplies run at most, the rest is drafted by the next runs
+const maxDraftsPerRun = 50
+
+const draftPromptIntro = "You are a support agent of the Android app"
+
+const draftPrompt = draftPromptIntro + ` %s, answering a review on Google Play.
+Write a short, friendly and personalized reply to the review below, in the language the review is written in (reviewer language code: %s).
+Address the specific problems the review mentions, described by the tags below. Do not promise dates or features, do not include links, placeholders or a signature.
+The reply must be at most 350 characters. Answer with the text of the reply only.
+
+Tags: %s
+Rating: %d stars
+Review: %s`
+
+// ReplyDraft is a reply written by Gemini that waits for a human decision (reply_drafts table).
+// Only approved drafts are posted to Play.
+type ReplyDraft struct {
+	ID         string    `bigquery:"draft_id" json:"id"`
+	AppName    string    `bigquery:"app_name" json:"package_name"`
+	ReviewID   string    `bigquery:"review_id" json:"comment_id"`
+	Language   string    `bigquery:"reviewer_language" json:"reviewer_language"`
+	StarRating int64     `bigquery:"star_rating" json:"star_rating"`
+	Review     string    `bigquery:"review_text" json:"review_text"` // copied so the queue can be read on its own
+	Tags       string    `bigquery:"tags" json:"tags"`
+	Text       string    `bigquery:"draft_text" json:"text"`
+	Status     string    `bigquery:"status" json:"status"`
+	CreatedAt  time.Time `bigquery:"created_at" json:"created_at"`
+	UpdatedAt  time.Time `bigquery:"updated_at" json:"updated_at"`
+}
+
+// draftReplies drafts a reply for the tagged negative reviews of a package that have neither a
+// draft nor a developer reply, up to maxDraftsPerRun. A failed draft is logged and left for the
+// next run: the fetch and the analysis went fine.
+func (a *App) draftReplies(ctx context.Context, packageName string, progress ProgressFunc) error {
+	if a.llm == nil {
+		return nil
+	}
+
+	settings, err := a.cfg.analysisSettings().settingsFor(ctx, a.store, packageName)
+	if err != nil {
+		return err
+	}
+	reviews, err := a.store.ReviewsToDraft(ctx, packageName, settings.maxStars, maxDraftsPerRun)
+	if err != nil {
+		return newError(KindStorage, "failed to list reviews to draft", err)
+	}
+	if len(reviews) == 0 {
+		return nil
+	}
+	tags, err := a.store.ReviewTags(ctx, packageName, "")
+	if err != nil {
+		return newError(KindStorage, "failed to list review tags", err)
+	}
+	reviewTags := map[string][]string{}
+	for _, tag := range tags {
+		reviewTags[tag.ReviewID] = append(reviewTags[tag.ReviewID], tag.Tag)
+	}
+
+	for i, review := range reviews {
+		message := "Drafted reply to " + review.ReviewID
+		if _, err := a.draftReply(ctx, packageName, review, strings.Join(reviewTags[review.ReviewID], ", ")); err != nil {
+			log.Printf("Failed to draft a reply to %s of %s: %v", review.ReviewID, packageName, err)
+			message = "Failed to draft reply to " + review.ReviewID
+		}
+		progress.report(i+1, len(reviews), message)
+	}
+	return nil
+}
+
+// latestAnalysis returns the analysis of a version, with no details if there is none
+func (a *App) latestAnalysis(ctx context.Context, packageName, version string) (*GeminiResponse, error) {
+	analysis, err := versionAnalysis(ctx, a.store, packageName, version)
+	if err != nil {
+		return nil, err
+	}
+	if analysis == nil {
+		return &GeminiResponse{}, nil
+	}
+	return &analysis.GeminiResponse, nil
+}
+
+// draftReply asks the model for a reply to a review and queues it as pending. The caller checks
+// that the review is negative and unanswered.
+func (a *App) draftReply(ctx context.Context, packageName string, review *CommentDetails, tags string) (*ReplyDraft, error) {
+	if tags == "" {
+		tags = "none"
+	}
+	prompt := fmt.Sprintf(draftPrompt, packageName, review.ReviewerLanguage, tags, review.StarRating, review.Comments)
+	text, err := a.llm.Generate(ctx, prompt)
+	if err != nil {
+		return nil, newError(KindLLM, "failed to generate reply", err)
+	}
+
+	now := time.Now().UTC()
+	draft := &ReplyDraft{
+		ID:         newID(),
+		AppName:    packageName,
+		ReviewID:   review.ReviewID,
+		Language:   review.ReviewerLanguage,
+		StarRating: review.StarRating,
+		Review:     review.Comments,
+		Tags:       tags,
+		Text:       cleanDraft(text),
+		Status:     DraftPending,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := a.store.SaveDraft(ctx, draft); err != nil {
+		return nil, newError(KindStorage, "failed to save reply draft", err)
+	}
+	return draft, nil
+}
+
+// cleanDraft strips what models like to add around a reply and keeps it within the Play limit
+func cleanDraft(text string) string {
+	text = strings.TrimSpace(text)
+	text = strings.Trim(text, `"“”`)
+	text = strings.TrimSpace(text)
+
+	if utf8.RuneCountInString(text) <= maxReplyLength {
+		return text
+	}
+	runes := []rune(text)[:maxReplyLength]
+	if i := strings.LastIndexAny(string(runes), ".!?"); i > 0 {
+		return string(runes)[:i+1]
+	}
+	return string(runes)
+}
+
+// decideDraft edits, approves or rejects a pending draft. Approving posts the (possibly edited)
+// text to Play first, the draft stays pending if that fails. Once Play accepted the reply the
+// draft is approved, a storage error is returned along with it.
+func (a *App) decideDraft(ctx context.Context, id, status, text string) (*ReplyDraft, error) {
+	// Serializes decisions so a draft cannot be posted twice
+	a.draftsMu.Lock()
+	defer a.draftsMu.Unlock()
+
+	draft, err := a.store.Draft(ctx, id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, &AppError{Kind: KindNotFound, Message: "draft not found"}
+		}
+		return nil, newError(KindStorage, "failed to fetch reply draft", err)
+	}
+	if draft.Status != DraftPending {
+		return nil, invalidArgument(fmt.Sprintf("draft is already %s", draft.Status))
+	}
+
+	if text != "" {
+		draft.Text = text
+	}
+	// Model drafts are checked too, they are posted as is. A draft can always be rejected.
+	if status != DraftRejected {
+		if err := validateReplyText(draft.Text); err != nil {
+			return nil, err
+		}
+	}
+
+	var warning error
+	if status == DraftApproved {
+		posted, err := a.draftPosted(ctx, draft)
+		if err != nil {
+			return nil, err
+		}
+		if !posted {
+			reply, err := a.sendReply(ctx, draft.AppName, draft.ReviewID, draft.Text)
+			if reply == nil {
+				return nil, err
+			}
+			warning = err
+		}
+	}
+
+	draft.Status = status
+	draft.UpdatedAt = time.Now().UTC()
+	if err := a.store.SaveDraft(ctx, draft); err != nil {
+		err = newError(KindStorage, "failed to save reply draft", err)
+		if status != DraftApproved {
+			return nil, err
+		}
+		warning = err
+	}
+	return draft, warning
+}
+
+// draftPosted reports whether a previous approval of a draft posted it to Play but could not
+// save the draft: its text was recorded as a reply since it was drafted
+func (a *App) draftPosted(ctx context.Context, draft *ReplyDraft) (bool, error) {
+	replies, err := a.store.Replies(ctx, draft.AppName, draft.ReviewID)
+	if err != nil {
+		return false, newError(KindStorage, "failed to list replies", err)
+	}
+	for _, reply := range replies {
+		if reply.Text == draft.Text && !reply.SentAt.Before(draft.CreatedAt) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// draftsHandler lists the reply drafts of a package, optionally filtered by status
+func (a *App) draftsHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("package_name")
+	status := r.URL.Query().Get("status")
+
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	if status != "" && status != DraftPending && status != DraftApproved && status != DraftRejected {
+		writeError(w, invalidArgument(fmt.Sprintf("invalid status %q", status)))
+		return
+	}
+
+	drafts, err := a.store.Drafts(r.Context(), packageName, status)
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to list reply drafts", err))
+		return
+	}
+	if drafts == nil {
+		drafts = []ReplyDraft{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drafts)
+}
+
+// createDraftHandler drafts a reply to a single review right away. It takes a JSON body with
+// package_name and comment_id, the tags come from the latest analysis of the review's version.
+func (a *App) createDraftHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PackageName string `json:"package_name"`
+		CommentID   string `json:"comment_id"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, invalidArgument("invalid JSON body"))
+		return
+	}
+	if err := validatePackageName(req.PackageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateReviewID(req.CommentID); err != nil {
+		writeError(w, err)
+		return
+	}
+	if a.llm == nil {
+		writeError(w, &AppError{Kind: KindLLM, Message: "no model is configured to draft replies"})
+		return
+	}
+
+	review, err := a.store.Comment(r.Context(), req.PackageName, req.CommentID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "comment not found"})
+			return
+		}
+		writeError(w, newError(KindStorage, "failed to fetch comment", err))
+		return
+	}
+	settings, err := a.cfg.analysisSettings().settingsFor(r.Context(), a.store, req.PackageName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if review.DeveloperComment != nil || review.StarRating > settings.maxStars {
+		writeError(w, invalidArgument("only unanswered negative reviews get reply drafts"))
+		return
+	}
+
+	tags := ""
+	if analysis, err := a.latestAnalysis(r.Context(), req.PackageName, review.Version); err == nil {
+		for _, detail := range analysis.Details {
+			if detail.CommentID == req.CommentID {
+				tags = strings.Join(detail.Tags, ", ")
+			}
+		}
+	}
+
+	draft, err := a.draftReply(r.Context(), req.PackageName, review, tags)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(draft)
+}
+
+// draftDecisionHandler serves PUT /drafts/{id} (edit), POST /drafts/{id}/approve and
+// POST /drafts/{id}/reject. The JSON body may carry the edited text.
+func (a *App) draftDecisionHandler(status string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if err := validateDraftID(id); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var req struct {
+			Text string `json:"text"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				writeError(w, invalidArgument("invalid JSON body"))
+				return
+			}
+		}
+		if status == DraftPending && req.Text == "" {
+			writeError(w, invalidArgument("reply text is required"))
+			return
+		}
+
+		draft, err := a.decideDraft(r.Context(), id, status, req.Text)
+		if draft == nil {
+			writeError(w, err)
+			return
+		}
+		resp := struct {
+			*ReplyDraft
+			Warning string `json:"warning,omitempty"`
+		}{ReplyDraft: draft}
+		if err != nil {
+			log.Printf("Draft %s: %v", id, err)
+			resp.Warning = err.Error()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorKind categorizes failures so handlers can answer with the right status code
+type ErrorKind string
+
+const (
+	KindInvalidArgument ErrorKind = "invalid_argument" // bad input from the caller
+	KindNotFound        ErrorKind = "not_found"        // unknown package, version, review or job
+	KindConflict        ErrorKind = "conflict"         // the resource exists already
+	KindUpstreamAuth    ErrorKind = "upstream_auth"    // our credentials were rejected by the Play API
+	KindRateLimited     ErrorKind = "rate_limited"     // the Play API or the model asked us to slow down
+	KindUpstream        ErrorKind = "upstream"         // the Play API failed or could not be reached
+	KindStorage         ErrorKind = "storage"          // the review store failed
+	KindLLM             ErrorKind = "llm"              // the model failed or answered something unusable
+	KindInternal        ErrorKind = "internal"         // anything else
+)
+
+// AppError is an error with a category, returned by the fetch, store and analysis functions
+type AppError struct {
+	Kind       ErrorKind
+	Message    string
+	Err        error
+	RetryAfter time.Duration // set for KindRateLimited when the upstream told us how long to wait
+}
+
+func (e *AppError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	if e.Message == "" {
+		return e.Err.Error()
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+// newError wraps err with a kind. If err already has a kind, it is kept: the innermost
+// layer knows best what went wrong (e.g. a 429 from Gemini stays rate_limited).
+func newError(kind ErrorKind, message string, err error) error {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		kind = appErr.Kind
+	}
+	return &AppError{Kind: kind, Message: message, Err: err}
+}
+
+// errorKind returns the category of err, KindInternal when it has none
+func errorKind(err error) ErrorKind {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return appErr.Kind
+	}
+	if errors.Is(err, ErrNotFound) {
+		return KindNotFound
+	}
+	return KindInternal
+}
+
+func (k ErrorKind) httpStatus() int {
+	switch k {
+	case KindInvalidArgument:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindConflict:
+		return http.StatusConflict
+	case KindRateLimited:
+		return http.StatusTooManyRequests
+	case KindUpstreamAuth, KindUpstream, KindLLM:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorResponse is the JSON body of every error answered by the server
+type errorResponse struct {
+	Error struct {
+		Kind    ErrorKind `json:"kind"`
+		Message string    `json:"message"`
+	} `json:"error"`
+}
+
+// writeError answers with the status code matching the kind of err and a JSON body
+func writeError(w http.ResponseWriter, err error) {
+	kind := errorKind(err)
+	status := kind.httpStatus()
+	if status >= http.StatusInternalServerError {
+		log.Printf("Request failed (%s): %v", kind, err)
+	}
+
+	var appErr *AppError
+	if errors.As(err, &appErr) && appErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(appErr.RetryAfter.Seconds())))
+	}
+
+	var body errorResponse
+	body.Error.Kind = kind
+	body.Error.Message = err.Error()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// invalidArgument is a shortcut for request validation failures
+func invalidArgument(message string) error {
+	return &AppError{Kind: KindInvalidArgument, Message: message}
+}
@@ -0,0 +1,311 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Stages a fetch job goes through, in order
+const (
+	JobQueued    = "queued"
+	JobFetching  = "fetching"
+	JobInserting = "inserting"
+	JobAnalyzing = "analyzing"
+	JobDrafting  = "drafting"
+	JobDone      = "done"
+	JobFailed    = "failed"
+)
+
+// How long finished jobs can still be polled
+const jobRetention = time.Hour
+
+var ErrQueueFull = errors.New("job queue is full")
+
+// JobStage records how a single stage of a job went
+type JobStage struct {
+	Name       string     `json:"name"`
+	Count      int        `json:"count"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// Job is a fetch -> insert -> analyze run for one package
+type Job struct {
+	ID          string     `json:"id"`
+	PackageName string     `json:"package_name"`
+	ReviewCount int        `json:"review_count"`
+	Incremental bool       `json:"incremental"` // only new and edited reviews, see SyncCheckpoint
+	StartIndex  int        `json:"start_index,omitempty"`
+	Translation string     `json:"translation_language,omitempty"` // language the reviews are translated to
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	ErrorKind   ErrorKind  `json:"error_kind,omitempty"`
+	Stages      []JobStage `json:"stages"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// jobPipeline is what a job runs, one method per stage. App implements it.
+type jobPipeline interface {
+	Fetch(ctx context.Context, packageName string, count int, incremental bool, opts fetchOptions, progress ProgressFunc) (*fetchResult, error)
+	Insert(ctx context.Context, fetched *fetchResult, progress ProgressFunc) error
+	Analyze(ctx context.Context, packageName string, progress ProgressFunc) error
+	Draft(ctx context.Context, packageName string, progress ProgressFunc) error
+}
+
+// jobQueue runs fetch jobs on a fixed pool of workers and keeps their status in memory
+type jobQueue struct {
+	ctx      context.Context // cancelled to abort the running jobs
+	pipeline jobPipeline
+	mu       sync.Mutex
+	jobs     map[string]*Job
+	queue    chan string
+	events   *progressBroker
+}
+
+func newJobQueue(ctx context.Context, pipeline jobPipeline, workers, capacity int) *jobQueue {
+	q := &jobQueue{
+		ctx:      ctx,
+		pipeline: pipeline,
+		jobs:     map[string]*Job{},
+		queue:    make(chan string, capacity),
+		events:   newProgressBroker(),
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Enqueue registers a new job for the package, count and fetch options of spec and
+// returns a snapshot of it. An incremental job joins the incremental job of the package
+// still queued or running, as both would read and move the same sync checkpoint.
+func (q *jobQueue) Enqueue(spec Job) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.prune()
+
+	if spec.Incremental {
+		for _, job := range q.jobs {
+			if job.PackageName == spec.PackageName && job.Incremental && job.Status != JobDone && job.Status != JobFailed {
+				return q.snapshot(job), nil
+			}
+		}
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:          newID(),
+		PackageName: spec.PackageName,
+		ReviewCount: spec.ReviewCount,
+		Incremental: spec.Incremental,
+		StartIndex:  spec.StartIndex,
+		Translation: spec.Translation,
+		Status:      JobQueued,
+		Stages:      []JobStage{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	select {
+	case q.queue <- job.ID:
+	default:
+		return Job{}, ErrQueueFull
+	}
+	q.jobs[job.ID] = job
+
+	return q.snapshot(job), nil
+}
+
+// Get returns a snapshot of a job, safe to encode while the job keeps running
+func (q *jobQueue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return q.snapshot(job), true
+}
+
+// Subscribe follows the progress events of a job, see progressBroker.Subscribe
+func (q *jobQueue) Subscribe(id string) (<-chan ProgressEvent, func()) {
+	return q.events.Subscribe(id)
+}
+
+// Active returns the queued or running job of a package, if there is one
+func (q *jobQueue) Active(packageName string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.jobs {
+		if job.PackageName == packageName && job.Status != JobDone && job.Status != JobFailed {
+			return q.snapshot(job), true
+		}
+	}
+	return Job{}, false
+}
+
+// Wait blocks until a job is done or failed and returns it
+func (q *jobQueue) Wait(ctx context.Context, id string) (Job, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		job, ok := q.Get(id)
+		if !ok {
+			return Job{}, ErrNotFound
+		}
+		if job.Status == JobDone || job.Status == JobFailed {
+			return job, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return job, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *jobQueue) work() {
+	for id := range q.queue {
+		q.run(id)
+	}
+}
+
+func (q *jobQueue) run(id string) {
+	q.mu.Lock()
+	job := q.jobs[id]
+	q.mu.Unlock()
+	if job == nil {
+		return
+	}
+
+	q.startStage(job, JobFetching)
+	opts := fetchOptions{StartIndex: job.StartIndex, TranslationLanguage: job.Translation}
+	fetched, err := q.pipeline.Fetch(q.ctx, job.PackageName, job.ReviewCount, job.Incremental, opts, q.progress(job, JobFetching))
+	if err != nil {
+		q.finishStage(job, 0, err)
+		return
+	}
+	q.finishStage(job, len(fetched.Reviews), nil)
+
+	q.startStage(job, JobInserting)
+	err = q.pipeline.Insert(q.ctx, fetched, q.progress(job, JobInserting))
+	if q.finishStage(job, len(fetched.Reviews), err) {
+		return
+	}
+
+	q.startStage(job, JobAnalyzing)
+	err = q.pipeline.Analyze(q.ctx, job.PackageName, q.progress(job, JobAnalyzing))
+	if q.finishStage(job, -1, err) {
+		return
+	}
+
+	q.startStage(job, JobDrafting)
+	err = q.pipeline.Draft(q.ctx, job.PackageName, q.progress(job, JobDrafting))
+	if q.finishStage(job, -1, err) {
+		return
+	}
+
+	q.mu.Lock()
+	job.Status = JobDone
+	job.UpdatedAt = time.Now()
+	q.mu.Unlock()
+	q.events.Publish(ProgressEvent{JobID: job.ID, Stage: JobDone, Message: "Job completed", Time: time.Now()})
+}
+
+// progress returns a ProgressFunc updating the count of the current stage and streaming the update
+func (q *jobQueue) progress(job *Job, stage string) ProgressFunc {
+	return func(done, total int, message string) {
+		q.mu.Lock()
+		job.Stages[len(job.Stages)-1].Count = done
+		job.UpdatedAt = time.Now()
+		q.mu.Unlock()
+
+		q.events.Publish(ProgressEvent{JobID: job.ID, Stage: stage, Done: done, Total: total, Message: message, Time: time.Now()})
+	}
+}
+
+func (q *jobQueue) startStage(job *Job, name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	job.Status = name
+	job.Stages = append(job.Stages, JobStage{Name: name, StartedAt: now})
+	job.UpdatedAt = now
+}
+
+// finishStage closes the current stage. If err is set it fails the whole job and returns true.
+// A negative count keeps the count reported through progress.
+func (q *jobQueue) finishStage(job *Job, count int, err error) bool {
+	q.mu.Lock()
+	now := time.Now()
+	stage := &job.Stages[len(job.Stages)-1]
+	if count >= 0 {
+		stage.Count = count
+	}
+	stage.FinishedAt = &now
+	if err != nil {
+		stage.Error = err.Error()
+		job.Status = JobFailed
+		job.Error = err.Error()
+		job.ErrorKind = errorKind(err)
+	}
+	job.UpdatedAt = now
+	q.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Job %s failed: %v", job.ID, err)
+		q.events.Publish(ProgressEvent{JobID: job.ID, Stage: JobFailed, Message: err.Error(), Time: now})
+	}
+	return err != nil
+}
+
+// prune forgets finished jobs older than jobRetention. Caller must hold q.mu.
+func (q *jobQueue) prune() {
+	for id, job := range q.jobs {
+		finished := job.Status == JobDone || job.Status == JobFailed
+		if finished && time.Since(job.UpdatedAt) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// snapshot copies a job so it can be read without holding q.mu. Caller must hold q.mu.
+func (q *jobQueue) snapshot(job *Job) Job {
+	c := *job
+	c.Stages = append(make([]JobStage, 0, len(job.Stages)), job.Stages...)
+	return c
+}
+
+// newID returns a random identifier, used for jobs and reply drafts
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
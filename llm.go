@@ -0,0 +1,410 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	defaultGeminiModel    = "gemini-2.0-flash-001"
+	defaultVertexLocation = "us-central1"
+)
+
+// LLMClient sends a prompt to a language model and returns its raw text answer
+type LLMClient interface {
+	Generate(ctx context.Context, prompt string) (string, error)
+}
+
+// JSONGenerator is implemented by the clients that can constrain their answer to a response schema
+type JSONGenerator interface {
+	GenerateJSON(ctx context.Context, prompt string, schema map[string]any) (string, error)
+}
+
+// newLLMClient builds the client selected by cfg.LLMProvider:
+//   - bigquery: ML.GENERATE_TEXT on the gemini_model remote model (default with the BigQuery store)
+//   - vertex: Gemini on Vertex AI through its REST API, using Application Default Credentials
+//   - gemini: the Gemini API (generativelanguage.googleapis.com) with an API key
+//   - fake: deterministic offline answers, no cloud access at all (default otherwise)
+func newLLMClient(ctx context.Context, cfg Config, bqClient *bigquery.Client) (LLMClient, error) {
+	provider := cfg.LLMProvider
+	if provider == "" {
+		provider = "fake"
+		if bqClient != nil {
+			provider = "bigquery"
+		}
+	}
+
+	switch provider {
+	case "bigquery":
+		if bqClient == nil {
+			return nil, fmt.Errorf("the bigquery LLM provider requires the BigQuery store")
+		}
+		return &bigQueryMLClient{client: bqClient, model: cfg.DatasetID + ".gemini_model"}, nil
+	case "vertex":
+		return newVertexClient(ctx, cfg.ProjectID, cfg.VertexLocation, cfg.GeminiModel)
+	case "gemini":
+		return newGeminiAPIClient(cfg.GeminiAPIKey, cfg.GeminiModel)
+	case "fake":
+		fake := &fakeLLMClient{}
+		if cfg.LLMFakeFile != "" {
+			canned, err := os.ReadFile(cfg.LLMFakeFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read canned LLM response: %w", err)
+			}
+			fake.Canned = string(canned)
+		}
+		return fake, nil
+	default:
+		return nil, fmt.Errorf("unknown LLM provider %q (expected bigquery, vertex, gemini or fake)", provider)
+	}
+}
+
+// bigQueryMLClient calls Gemini through ML.GENERATE_TEXT on a BigQuery remote model
+type bigQueryMLClient struct {
+	client *bigquery.Client
+	model  string // dataset.model
+}
+
+func (c *bigQueryMLClient) Generate(ctx context.Context, prompt string) (string, error) {
+	q := c.client.Query(fmt.Sprintf(`
+		SELECT ml_generate_text_llm_result
+		FROM ML.GENERATE_TEXT(MODEL `+"`%s`"+`,
+			(SELECT @prompt AS prompt),
+			STRUCT(TRUE AS flatten_json_output, 8192 AS max_output_tokens,
+				[STRUCT('HARM_CATEGORY_HATE_SPEECH' AS category, 'BLOCK_NONE' AS threshold),
+				STRUCT('HARM_CATEGORY_DANGEROUS_CONTENT' AS category, 'BLOCK_NONE' AS threshold),
+				STRUCT('HARM_CATEGORY_SEXUALLY_EXPLICIT' AS category, 'BLOCK_NONE' AS threshold),
+				STRUCT('HARM_CATEGORY_HARASSMENT' AS category, 'BLOCK_NONE' AS threshold)] AS safety_settings))
+	`, c.model))
+	q.Parameters = []bigquery.QueryParameter{{Name: "prompt", Value: prompt}}
+
+	it, err := q.Read(ctx)
+	if err != nil {
+		return "", fmt.Errorf("ML.GENERATE_TEXT failed: %w", err)
+	}
+
+	var row []bigquery.Value
+	err = it.Next(&row)
+	if err == iterator.Done {
+		return "", fmt.Errorf("ML.GENERATE_TEXT returned no rows")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read ML.GENERATE_TEXT result: %w", err)
+	}
+
+	text, _ := row[0].(string)
+	return text, nil
+}
+
+// Keyword rules used by the fake client to tag negative reviews
+var fakeTagRules = []struct {
+	tag      string
+	category string
+	severity string
+	keywords []string
+}{
+	{"crash", "stability", "high", []string{"crash", "freez", "force close", "closes itself"}},
+	{"performance", "performance", "medium", []string{"slow", "lag", "loading", "takes forever"}},
+	{"ads", "ads", "low", []string{" ad ", " ads", "advert", "commercial"}},
+	{"login", "account", "high", []string{"login", "log in", "sign in", "password", "account"}},
+	{"battery", "performance", "medium", []string{"battery", "drain", "overheat"}},
+	{"pricing", "billing", "medium", []string{"price", "expensive", "subscription", "pay", "refund"}},
+	{"update", "functionality", "medium", []string{"update", "new version"}},
+	{"bugs", "functionality", "medium", []string{"bug", "glitch", "broken", "doesn't work", "does not work", "not working"}},
+}
+
+// fakeSeverities orders the severities, the severity of a review is the highest of its tags
+var fakeSeverities = []string{"low", "medium", "high", "critical"}
+
+// fakeMaxStarsRegex finds the negative threshold of an analysis prompt
+var fakeMaxStarsRegex = regexp.MustCompile(`star_rating <= (\d+)`)
+
+// fakeLLMClient answers analysis and reply prompts without any network access. If Canned is set
+// it is returned verbatim, otherwise reviews embedded in the prompt are tagged with keyword
+// rules and summarized with simple counts, and replies are built from the tags of the review.
+// The same prompt always gives the same answer.
+type fakeLLMClient struct {
+	Canned string
+}
+
+func (c *fakeLLMClient) Generate(ctx context.Context, prompt string) (string, error) {
+	if c.Canned != "" {
+		return c.Canned, nil
+	}
+	if strings.HasPrefix(prompt, draftPromptIntro) {
+		return fakeReply(prompt), nil
+	}
+	if strings.HasPrefix(prompt, reducePromptIntro) {
+		return fakeReduce(prompt), nil
+	}
+	if strings.HasPrefix(prompt, mappingPromptIntro) {
+		return fakeMapping(prompt)
+	}
+	if strings.HasPrefix(prompt, comparePromptIntro) {
+		return fakeNarrative(prompt)
+	}
+
+	reviews := reviewsFromPrompt(prompt)
+	maxStars := defaultConfig().AnalysisMaxStars
+	if m := fakeMaxStarsRegex.FindStringSubmatch(prompt); m != nil {
+		maxStars, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+
+	result := GeminiResponse{SchemaVersion: analysisSchemaVersion, Details: []AnalysisDetail{}}
+
+	tagCounts := map[string]int{}
+	var stars int64
+	negative := 0
+	for _, r := range reviews {
+		stars += r.StarRating
+		if r.StarRating > maxStars {
+			continue
+		}
+		negative++
+
+		tags, category, severity := fakeTags(r.Comments)
+		for _, tag := range tags {
+			tagCounts[tag]++
+		}
+		result.Details = append(result.Details, AnalysisDetail{CommentID: r.ReviewID, Tags: tags, Severity: severity, Category: category})
+	}
+
+	if len(reviews) == 0 {
+		result.Summary = "No reviews were provided."
+	} else {
+		result.Summary = fmt.Sprintf("%d reviews analyzed with an average rating of %.1f. %d are positive and %d are negative.",
+			len(reviews), float64(stars)/float64(len(reviews)), len(reviews)-negative, negative)
+		if top := topTags(tagCounts, 3); len(top) > 0 {
+			result.Summary += " Negative reviews mostly mention " + strings.Join(top, ", ") + "."
+		}
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// reviewsFromPrompt extracts the JSON encoded reviews appended to a prompt by buildAnalysisPrompt
+func reviewsFromPrompt(prompt string) []*Review {
+	start := strings.Index(prompt, `{"review_id"`)
+	if start < 0 {
+		return nil
+	}
+
+	var reviews []*Review
+	dec := json.NewDecoder(strings.NewReader(prompt[start:]))
+	for dec.More() {
+		var r struct {
+			ReviewID   string `json:"review_id"`
+			StarRating int64  `json:"star_rating"`
+			Comments   string `json:"comments"`
+		}
+		if err := dec.Decode(&r); err != nil {
+			break
+		}
+		reviews = append(reviews, &Review{ReviewID: r.ReviewID, StarRating: r.StarRating, Comments: r.Comments})
+	}
+	return reviews
+}
+
+// fakeReply answers a draftPrompt, in English whatever the reviewer language
+func fakeReply(prompt string) string {
+	tags := "none"
+	for _, line := range strings.Split(prompt, "\n") {
+		if strings.HasPrefix(line, "Tags: ") {
+			tags = strings.TrimPrefix(line, "Tags: ")
+		}
+	}
+	if tags == "none" {
+		return "Thank you for your review. We are sorry the app did not meet your expectations, your feedback helps us improve it."
+	}
+	return fmt.Sprintf("Thank you for your review. We are sorry about the trouble with %s, our team is looking into it.", tags)
+}
+
+// fakeReduce answers a reducePrompt by joining the chunk summaries
+func fakeReduce(prompt string) string {
+	var summaries []string
+	for _, line := range strings.Split(prompt, "\n") {
+		if strings.HasPrefix(line, "Chunk ") {
+			if _, summary, ok := strings.Cut(line, ": "); ok {
+				summaries = append(summaries, summary)
+			}
+		}
+	}
+	return fmt.Sprintf("Consolidated from %d chunks. %s", len(summaries), strings.Join(summaries, " "))
+}
+
+// fakeMapping answers a mappingPrompt with the label sharing the most words with each tag, the
+// confidence growing from 0.5 with the share of the words of the tag found in the label
+func fakeMapping(prompt string) (string, error) {
+	var labels []struct {
+		Label       string   `json:"label"`
+		Description string   `json:"description"`
+		Synonyms    []string `json:"synonyms"`
+	}
+	var tags []string
+	for _, line := range strings.Split(prompt, "\n") {
+		if rest, ok := strings.CutPrefix(line, "Taxonomy: "); ok {
+			if err := json.Unmarshal([]byte(rest), &labels); err != nil {
+				return "", err
+			}
+		}
+		if rest, ok := strings.CutPrefix(line, "Tags: "); ok {
+			if err := json.Unmarshal([]byte(rest), &tags); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	type mapping struct {
+		Tag        string  `json:"tag"`
+		Label      string  `json:"label"`
+		Confidence float64 `json:"confidence"`
+	}
+	result := struct {
+		Mappings []mapping `json:"mappings"`
+	}{Mappings: []mapping{}}
+	for _, tag := range tags {
+		words := fakeWords(tag)
+		m := mapping{Tag: tag}
+		for _, l := range labels {
+			known := fakeWords(strings.ReplaceAll(l.Label, "-", " ") + " " + l.Description + " " + strings.Join(l.Synonyms, " "))
+			shared := 0
+			for w := range words {
+				if known[w] {
+					shared++
+				}
+			}
+			if confidence := 0.5 + 0.5*float64(shared)/float64(len(words)); shared > 0 && confidence > m.Confidence {
+				m.Label, m.Confidence = l.Label, confidence
+			}
+		}
+		result.Mappings = append(result.Mappings, m)
+	}
+
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// fakeNarrative answers a comparePrompt by listing the rating change and the issues by change
+func fakeNarrative(prompt string) (string, error) {
+	_, comparison, _ := strings.Cut(prompt, "Comparison: ")
+	var c VersionComparison
+	if err := json.Unmarshal([]byte(comparison), &c); err != nil {
+		return "", err
+	}
+
+	text := fmt.Sprintf("Version %s is rated %.2f against %.2f for version %s (%+.2f), with %d reviews against %d.",
+		c.Target.Version, c.Target.AverageRating, c.Base.AverageRating, c.Base.Version, c.RatingDelta, c.Target.ReviewCount, c.Base.ReviewCount)
+	for _, change := range []struct{ name, title string }{
+		{IssueNew, "New issues"},
+		{IssueGrowing, "Growing issues"},
+		{IssueResolved, "Resolved issues"},
+		{IssueShrinking, "Shrinking issues"},
+	} {
+		var issues []string
+		for _, issue := range c.Issues {
+			if issue.Change == change.name {
+				issues = append(issues, issue.Issue)
+			}
+		}
+		if len(issues) > 0 {
+			text += fmt.Sprintf(" %s: %s.", change.title, strings.Join(issues, ", "))
+		}
+	}
+	return text, nil
+}
+
+// fakeWords returns the stems of the words of a text, without the most common ones
+func fakeWords(text string) map[string]bool {
+	words := map[string]bool{}
+	for _, w := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		switch w {
+		case "a", "an", "the", "and", "or", "of", "to", "is", "it", "in", "on", "too", "app", "not":
+			continue
+		}
+		for _, suffix := range []string{"ing", "es", "s"} {
+			if len(w) > len(suffix)+2 {
+				if stem, ok := strings.CutSuffix(w, suffix); ok {
+					w = stem
+					break
+				}
+			}
+		}
+		words[w] = true
+	}
+	return words
+}
+
+// fakeTags returns the tags of a negative review, the category of its first tag and its severity
+func fakeTags(text string) (tags []string, category, severity string) {
+	text = " " + strings.ToLower(text) + " "
+
+	rank := 0
+	for _, rule := range fakeTagRules {
+		for _, keyword := range rule.keywords {
+			if strings.Contains(text, keyword) {
+				tags = append(tags, rule.tag)
+				if category == "" {
+					category = rule.category
+				}
+				if r := slices.Index(fakeSeverities, rule.severity); r > rank {
+					rank = r
+				}
+				break
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return []string{"general dissatisfaction"}, "other", "low"
+	}
+	return tags, category, fakeSeverities[rank]
+}
+
+// topTags returns the n most frequent tags, ties broken alphabetically
+func topTags(counts map[string]int, n int) []string {
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if counts[tags[i]] != counts[tags[j]] {
+			return counts[tags[i]] > counts[tags[j]]
+		}
+		return tags[i] < tags[j]
+	})
+	if len(tags) > n {
+		tags = tags[:n]
+	}
+	return tags
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+// geminiClient calls the generateContent REST method, either on Vertex AI or on the Gemini API.
+// Both expose the same request and response bodies, only the URL and the authentication differ.
+type geminiClient struct {
+	httpClient *http.Client
+	url        string
+	apiKey     string // Gemini API only, Vertex AI uses OAuth2 through httpClient
+}
+
+func newVertexClient(ctx context.Context, projectID, location, model string) (*geminiClient, error) {
+	if projectID == "" {
+		return nil, fmt.Errorf("the vertex LLM provider needs PROJECT_ID")
+	}
+
+	httpClient, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Vertex AI client: %w", err)
+	}
+
+	return &geminiClient{
+		httpClient: httpClient,
+		url: fmt.Sprintf("https://%s-aiplatform.googleapis.com/v1/projects/%s/locations/%s/publishers/google/models/%s:generateContent",
+			location, projectID, location, model),
+	}, nil
+}
+
+func newGeminiAPIClient(apiKey, model string) (*geminiClient, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("the gemini LLM provider needs GEMINI_API_KEY")
+	}
+
+	return &geminiClient{
+		httpClient: http.DefaultClient,
+		url:        fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:generateContent", model),
+		apiKey:     apiKey,
+	}, nil
+}
+
+type geminiPart struct {
+	Text string `json:"text"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiSafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
+type geminiRequest struct {
+	Contents         []geminiContent `json:"contents"`
+	GenerationConfig struct {
+		MaxOutputTokens  int            `json:"maxOutputTokens"`
+		ResponseMimeType string         `json:"responseMimeType,omitempty"`
+		ResponseSchema   map[string]any `json:"responseSchema,omitempty"`
+	} `json:"generationConfig"`
+	SafetySettings []geminiSafetySetting `json:"safetySettings"`
+}
+
+type geminiResponse struct {
+	Candidates []struct {
+		Content      geminiContent `json:"content"`
+		FinishReason string        `json:"finishReason"`
+	} `json:"candidates"`
+	PromptFeedback struct {
+		BlockReason string `json:"blockReason"`
+	} `json:"promptFeedback"`
+}
+
+func (c *geminiClient) Generate(ctx context.Context, prompt string) (string, error) {
+	return c.generate(ctx, prompt, nil)
+}
+
+// GenerateJSON uses the JSON mode of Gemini, the answer follows schema (an OpenAPI schema)
+func (c *geminiClient) GenerateJSON(ctx context.Context, prompt string, schema map[string]any) (string, error) {
+	return c.generate(ctx, prompt, schema)
+}
+
+func (c *geminiClient) generate(ctx context.Context, prompt string, schema map[string]any) (string, error) {
+	var body geminiRequest
+	body.Contents = []geminiContent{{Role: "user", Parts: []geminiPart{{Text: prompt}}}}
+	body.GenerationConfig.MaxOutputTokens = 8192
+	if schema != nil {
+		body.GenerationConfig.ResponseMimeType = "application/json"
+		body.GenerationConfig.ResponseSchema = schema
+	}
+	// Same settings as the ML.GENERATE_TEXT call in the stored procedure
+	for _, category := range []string{"HARM_CATEGORY_HATE_SPEECH", "HARM_CATEGORY_DANGEROUS_CONTENT", "HARM_CATEGORY_SEXUALLY_EXPLICIT", "HARM_CATEGORY_HARASSMENT"} {
+		body.SafetySettings = append(body.SafetySettings, geminiSafetySetting{Category: category, Threshold: "BLOCK_NONE"})
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode Gemini request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create Gemini request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("x-goog-api-key", c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to call Gemini: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Gemini response: %w", err)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return "", &AppError{Kind: KindRateLimited, Message: "gemini quota exceeded: " + string(respBody)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gemini returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var parsed geminiResponse
+	if err := json.Unmarshal(respBody, &parsed); err != nil {
+		return "", fmt.Errorf("failed to parse Gemini response: %w", err)
+	}
+	if parsed.PromptFeedback.BlockReason != "" {
+		return "", fmt.Errorf("gemini blocked the prompt: %s", parsed.PromptFeedback.BlockReason)
+	}
+	if len(parsed.Candidates) == 0 {
+		return "", fmt.Errorf("gemini returned no candidates")
+	}
+
+	var text strings.Builder
+	for _, part := range parsed.Candidates[0].Content.Parts {
+		text.WriteString(part.Text)
+	}
+	return text.String(), nil
+}
@@ -17,20 +17,19 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
-	"cloud.google.com/go/bigquery"
+	"github.com/NucleusEngineering/play-gemini/playapi"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/iterator"
 )
 
 // Implementation
@@ -44,358 +43,425 @@ type Review struct {
 	StarRating       int64  `bigquery:"star_rating"`
 	LastModified     string `bigquery:"last_modified"` // Format: RFC3339
 	ReviewerLanguage string `bigquery:"reviewer_language"`
-}
-
-var (
-	projectID     string
-	bqClient      *bigquery.Client
-	httpClient    *http.Client
-	datasetID     string = "play_store_reviews_demo"
-	tableID       string = "raw_reviews"
-	ctx           context.Context
-	reviewsApiUri = "androidpublisher.googleapis.com"
-)
 
-func init() {
-	var err error
-
-	ctx = context.Background()
+	Device           string            `bigquery:"device"`
+	AndroidOSVersion int64             `bigquery:"android_os_version"` // API level
+	AppVersionCode   int64             `bigquery:"app_version_code"`
+	ThumbsUpCount    int64             `bigquery:"thumbs_up_count"`
+	ThumbsDownCount  int64             `bigquery:"thumbs_down_count"`
+	DeviceMetadata   *DeviceMetadata   `bigquery:"device_metadata"`
+	OriginalText     string            `bigquery:"original_text"` // before translation, if translated
+	DeveloperComment *DeveloperComment `bigquery:"developer_comment"`
+}
 
-	projectID = os.Getenv("PROJECT_ID")
-	if projectID == "" {
-		log.Fatal("PROJECT_ID environment variable must be set.")
-	}
+// DeviceMetadata describes the device a review was written on, as reported by Play
+type DeviceMetadata struct {
+	ProductName      string `bigquery:"product_name" json:"productName"`
+	Manufacturer     string `bigquery:"manufacturer" json:"manufacturer"`
+	DeviceClass      string `bigquery:"device_class" json:"deviceClass"`
+	ScreenWidthPx    int64  `bigquery:"screen_width_px" json:"screenWidthPx"`
+	ScreenHeightPx   int64  `bigquery:"screen_height_px" json:"screenHeightPx"`
+	NativePlatform   string `bigquery:"native_platform" json:"nativePlatform"`
+	ScreenDensityDpi int64  `bigquery:"screen_density_dpi" json:"screenDensityDpi"`
+	GlEsVersion      int64  `bigquery:"gl_es_version" json:"glEsVersion"`
+	CpuModel         string `bigquery:"cpu_model" json:"cpuModel"`
+	CpuMake          string `bigquery:"cpu_make" json:"cpuMake"`
+	RamMb            int64  `bigquery:"ram_mb" json:"ramMb"`
+}
 
-	bqClient, err = bigquery.NewClient(ctx, projectID)
-	if err != nil {
-		log.Fatalf("bigquery.NewClient: %v", err)
-	}
-	defer bqClient.Close()
+// DeveloperComment is the developer reply to a review
+type DeveloperComment struct {
+	Text         string    `bigquery:"text"`
+	LastModified time.Time `bigquery:"last_modified"`
+}
 
-	httpClient, err = google.DefaultClient(ctx, "https://www.googleapis.com/auth/androidpublisher") // Use the correct scope
-	if err != nil {
-		log.Fatalf("Unable to create client: %v", err)
-	}
+// Rows per InsertReviews call, the recommended maximum for BigQuery streaming inserts
+const insertBatchSize = 500
+
+// fetchOptions narrows down the reviews fetchReviews pages through
+type fetchOptions struct {
+	PageToken           string    // start from this page instead of the newest reviews
+	StartIndex          int       // skip this many reviews, only used without PageToken
+	TranslationLanguage string    // translate the reviews to this language, e.g. "en"
+	After               time.Time // stop at the first review last modified before this second
+	// WholePages keeps the rest of the last page past the review count, so that
+	// paging can resume from the returned page token without skipping reviews
+	WholePages bool
 }
 
-func fetchReviews(packageName string, reviewsToFetch int) []*Review {
-	baseURL := fmt.Sprintf("https://%s/androidpublisher/v3/applications/%s/reviews", reviewsApiUri, packageName)
-	pageToken := ""
+// fetchReviews pages through the Play Developer API reviews.list method, following
+// tokenPagination. Pages ask for the reviews still missing, at most playapi.MaxPageSize.
+// The returned page token is set when paging stopped on the review count with pages left.
+func fetchReviews(ctx context.Context, client *playapi.Client, packageName string, reviewsToFetch int, opts fetchOptions, progress ProgressFunc) ([]*Review, string, error) {
+	pageToken := opts.PageToken
 	var allReviews []*Review // Now a slice of our custom Review struct
 	fetchedReviews := 0
+	page := 0
+	reachedKnown := false
 
 	for {
-		url := baseURL
-		if pageToken != "" {
-			url += "?token=" + pageToken + "&maxResults=" + strconv.Itoa(reviewsToFetch)
-		}
-
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.Fatalf("Error creating request: %v", err)
-		}
-
-		token, err := httpClient.Transport.(*oauth2.Transport).Source.Token()
-		if err != nil {
-			log.Fatalf("Error getting token: %v", err)
+		req := playapi.ListReviewsRequest{
+			PackageName:         packageName,
+			Token:               pageToken,
+			MaxResults:          min(reviewsToFetch-fetchedReviews, playapi.MaxPageSize),
+			TranslationLanguage: opts.TranslationLanguage,
 		}
-
-		req.Header.Set("Authorization", "Bearer "+token.AccessToken)
-
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Fatalf("Error making request: %v", err)
+		if pageToken == "" {
+			// Later pages are addressed by their token only
+			req.StartIndex = opts.StartIndex
 		}
-		defer resp.Body.Close()
 
-		body, err := io.ReadAll(resp.Body)
+		reviewsResponse, err := client.ListReviews(ctx, req)
 		if err != nil {
-			log.Fatalf("Error reading response body: %v", err)
+			return nil, "", playAPIError(packageName, err)
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			if resp.StatusCode == http.StatusNotFound {
-				log.Printf("No reviews found for package: %s", packageName)
-				return nil
+		for i := range reviewsResponse.Reviews {
+			r := &reviewsResponse.Reviews[i]
+			if r.UserComment() == nil {
+				continue
 			}
-			log.Fatalf("Error: %s, Status Code: %d", string(body), resp.StatusCode)
-		}
-
-		var reviewsResponse struct {
-			Reviews []struct {
-				ReviewId   string     `json:"reviewId"`
-				AuthorName string     `json:"authorName"`
-				Comments   []struct { // Comments is now a slice of structs
-					UserComment struct {
-						Text           string `json:"text"` // Extract the actual comment text
-						StarRating     int64  `json:"starRating"`
-						AppVersionName string `json:"appVersionName"`
-						LastModified   struct {
-							Seconds int64 `json:"seconds"`
-							Nanos   int64 `json:"nanos"`
-						} `json:"lastModified"`
-
-						// Add other fields from userComment as needed
-					} `json:"userComment"`
-				} `json:"comments"`
-				ReviewerLanguage string `json:"reviewerLanguage"`
-			} `json:"reviews"`
-			TokenPagination struct {
-				NextPageToken string `json:"nextPageToken"`
-			} `json:"tokenPagination"`
-		}
-
-		if err := json.Unmarshal(body, &reviewsResponse); err != nil {
-			log.Fatalf("Error unmarshalling response: %v, Body: %s", err, string(body))
-		}
 
-		for _, r := range reviewsResponse.Reviews {
-
-			t := time.Unix(int64(r.Comments[0].UserComment.LastModified.Seconds), 0) // Convert to time.Time
-			formattedTimeWithFractional := t.Format("2006-01-02 15:04:05.000000")    // Format with fractional seconds (microseconds)
-
-			allReviews = append(allReviews, &Review{
-				ReviewID:         r.ReviewId,
-				AuthorName:       r.AuthorName,
-				AppName:          packageName,
-				Comments:         r.Comments[0].UserComment.Text,       // Get the comment text
-				StarRating:       r.Comments[0].UserComment.StarRating, // moved here from above level
-				Version:          r.Comments[0].UserComment.AppVersionName,
-				LastModified:     formattedTimeWithFractional,
-				ReviewerLanguage: r.ReviewerLanguage,
-			})
+			review := reviewFromPlay(packageName, r)
+			// Stored times are truncated to the second, so reviews of the same second as After are
+			// fetched again and deduplicated by the store rather than missed
+			if t := r.UserComment().LastModified.Time(); t.Truncate(time.Second).Before(opts.After) {
+				// Everything from here on is already stored
+				reachedKnown = true
+				break
+			}
+			allReviews = append(allReviews, review)
 			fetchedReviews++
 
-			if fetchedReviews >= reviewsToFetch {
+			if fetchedReviews >= reviewsToFetch && !opts.WholePages {
 				break
 			}
 
 		}
 
-		fmt.Printf("Fetched %d vs %d\n", fetchedReviews, reviewsToFetch)
+		page++
+		log.Printf("Fetched %d vs %d reviews of %s", fetchedReviews, reviewsToFetch, packageName)
+		progress.report(fetchedReviews, reviewsToFetch, fmt.Sprintf("Fetched page %d", page))
 
-		if reviewsResponse.TokenPagination.NextPageToken == "" || fetchedReviews >= reviewsToFetch {
-			break
+		if reachedKnown {
+			progress.report(fetchedReviews, fetchedReviews, "Reached already stored reviews")
+			return allReviews, "", nil
+		}
+		if reviewsResponse.TokenPagination.NextPageToken == "" {
+			return allReviews, "", nil
 		}
 
 		pageToken = reviewsResponse.TokenPagination.NextPageToken
+		if fetchedReviews >= reviewsToFetch {
+			return allReviews, pageToken, nil
+		}
+	}
+}
+
+// reviewFromPlay flattens a review of the API into the raw_reviews row, r must have a user comment
+func reviewFromPlay(packageName string, r *playapi.Review) *Review {
+	userComment := r.UserComment()
+
+	t := userComment.LastModified.Time().Truncate(time.Second)
+	review := &Review{
+		ReviewID:         r.ReviewID,
+		AuthorName:       r.AuthorName,
+		AppName:          packageName,
+		Comments:         userComment.Text,
+		StarRating:       userComment.StarRating,
+		Version:          userComment.AppVersionName,
+		LastModified:     t.Format(lastModifiedLayout), // Format with fractional seconds (microseconds)
+		ReviewerLanguage: userComment.ReviewerLanguage,
+		Device:           userComment.Device,
+		AndroidOSVersion: userComment.AndroidOsVersion,
+		AppVersionCode:   userComment.AppVersionCode,
+		ThumbsUpCount:    userComment.ThumbsUpCount,
+		ThumbsDownCount:  userComment.ThumbsDownCount,
+		OriginalText:     userComment.OriginalText,
+	}
+	if userComment.DeviceMetadata != nil {
+		metadata := DeviceMetadata(*userComment.DeviceMetadata)
+		review.DeviceMetadata = &metadata
 	}
+	if developerComment := r.DeveloperComment(); developerComment != nil {
+		review.DeveloperComment = &DeveloperComment{
+			Text:         developerComment.Text,
+			LastModified: developerComment.LastModified.Time(),
+		}
+	}
+	return review
+}
 
-	return allReviews
+// playAPIError turns a failed Play Developer API call into a typed error
+func playAPIError(packageName string, err error) error {
+	var apiErr *playapi.Error
+	if !errors.As(err, &apiErr) {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) {
+			return newError(KindUpstreamAuth, "error getting token", err)
+		}
+		return newError(KindUpstream, "error calling the play API for "+packageName, err)
+	}
+
+	appErr := &AppError{Message: fmt.Sprintf("play API answered %d for %s: %s", apiErr.StatusCode, packageName, apiErr.Message)}
+	switch {
+	case apiErr.StatusCode == http.StatusNotFound:
+		appErr.Kind = KindNotFound
+		appErr.Message = fmt.Sprintf("no reviews found for package %s", packageName)
+	case apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden:
+		appErr.Kind = KindUpstreamAuth
+	case apiErr.StatusCode == http.StatusTooManyRequests:
+		appErr.Kind = KindRateLimited
+		appErr.RetryAfter = apiErr.RetryAfter
+	default:
+		appErr.Kind = KindUpstream
+	}
+
+	return appErr
 }
 
-func pushToBigQuery(allReviews []*Review) {
+func pushReviews(ctx context.Context, store ReviewStore, allReviews []*Review, progress ProgressFunc) error {
 	// check if allreviews is not nil nor empty
 	if allReviews == nil {
-		fmt.Println("No reviews fetched.")
-		return
+		log.Println("No reviews fetched.")
+		return nil
 	}
 
-	var bqReviews []*Review
 	for _, review := range allReviews {
 		if review.Version == "" {
 			review.Version = "unknown"
 		}
-
-		bqReviews = append(bqReviews, &Review{
-			ReviewID:         review.ReviewID,
-			AuthorName:       review.AuthorName,
-			AppName:          review.AppName,
-			Version:          review.Version,
-			Comments:         review.Comments,
-			StarRating:       review.StarRating,
-			LastModified:     review.LastModified,
-			ReviewerLanguage: review.ReviewerLanguage,
-		})
 	}
 
-	u := bqClient.Dataset(datasetID).Table(tableID).Inserter()
-	if err := u.Put(ctx, bqReviews); err != nil {
-		log.Fatalf("Failed to insert reviews into BigQuery: %v\n", err)
+	for start := 0; start < len(allReviews); start += insertBatchSize {
+		end := min(start+insertBatchSize, len(allReviews))
+		if err := store.InsertReviews(ctx, allReviews[start:end]); err != nil {
+			return newError(KindStorage, "failed to insert reviews", err)
+		}
+		progress.report(end, len(allReviews), fmt.Sprintf("Inserted batch of %d reviews", end-start))
 	}
-}
-
-func preProcessReviewsInBigQuery(packageName string) {
-	defer bqClient.Close()
 
-	// start timer
-	start := time.Now()
-
-	q := bqClient.Query(fmt.Sprintf("CALL `%s.pre_process_reviews_in_bq`('%s')", datasetID, packageName))
-	q.Location = "US"
+	return nil
+}
 
-	job, err := q.Run(ctx)
+func getVersions(ctx context.Context, store ReviewStore, packageName string) ([]string, error) {
+	versions, err := store.Versions(ctx, packageName)
 	if err != nil {
-		log.Fatalf("Error running stored procedure: %v", err)
+		return nil, newError(KindStorage, "failed to list versions", err)
 	}
 
-	status, err := job.Wait(ctx)
+	return versions, nil
+}
+
+func getVersionAnalysis(ctx context.Context, store ReviewStore, packageName string, version string) (string, error) {
+	geminiResponse, err := versionAnalysis(ctx, store, packageName, version)
 	if err != nil {
-		log.Fatalf("Error waiting for job completion: %v", err)
+		return "", err
+	}
+	if geminiResponse == nil { // Handle case where no results are returned
+		return "", nil
 	}
 
-	if err := status.Err(); err != nil {
-		log.Fatalf("Stored procedure execution failed: %v", err)
+	// Convert to JSON string for returning in the response
+	jsonData, err := json.Marshal(geminiResponse)
+	if err != nil {
+		return "", newError(KindInternal, "failed to marshal JSON", err) // Wrap error
 	}
 
-	fmt.Printf("Review pre-processing with Gemini completed in %.2f seconds.\n", time.Since(start).Seconds())
+	return string(jsonData), nil // Return JSON string and nil error
 }
 
-func getVersions(packageName string) []string {
-	defer bqClient.Close()
-
-	query := bqClient.Query(fmt.Sprintf(`
-		SELECT DISTINCT version
-		FROM %s.reviews_to_process
-		WHERE app_name = '%s'
-	`, datasetID, packageName))
+func (a *App) homeHandler(w http.ResponseWriter, r *http.Request) {
+	a.templates.ExecuteTemplate(w, "index.html", nil)
+}
 
-	it, err := query.Read(ctx)
-	if err != nil {
-		log.Fatalf("Failed to execute query: %v", err)
+func (a *App) fetchHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("package_name")
+	if packageName == "" {
+		writeError(w, invalidArgument("package name is required"))
+		return
+	}
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	var versions []string
-	for {
-		var row map[string]bigquery.Value
-		err = it.Next(&row)
-		if err == iterator.Done {
-			break
-		}
+	reviewCount, err := strconv.Atoi(r.URL.Query().Get("review_count"))
+	if err != nil || reviewCount <= 0 {
+		// Registered apps have their own default
+		reviewCount = a.cfg.DefaultFetchCount
+		registered, err := a.registeredApp(r.Context(), packageName)
 		if err != nil {
-			log.Fatalf("Failed to read row: %v", err)
+			writeError(w, err)
+			return
+		}
+		if registered != nil {
+			reviewCount = int(registered.FetchCount)
 		}
-		versions = append(versions, row["version"].(string))
 	}
 
-	return versions
-}
-
-func getVersionAnalysis(packageName string, version string) (string, error) {
-	defer bqClient.Close()
-
-	query := bqClient.Query(fmt.Sprintf(`
-		SELECT gemini_response
-		FROM %s.reviews_to_process
-		WHERE version = '%s' AND app_name = '%s'
-		ORDER BY created_at DESC
-		LIMIT 1
-	`, datasetID, version, packageName))
+	incremental := false
+	if value := r.URL.Query().Get("incremental"); value != "" {
+		incremental, err = strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, invalidArgument(fmt.Sprintf("invalid incremental flag %q", value)))
+			return
+		}
+	}
 
-	it, err := query.Read(ctx)
-	if err != nil {
-		log.Fatalf("Failed to execute query: %v", err)
+	startIndex := 0
+	if value := r.URL.Query().Get("start_index"); value != "" {
+		startIndex, err = strconv.Atoi(value)
+		if err != nil || startIndex < 0 {
+			writeError(w, invalidArgument(fmt.Sprintf("invalid start index %q", value)))
+			return
+		}
+		if incremental {
+			writeError(w, invalidArgument("start_index cannot be combined with an incremental fetch"))
+			return
+		}
 	}
 
-	type GeminiResponse struct {
-		Summary string `json:"summary"`
-		Details []struct {
-			CommentID string `json:"comment_id"`
-			Tags      string `json:"tags"`
-		} `json:"details"`
+	translation := r.URL.Query().Get("translation_language")
+	if translation != "" {
+		if err := validateLanguage(translation); err != nil {
+			writeError(w, err)
+			return
+		}
 	}
 
-	var row []bigquery.Value
-	err = it.Next(&row)
+	job, err := a.jobs.Enqueue(Job{PackageName: packageName, ReviewCount: reviewCount, Incremental: incremental, StartIndex: startIndex, Translation: translation})
 	if err != nil {
-		if err == io.EOF { // Handle case where no results are returned
-			return "", nil
+		if errors.Is(err, ErrQueueFull) {
+			w.Header().Set("Retry-After", "30")
+			err = &AppError{Kind: KindRateLimited, Message: "too many fetch jobs queued, try again later", Err: err}
 		}
-		return "", fmt.Errorf("failed to retrieve next row: %w", err) // Wrap error
+		writeError(w, err)
+		return
 	}
 
-	geminiJSON := row[0].(string)
-	// remove first 7 and last 3 characters from this string
-	geminiJSON = strings.Replace(geminiJSON, "```json", "", -1)
-	geminiJSON = strings.Replace(geminiJSON, "```", "", -1)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
 
-	var geminiResponse GeminiResponse
-	err = json.Unmarshal([]byte(geminiJSON), &geminiResponse)
+// jobEventsHandler streams the progress of a job as Server-Sent Events until it is done or failed
+func (a *App) jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
 
-	if err != nil {
-		return "", fmt.Errorf("failed to parse JSON: %w", err) // Wrap error
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, &AppError{Kind: KindInternal, Message: "streaming is not supported"})
+		return
 	}
 
-	// fmt.Printf("Summary: %s\n", geminiResponse.Summary)
-	// fmt.Println("Details:")
-	// for _, tag := range geminiResponse.Details {
-	// 	if tag.Tags == "" {
-	// 		continue
-	// 	}
-	// 	fmt.Printf("  Comment ID: %s, Tags: %s\n", tag.CommentID, tag.Tags)
-	// }
+	// Subscribe before reading the job so no event is lost in between
+	events, cancel := a.jobs.Subscribe(id)
+	defer cancel()
 
-	// Convert to JSON string for returning in the response
-	jsonData, err := json.Marshal(geminiResponse)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal JSON: %w", err) // Wrap error
+	job, ok := a.jobs.Get(id)
+	if !ok {
+		writeError(w, &AppError{Kind: KindNotFound, Message: "job not found"})
+		return
 	}
 
-	return string(jsonData), nil // Return JSON string and nil error
-}
-
-func homeHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := template.Must(template.ParseFiles("templates/index.html")) // Create index.html
-	tmpl.Execute(w, nil)
-}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
 
-func fetchHandler(w http.ResponseWriter, r *http.Request) {
-	packageName := r.URL.Query().Get("package_name")
-	if packageName == "" {
-		http.Error(w, "Package name is required", http.StatusBadRequest)
+	writeSSE(w, "job", job)
+	flusher.Flush()
+	if job.Status == JobDone || job.Status == JobFailed {
 		return
 	}
 
-	reviewCount, err := strconv.Atoi(r.URL.Query().Get("review_count"))
-	if err != nil || reviewCount <= 0 {
-		reviewCount = 200
+	// Comments keep proxies from closing an idle stream during long stages
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case e := <-events:
+			writeSSE(w, "progress", e)
+			if e.Stage == JobDone || e.Stage == JobFailed {
+				job, _ = a.jobs.Get(id)
+				writeSSE(w, "job", job)
+				flusher.Flush()
+				return
+			}
+			flusher.Flush()
+		}
 	}
+}
 
-	reviews := fetchReviews(packageName, reviewCount)
-	pushToBigQuery(reviews)
-	preProcessReviewsInBigQuery(packageName)
+func (a *App) jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.jobs.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, &AppError{Kind: KindNotFound, Message: "job not found"})
+		return
+	}
 
-	fmt.Fprintln(w, "Reviews fetched, pushed to BigQuery, and pre-processed successfully!")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
 }
 
-func analyzeHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) analyzeHandler(w http.ResponseWriter, r *http.Request) {
 	packageName := r.URL.Query().Get("package_name")
 	if packageName == "" {
-		http.Error(w, "Package name is required", http.StatusBadRequest)
+		writeError(w, invalidArgument("package name is required"))
+		return
+	}
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	versions := getVersions(packageName)
+	versions, err := getVersions(r.Context(), a.store, packageName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 	if len(versions) == 0 {
-		http.Error(w, "No versions found for this package.", http.StatusNotFound)
+		writeError(w, &AppError{Kind: KindNotFound, Message: "no versions found for this package"})
 		return
 	}
 
 	// Convert versions to JSON
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(versions) // Directly encode the versions slice
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+	json.NewEncoder(w).Encode(versions) // Directly encode the versions slice
 }
 
-func versionAnalysisHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) versionAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 	packageName := r.URL.Query().Get("package_name")
 	version := r.URL.Query().Get("version")
 
 	if packageName == "" || version == "" {
-		http.Error(w, "Package name and Version are required", http.StatusBadRequest)
+		writeError(w, invalidArgument("package name and version are required"))
+		return
+	}
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateVersion(version); err != nil {
+		writeError(w, err)
 		return
 	}
 
-	jsonData, err := getVersionAnalysis(packageName, version)
+	jsonData, err := getVersionAnalysis(r.Context(), a.store, packageName, version)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError) // Handle error properly
+		writeError(w, err)
 		return
 	}
 
 	if jsonData == "" { // Handle case where no analysis is found
-		http.Error(w, "No analysis found for this version.", http.StatusNotFound)
+		writeError(w, &AppError{Kind: KindNotFound, Message: "no analysis found for this version"})
 		return
 	}
 
@@ -403,55 +469,31 @@ func versionAnalysisHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, jsonData) // Write JSON to response
 }
 
-func commentHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) commentHandler(w http.ResponseWriter, r *http.Request) {
 	packageName := r.URL.Query().Get("package_name")
 	commentID := r.URL.Query().Get("comment_id")
 
 	if packageName == "" || commentID == "" {
-		http.Error(w, "Package name and comment ID are required", http.StatusBadRequest)
+		writeError(w, invalidArgument("package name and comment ID are required"))
 		return
 	}
-
-	// Query BigQuery for the comment details
-	query := bqClient.Query(fmt.Sprintf(`
-		SELECT *
-		FROM %s.raw_reviews
-		WHERE app_name = '%s' AND review_id = '%s'
-	`, datasetID, packageName, commentID))
-
-	fmt.Printf(`
-	SELECT *
-	FROM %s.raw_reviews
-	WHERE app_name = '%s' AND review_id = '%s'
-`, datasetID, packageName, commentID)
-
-	it, err := query.Read(ctx)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to execute query: %v", err), http.StatusInternalServerError)
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
 		return
 	}
-
-	type CommentDetails struct {
-		ReviewID         string    `bigquery:"review_id"`
-		AuthorName       string    `bigquery:"author_name"`
-		AppName          string    `bigquery:"app_name"`
-		Comments         string    `bigquery:"comments"`
-		StarRating       int64     `bigquery:"star_rating"`
-		LastModified     time.Time `bigquery:"last_modified"`
-		ReviewerLanguage string    `bigquery:"reviewer_language"`
-		Version          string    `bigquery:"version"` // Add Version field
+	if err := validateReviewID(commentID); err != nil {
+		writeError(w, err)
+		return
 	}
 
-	var commentDetails CommentDetails
-	err = it.Next(&commentDetails)
+	commentDetails, err := a.store.Comment(r.Context(), packageName, commentID)
 	if err != nil {
-		if err == iterator.Done {
-			http.Error(w, "Comment not found", http.StatusNotFound)
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "comment not found"})
 			return
 		}
 
-		http.Error(w, fmt.Sprintf("Failed to fetch comment: %v", err), http.StatusInternalServerError)
-
+		writeError(w, newError(KindStorage, "failed to fetch comment", err))
 		return
 	}
 
@@ -460,22 +502,44 @@ func commentHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, args, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) || (err == nil && len(args) > 0 && isHelp(args)) {
+		printUsage(os.Stdout)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	mockURI := os.Getenv("MOCK_URI")
-	if mockURI != "" {
-		reviewsApiUri = mockURI
+	app, err := newApp(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer app.Close()
 
-	http.HandleFunc("/", homeHandler)
-	http.HandleFunc("/fetch", fetchHandler)
-	http.HandleFunc("/analyze", analyzeHandler)
-	http.HandleFunc("/versionAnalysis", versionAnalysisHandler)
-	http.HandleFunc("/comment", commentHandler)
+	// Commands run once instead of the server, see cli.go
+	if len(args) > 0 {
+		if err := runCommand(context.Background(), app, args); err != nil {
+			app.Close()
+			log.Fatal(err)
+		}
+		return
+	}
 
-	log.Printf("Server listening on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	server := &http.Server{Addr: ":" + cfg.Port, Handler: app.routes()}
+
+	// Stop accepting requests on SIGINT/SIGTERM (sent by Cloud Run) and let the running ones finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Server listening on port %s", cfg.Port)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 }
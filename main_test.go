@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandlersRejectMaliciousInput(t *testing.T) {
+	app := &App{cfg: defaultConfig(), store: newMemoryStore()}
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	payloads := []string{
+		"com.example' OR '1'='1",
+		"com.example'; DROP TABLE raw_reviews;--",
+		"1.0;--",
+		"com.example`.raw_reviews",
+		`com.example" OR ""="`,
+		strings.Repeat("a", 1025),
+	}
+
+	for _, payload := range payloads {
+		requests := map[string]url.Values{
+			"/analyze":                 {"package_name": {payload}},
+			"/comment package name":    {"package_name": {payload}, "comment_id": {"gp:AOqpTOH"}},
+			"/comment comment ID":      {"package_name": {"com.example.app"}, "comment_id": {payload}},
+			"/versionAnalysis package": {"package_name": {payload}, "version": {"1.0"}},
+			"/versionAnalysis version": {"package_name": {"com.example.app"}, "version": {payload}},
+		}
+		for name, query := range requests {
+			path, _, _ := strings.Cut(name, " ")
+			t.Run(name+"/"+payload[:min(len(payload), 20)], func(t *testing.T) {
+				resp, err := http.Get(srv.URL + path + "?" + query.Encode())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+
+				if resp.StatusCode != http.StatusBadRequest {
+					t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+				}
+				var body struct {
+					Error struct {
+						Kind ErrorKind `json:"kind"`
+					} `json:"error"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+					t.Fatal(err)
+				}
+				if body.Error.Kind != KindInvalidArgument {
+					t.Errorf("kind = %s, want %s", body.Error.Kind, KindInvalidArgument)
+				}
+			})
+		}
+	}
+}
+
+func TestHandlersAcceptValidInput(t *testing.T) {
+	app := &App{cfg: defaultConfig(), store: newMemoryStore()}
+	srv := httptest.NewServer(app.routes())
+	defer srv.Close()
+
+	// Nothing is stored, valid input gets past validation to a 404
+	for _, path := range []string{
+		"/analyze?package_name=com.example.app",
+		"/comment?package_name=com.example.app&comment_id=gp:AOqpTOH",
+		"/versionAnalysis?package_name=com.example.app&version=5.3.1",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want %d", path, resp.StatusCode, http.StatusNotFound)
+		}
+	}
+}
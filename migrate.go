@@ -0,0 +1,339 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+//go:embed bq-schema/*.json bq-schema/bq_review_analysis.sql
+var bqSchemaFiles embed.FS
+
+// defaultDatasetID is the dataset named in bq-schema/bq_review_analysis.sql
+const defaultDatasetID = "play_store_reviews_demo"
+
+// Outcomes of a migration step. Dry runs report what they would do.
+const (
+	MigrationCreated      = "created"
+	MigrationUpdated      = "updated"
+	MigrationReplaced     = "replaced"
+	MigrationUnchanged    = "unchanged"
+	MigrationMismatch     = "mismatch" // differences that cannot be applied, see the diff
+	MigrationWouldCreate  = "would create"
+	MigrationWouldUpdate  = "would update"
+	MigrationWouldReplace = "would replace"
+)
+
+// MigrationStep reports what a migration did to one BigQuery object
+type MigrationStep struct {
+	Object string   `json:"object"` // dataset, dataset.table, dataset.procedure or dataset.model
+	Kind   string   `json:"kind"`   // dataset, table, procedure or model
+	Status string   `json:"status"`
+	Diff   []string `json:"diff,omitempty"` // "+" added, "-" only in the table, "~" changed
+}
+
+// migrator creates or updates the dataset, the tables of bq-schema, the stored procedure and
+// the gemini_model remote model. Running it again only applies what changed.
+type migrator struct {
+	client *bigquery.Client
+	cfg    Config
+	dryRun bool
+}
+
+func (m *migrator) Run(ctx context.Context) ([]MigrationStep, error) {
+	step, err := m.dataset(ctx)
+	if err != nil {
+		return nil, err
+	}
+	steps := []MigrationStep{step}
+
+	files, err := fs.Glob(bqSchemaFiles, "bq-schema/*.json")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		table := strings.TrimSuffix(path.Base(file), ".json")
+		if table == "raw_reviews" {
+			table = m.cfg.TableID
+		}
+		step, err := m.table(ctx, table, file)
+		if err != nil {
+			return steps, fmt.Errorf("table %s: %w", table, err)
+		}
+		steps = append(steps, step)
+	}
+
+	// The procedure calls the model, create the model first
+	step, err = m.model(ctx)
+	if err != nil {
+		return steps, err
+	}
+	steps = append(steps, step)
+
+	step, err = m.procedure(ctx)
+	if err != nil {
+		return steps, err
+	}
+	return append(steps, step), nil
+}
+
+func (m *migrator) dataset(ctx context.Context) (MigrationStep, error) {
+	step := MigrationStep{Object: m.cfg.DatasetID, Kind: "dataset", Status: MigrationUnchanged}
+	ds := m.client.Dataset(m.cfg.DatasetID)
+
+	md, err := ds.Metadata(ctx)
+	switch {
+	case isNotFound(err):
+		if m.dryRun {
+			step.Status = MigrationWouldCreate
+			return step, nil
+		}
+		if err := ds.Create(ctx, &bigquery.DatasetMetadata{Location: m.cfg.Location}); err != nil {
+			return step, fmt.Errorf("failed to create dataset: %w", err)
+		}
+		step.Status = MigrationCreated
+	case err != nil:
+		return step, fmt.Errorf("failed to read dataset: %w", err)
+	case !strings.EqualFold(md.Location, m.cfg.Location):
+		// A dataset cannot move, and queries run in the configured location
+		step.Status = MigrationMismatch
+		step.Diff = []string{fmt.Sprintf("~ location: %s in BigQuery, %s configured", md.Location, m.cfg.Location)}
+	}
+	return step, nil
+}
+
+func (m *migrator) table(ctx context.Context, table, file string) (MigrationStep, error) {
+	step := MigrationStep{Object: m.cfg.DatasetID + "." + table, Kind: "table", Status: MigrationUnchanged}
+
+	data, err := bqSchemaFiles.ReadFile(file)
+	if err != nil {
+		return step, err
+	}
+	want, err := bigquery.SchemaFromJSON(data)
+	if err != nil {
+		return step, fmt.Errorf("invalid schema %s: %w", file, err)
+	}
+
+	t := m.client.Dataset(m.cfg.DatasetID).Table(table)
+	md, err := t.Metadata(ctx)
+	switch {
+	case isNotFound(err):
+		if m.dryRun {
+			step.Status = MigrationWouldCreate
+			return step, nil
+		}
+		if err := t.Create(ctx, &bigquery.TableMetadata{Schema: want}); err != nil {
+			return step, fmt.Errorf("failed to create table: %w", err)
+		}
+		step.Status = MigrationCreated
+		return step, nil
+	case err != nil:
+		return step, fmt.Errorf("failed to read table: %w", err)
+	}
+
+	merged, diff, mismatch := diffSchema(md.Schema, want, "")
+	step.Diff = diff
+	switch {
+	case mismatch:
+		// Apply nothing rather than half of the changes
+		step.Status = MigrationMismatch
+	case !schemaChanged(diff):
+	case m.dryRun:
+		step.Status = MigrationWouldUpdate
+	default:
+		if _, err := t.Update(ctx, bigquery.TableMetadataToUpdate{Schema: merged}, md.ETag); err != nil {
+			return step, fmt.Errorf("failed to update schema: %w", err)
+		}
+		step.Status = MigrationUpdated
+	}
+	return step, nil
+}
+
+// diffSchema compares the schema of a table with the wanted one. BigQuery can add columns and
+// relax REQUIRED columns to NULLABLE in place, merged is the table schema with those changes.
+// Columns only in the table are kept and reported. Other differences are mismatches.
+func diffSchema(have, want bigquery.Schema, prefix string) (merged bigquery.Schema, diff []string, mismatch bool) {
+	existing := map[string]*bigquery.FieldSchema{}
+	for _, f := range have {
+		existing[strings.ToLower(f.Name)] = f
+	}
+	wanted := map[string]bool{}
+
+	for _, f := range have {
+		copied := *f
+		merged = append(merged, &copied)
+	}
+
+	for _, w := range want {
+		name := prefix + w.Name
+		wanted[strings.ToLower(w.Name)] = true
+
+		h, ok := existing[strings.ToLower(w.Name)]
+		if !ok {
+			if w.Required {
+				diff = append(diff, fmt.Sprintf("~ %s: REQUIRED column cannot be added to an existing table", name))
+				mismatch = true
+				continue
+			}
+			diff = append(diff, fmt.Sprintf("+ %s %s", name, fieldType(w)))
+			merged = append(merged, w)
+			continue
+		}
+
+		if normalizeFieldType(h.Type) != normalizeFieldType(w.Type) || h.Repeated != w.Repeated {
+			diff = append(diff, fmt.Sprintf("~ %s: %s in the table, %s in the schema", name, fieldType(h), fieldType(w)))
+			mismatch = true
+			continue
+		}
+
+		var target *bigquery.FieldSchema
+		for _, f := range merged {
+			if strings.EqualFold(f.Name, w.Name) {
+				target = f
+			}
+		}
+		switch {
+		case h.Required && !w.Required:
+			diff = append(diff, fmt.Sprintf("~ %s: REQUIRED relaxed to NULLABLE", name))
+			target.Required = false
+		case !h.Required && w.Required:
+			diff = append(diff, fmt.Sprintf("~ %s: NULLABLE in the table, REQUIRED in the schema", name))
+			mismatch = true
+		}
+
+		if normalizeFieldType(w.Type) == bigquery.RecordFieldType {
+			nested, nestedDiff, nestedMismatch := diffSchema(h.Schema, w.Schema, name+".")
+			target.Schema = nested
+			diff = append(diff, nestedDiff...)
+			mismatch = mismatch || nestedMismatch
+		}
+	}
+
+	for _, h := range have {
+		if !wanted[strings.ToLower(h.Name)] {
+			diff = append(diff, fmt.Sprintf("- %s %s: only in the table, kept", prefix+h.Name, fieldType(h)))
+		}
+	}
+	return merged, diff, mismatch
+}
+
+// schemaChanged reports whether a diff has changes to apply, columns only in the table are left alone
+func schemaChanged(diff []string) bool {
+	for _, d := range diff {
+		if !strings.HasPrefix(d, "- ") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeFieldType maps the standard SQL type names to the legacy ones the API returns
+func normalizeFieldType(t bigquery.FieldType) bigquery.FieldType {
+	switch strings.ToUpper(string(t)) {
+	case "INT64":
+		return bigquery.IntegerFieldType
+	case "FLOAT64":
+		return bigquery.FloatFieldType
+	case "BOOL":
+		return bigquery.BooleanFieldType
+	case "STRUCT":
+		return bigquery.RecordFieldType
+	}
+	return bigquery.FieldType(strings.ToUpper(string(t)))
+}
+
+func fieldType(f *bigquery.FieldSchema) string {
+	mode := "NULLABLE"
+	switch {
+	case f.Repeated:
+		mode = "REPEATED"
+	case f.Required:
+		mode = "REQUIRED"
+	}
+	return string(normalizeFieldType(f.Type)) + " " + mode
+}
+
+func (m *migrator) model(ctx context.Context) (MigrationStep, error) {
+	step := MigrationStep{Object: m.cfg.DatasetID + ".gemini_model", Kind: "model", Status: MigrationReplaced}
+	if m.dryRun {
+		step.Status = MigrationWouldReplace
+		return step, nil
+	}
+
+	// An unqualified connection is in the location of the dataset
+	connection := m.cfg.Connection
+	if !strings.Contains(connection, ".") {
+		connection = strings.ToLower(m.cfg.Location) + "." + connection
+	}
+
+	// Replacing keeps the endpoint in line with the configured model
+	sql := fmt.Sprintf("CREATE OR REPLACE MODEL `%s.gemini_model`\nREMOTE WITH CONNECTION `%s`\nOPTIONS (ENDPOINT = '%s')",
+		m.cfg.DatasetID, connection, m.cfg.GeminiModel)
+	if err := m.exec(ctx, sql); err != nil {
+		return step, fmt.Errorf("failed to create the remote model, does the connection %s exist? %w", connection, err)
+	}
+	return step, nil
+}
+
+func (m *migrator) procedure(ctx context.Context) (MigrationStep, error) {
+	step := MigrationStep{Object: m.cfg.DatasetID + ".pre_process_reviews_in_bq", Kind: "procedure", Status: MigrationReplaced}
+	if m.dryRun {
+		step.Status = MigrationWouldReplace
+		return step, nil
+	}
+
+	data, err := bqSchemaFiles.ReadFile("bq-schema/bq_review_analysis.sql")
+	if err != nil {
+		return step, err
+	}
+	// The file names the default dataset and table, IDs are validated with the configuration
+	sql := strings.ReplaceAll(string(data), "`"+defaultDatasetID+".raw_reviews`", "`"+m.cfg.DatasetID+"."+m.cfg.TableID+"`")
+	sql = strings.ReplaceAll(sql, "`"+defaultDatasetID+".", "`"+m.cfg.DatasetID+".")
+
+	if err := m.exec(ctx, sql); err != nil {
+		return step, fmt.Errorf("failed to create the stored procedure: %w", err)
+	}
+	return step, nil
+}
+
+// exec runs a DDL statement
+func (m *migrator) exec(ctx context.Context, sql string) error {
+	job, err := m.client.Query(sql).Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
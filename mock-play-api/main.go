@@ -24,7 +24,9 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"strings"
 
@@ -265,30 +267,44 @@ func transformReviews(reviewData []map[string]interface{}, pageInfo map[string]i
 			unixTimestamp = t.Unix()
 		}
 
-		transformed.Reviews = append(transformed.Reviews, TransformedReview{
-			ReviewID:   review["reviewId"].(string),
-			AuthorName: review["userName"].(string),
-			Comments: []Comment{
-				{
-					UserComment: UserComment{
-						Text: review["content"].(string),
-						LastModified: Time{
-							Seconds: unixTimestamp,
-							Nanos:   0,
-						},
-						StarRating:       int(review["score"].(float64)),
-						ReviewerLanguage: "en", // Replace as needed
-						Device:           "",   // Replace as needed
-						AndroidOsVersion: 0,    // Replace as needed
-						AppVersionCode:   0,    // Replace as needed
-						AppVersionName:   review["appVersion"].(string),
-						ThumbsUpCount:    int(review["thumbsUpCount"].(float64)),
-						ThumbsDownCount:  0, // Replace as needed
-						DeviceMetadata:   MockPhones[rand.Intn(len(MockPhones))],
-						OriginalText:     review["content"].(string),
+		comments := []Comment{
+			{
+				UserComment: &UserComment{
+					Text: review["content"].(string),
+					LastModified: Time{
+						Seconds: unixTimestamp,
+						Nanos:   0,
 					},
+					StarRating:       int(review["score"].(float64)),
+					ReviewerLanguage: "en", // Replace as needed
+					Device:           "",   // Replace as needed
+					AndroidOsVersion: 0,    // Replace as needed
+					AppVersionCode:   0,    // Replace as needed
+					AppVersionName:   review["appVersion"].(string),
+					ThumbsUpCount:    int(review["thumbsUpCount"].(float64)),
+					ThumbsDownCount:  0, // Replace as needed
+					DeviceMetadata:   MockPhones[rand.Intn(len(MockPhones))],
+					OriginalText:     review["content"].(string),
 				},
 			},
+		}
+
+		// Replies sent to the mock win over the ones scraped from Play
+		reviewID := review["reviewId"].(string)
+		if reply, ok := sentReply(reviewID); ok {
+			comments = append(comments, Comment{DeveloperComment: &reply})
+		} else if replyContent, ok := review["replyContent"].(string); ok && replyContent != "" {
+			reply := DeveloperComment{Text: replyContent}
+			if repliedAt, err := time.Parse(time.RFC3339, fmt.Sprint(review["repliedAt"])); err == nil {
+				reply.LastModified.Seconds = repliedAt.Unix()
+			}
+			comments = append(comments, Comment{DeveloperComment: &reply})
+		}
+
+		transformed.Reviews = append(transformed.Reviews, TransformedReview{
+			ReviewID:   reviewID,
+			AuthorName: review["userName"].(string),
+			Comments:   comments,
 		})
 	}
 
@@ -401,9 +417,60 @@ func post(ctx context.Context, url string, data url.Values, headers map[string]s
 	return body, nil
 }
 
+// Play limits developer replies to 350 characters
+const maxReplyLength = 350
+
+// replies sent through the reply endpoint, by review ID
+var (
+	repliesMu sync.Mutex
+	replies   = map[string]DeveloperComment{}
+)
+
+func sentReply(reviewID string) (DeveloperComment, bool) {
+	repliesMu.Lock()
+	defer repliesMu.Unlock()
+
+	reply, ok := replies[reviewID]
+	return reply, ok
+}
+
+// handles the /reviews/{review_id}:reply endpoint. Replies are kept in memory and
+// returned as developer comments by the /reviews endpoint.
+func replyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	reviewID := vars["review_id"]
+
+	var req ReplyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.ReplyText) == "" {
+		http.Error(w, "replyText is required", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(req.ReplyText) > maxReplyLength {
+		http.Error(w, fmt.Sprintf("replyText is longer than %d characters", maxReplyLength), http.StatusBadRequest)
+		return
+	}
+
+	reply := DeveloperComment{Text: req.ReplyText, LastModified: Time{Seconds: time.Now().Unix()}}
+	repliesMu.Lock()
+	replies[reviewID] = reply
+	repliesMu.Unlock()
+
+	var resp ReplyResponse
+	resp.Result.ReplyText = reply.Text
+	resp.Result.LastEdited = reply.LastModified
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
 func main() {
 	r := mux.NewRouter()
 	r.HandleFunc("/androidpublisher/v3/applications/{app_id}/reviews", reviewsHandler).Methods("GET")
+	r.HandleFunc("/androidpublisher/v3/applications/{app_id}/reviews/{review_id}:reply", replyHandler).Methods("POST")
 
 	fmt.Println("Play Store mock server listening on port 8080")
 	http.ListenAndServe(":8080", r)
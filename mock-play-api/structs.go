@@ -77,9 +77,29 @@ type TransformedReview struct {
 	Comments   []Comment `json:"comments"`
 }
 
-// Comment represents a comment structure
+// Comment represents a comment structure, either the user comment or the developer reply
 type Comment struct {
-	UserComment UserComment `json:"userComment"`
+	UserComment      *UserComment      `json:"userComment,omitempty"`
+	DeveloperComment *DeveloperComment `json:"developerComment,omitempty"`
+}
+
+// DeveloperComment represents a developer reply structure
+type DeveloperComment struct {
+	Text         string `json:"text"`
+	LastModified Time   `json:"lastModified"`
+}
+
+// ReplyRequest represents the body of the reviews.reply method
+type ReplyRequest struct {
+	ReplyText string `json:"replyText"`
+}
+
+// ReplyResponse represents the answer of the reviews.reply method
+type ReplyResponse struct {
+	Result struct {
+		ReplyText  string `json:"replyText"`
+		LastEdited Time   `json:"lastEdited"`
+	} `json:"result"`
 }
 
 // UserComment represents a user comment structure
@@ -0,0 +1,372 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VersionSummary is the summary of the latest analysis of a version (version_summaries table)
+type VersionSummary struct {
+	AppName       string    `bigquery:"app_name" json:"package_name"`
+	Version       string    `bigquery:"version" json:"version"`
+	Summary       string    `bigquery:"summary" json:"summary"`
+	SchemaVersion int64     `bigquery:"schema_version" json:"schema_version"`
+	AnalyzedAt    time.Time `bigquery:"analyzed_at" json:"analyzed_at"` // created_at of the last chunk in reviews_to_process
+	ProcessedAt   time.Time `bigquery:"processed_at" json:"processed_at"`
+}
+
+// ReviewTag is one tag of a negative review (review_tags table). The severity and category are
+// those of the review, repeated on each of its tags.
+type ReviewTag struct {
+	ReviewID    string    `bigquery:"review_id" json:"review_id"`
+	AppName     string    `bigquery:"app_name" json:"package_name"`
+	Version     string    `bigquery:"version" json:"version"`
+	Tag         string    `bigquery:"tag" json:"tag"`
+	Severity    string    `bigquery:"severity" json:"severity"`
+	Category    string    `bigquery:"category" json:"category"`
+	ProcessedAt time.Time `bigquery:"processed_at" json:"processed_at"`
+
+	// Label of the tag in the taxonomy, unmapped if none, set by readers from tag_mappings
+	Label      string  `bigquery:"-" json:"label,omitempty"`
+	Confidence float64 `bigquery:"-" json:"confidence,omitempty"`
+}
+
+// reducePromptIntro starts the prompt consolidating the chunk summaries of a version
+const reducePromptIntro = "You are a app review summarizer consolidating partial summaries."
+
+const reducePrompt = reducePromptIntro + ` The reviews of version %s of the Android app %s were summarized in %d chunks. Combine the chunk summaries below into a single summary with the overall sentiment outlining positives and negatives, without repeating yourself. Answer with the summary text only.
+
+%s`
+
+// SummaryChunk is the provenance of a version summary: one analyzed chunk of its reviews
+// (summary_chunks table)
+type SummaryChunk struct {
+	AppName     string    `bigquery:"app_name" json:"package_name"`
+	Version     string    `bigquery:"version" json:"version"`
+	Chunk       int64     `bigquery:"chunk" json:"chunk"`             // 1-based, in the order of the analysis
+	AnalyzedAt  time.Time `bigquery:"analyzed_at" json:"analyzed_at"` // created_at of the chunk in reviews_to_process
+	Summary     string    `bigquery:"summary" json:"summary"`
+	ReviewIDs   []string  `bigquery:"review_ids" json:"review_ids"` // the reviews the chunk tagged
+	ProcessedAt time.Time `bigquery:"processed_at" json:"processed_at"`
+}
+
+// VersionAnalysis is the consolidated analysis of a version, with its chunks
+type VersionAnalysis struct {
+	GeminiResponse
+	TagCounts   []TagCount     `json:"tag_counts"`   // most frequent first
+	LabelCounts []LabelCount   `json:"label_counts"` // most frequent first, with the unmapped bucket
+	Chunks      []SummaryChunk `json:"chunks"`
+	Tags        []ReviewTag    `json:"-"` // with their label, the details and counts are built from them
+}
+
+// TagCount is the number of reviews of a version with a tag
+type TagCount struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// processAnalyses is the post-processing stage of an analysis run. The stored answers are
+// validated first, then the analyses not processed yet are reduced per version: the chunk
+// summaries are consolidated into one, and the tags of the reviews are merged and deduplicated.
+// The analyzers supersede the leftovers of failed runs, so a version only has the chunks of
+// its latest run to reduce.
+func processAnalyses(ctx context.Context, store ReviewStore, llm LLMClient, packageName string) error {
+	if err := checkStoredAnalyses(ctx, store, packageName); err != nil {
+		return err
+	}
+
+	unprocessed, err := store.UnprocessedAnalyses(ctx, packageName)
+	if err != nil {
+		return newError(KindStorage, "failed to list unprocessed analyses", err)
+	}
+
+	// Analyses are listed oldest first, chunks keep that order
+	var versions []string
+	chunks := map[string][]*StoredAnalysis{}
+	for _, stored := range unprocessed {
+		if chunks[stored.Version] == nil {
+			versions = append(versions, stored.Version)
+		}
+		chunks[stored.Version] = append(chunks[stored.Version], stored)
+	}
+
+	for _, version := range versions {
+		if err := processVersion(ctx, store, llm, packageName, version, chunks[version]); err != nil {
+			return err
+		}
+	}
+	if len(unprocessed) > 0 {
+		log.Printf("Processed %d analyses of %s in %d versions", len(unprocessed), packageName, len(versions))
+	}
+	return nil
+}
+
+// processVersion reduces the chunks of a version into its summary and review tags
+func processVersion(ctx context.Context, store ReviewStore, llm LLMClient, packageName, version string, chunks []*StoredAnalysis) error {
+	now := time.Now().UTC()
+	var summaries []string
+	var provenance []SummaryChunk
+	details := map[string]AnalysisDetail{}
+	for i, stored := range chunks {
+		var analysis GeminiResponse
+		if err := json.Unmarshal([]byte(stored.Response), &analysis); err != nil {
+			// Only validated analyses are listed
+			return newError(KindInternal, "failed to decode analysis", err)
+		}
+
+		chunk := SummaryChunk{
+			AppName:     packageName,
+			Version:     version,
+			Chunk:       int64(i + 1),
+			AnalyzedAt:  stored.CreatedAt,
+			Summary:     analysis.Summary,
+			ReviewIDs:   []string{},
+			ProcessedAt: now,
+		}
+		for _, detail := range analysis.Details {
+			// A review paged into two chunks keeps its latest tags
+			details[detail.CommentID] = detail
+			chunk.ReviewIDs = append(chunk.ReviewIDs, detail.CommentID)
+		}
+		summaries = append(summaries, analysis.Summary)
+		provenance = append(provenance, chunk)
+	}
+
+	text := summaries[0]
+	if len(summaries) > 1 {
+		var err error
+		if text, err = reduceSummaries(ctx, llm, packageName, version, summaries); err != nil {
+			return err
+		}
+	}
+
+	merged := make([]AnalysisDetail, 0, len(details))
+	for _, detail := range details {
+		merged = append(merged, detail)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].CommentID < merged[j].CommentID })
+	dedupTags(merged)
+
+	tags := []ReviewTag{}
+	for _, detail := range merged {
+		for _, tag := range detail.Tags {
+			tags = append(tags, ReviewTag{
+				ReviewID:    detail.CommentID,
+				AppName:     packageName,
+				Version:     version,
+				Tag:         tag,
+				Severity:    detail.Severity,
+				Category:    detail.Category,
+				ProcessedAt: now,
+			})
+		}
+	}
+
+	summary := &VersionSummary{
+		AppName:       packageName,
+		Version:       version,
+		Summary:       text,
+		SchemaVersion: analysisSchemaVersion,
+		AnalyzedAt:    chunks[len(chunks)-1].CreatedAt,
+		ProcessedAt:   now,
+	}
+	if err := store.SaveProcessedVersion(ctx, chunks, summary, provenance, tags); err != nil {
+		return newError(KindStorage, "failed to save processed analyses", err)
+	}
+	return nil
+}
+
+// reduceSummaries asks the model for one summary out of the chunk summaries of a version
+func reduceSummaries(ctx context.Context, llm LLMClient, packageName, version string, summaries []string) (string, error) {
+	var lines []string
+	for i, summary := range summaries {
+		lines = append(lines, fmt.Sprintf("Chunk %d: %s", i+1, summary))
+	}
+
+	answer, err := llm.Generate(ctx, fmt.Sprintf(reducePrompt, version, packageName, len(summaries), strings.Join(lines, "\n")))
+	if err != nil {
+		return "", newError(KindLLM, "failed to consolidate the summaries of version "+version, err)
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return "", &AppError{Kind: KindLLM, Message: "empty consolidated summary of version " + version}
+	}
+	return answer, nil
+}
+
+// tagKey is the form of a tag compared when merging tags and mapping them to the taxonomy
+func tagKey(tag string) string {
+	return strings.ToLower(strings.Join(strings.Fields(tag), " "))
+}
+
+// dedupTags merges the tags of a version that only differ by case or spacing into their most
+// used spelling, then removes the duplicates of each review
+func dedupTags(details []AnalysisDetail) {
+	key := tagKey
+	spellings := map[string]map[string]int{}
+	for _, detail := range details {
+		for _, tag := range detail.Tags {
+			if spellings[key(tag)] == nil {
+				spellings[key(tag)] = map[string]int{}
+			}
+			spellings[key(tag)][tag]++
+		}
+	}
+	canonical := map[string]string{}
+	for k, counts := range spellings {
+		for _, spelling := range topTags(counts, 1) {
+			canonical[k] = spelling
+		}
+	}
+
+	for i := range details {
+		seen := map[string]bool{}
+		tags := []string{}
+		for _, tag := range details[i].Tags {
+			if tag = canonical[key(tag)]; !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+		details[i].Tags = tags
+	}
+}
+
+// versionAnalysis rebuilds the analysis of a version from its summary, the tags of its reviews
+// and its chunks, or returns nil if the version was never analyzed
+func versionAnalysis(ctx context.Context, store ReviewStore, packageName, version string) (*VersionAnalysis, error) {
+	summary, err := store.VersionSummary(ctx, packageName, version)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newError(KindStorage, "failed to retrieve version summary", err)
+	}
+
+	tags, err := labeledReviewTags(ctx, store, packageName, version)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := store.SummaryChunks(ctx, packageName, version)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to retrieve summary chunks", err)
+	}
+	if chunks == nil {
+		chunks = []SummaryChunk{}
+	}
+
+	analysis := &VersionAnalysis{
+		GeminiResponse: GeminiResponse{SchemaVersion: int(summary.SchemaVersion), Summary: summary.Summary, Details: []AnalysisDetail{}},
+		TagCounts:      []TagCount{},
+		LabelCounts:    []LabelCount{},
+		Chunks:         chunks,
+		Tags:           tags,
+	}
+	index := map[string]int{}
+	counts := map[string]int{}
+	labeled := map[string]map[string]bool{} // label -> reviews
+	for _, tag := range tags {
+		if labeled[tag.Label] == nil {
+			labeled[tag.Label] = map[string]bool{}
+		}
+		labeled[tag.Label][tag.ReviewID] = true
+
+		i, ok := index[tag.ReviewID]
+		if !ok {
+			i = len(analysis.Details)
+			index[tag.ReviewID] = i
+			analysis.Details = append(analysis.Details, AnalysisDetail{CommentID: tag.ReviewID, Tags: []string{}, Severity: tag.Severity, Category: tag.Category})
+		}
+		analysis.Details[i].Tags = append(analysis.Details[i].Tags, tag.Tag)
+		counts[tag.Tag]++
+	}
+	sort.Slice(analysis.Details, func(i, j int) bool { return analysis.Details[i].CommentID < analysis.Details[j].CommentID })
+	for _, tag := range topTags(counts, len(counts)) {
+		analysis.TagCounts = append(analysis.TagCounts, TagCount{Tag: tag, Count: counts[tag]})
+	}
+	labelCounts := map[string]int{}
+	for label, reviews := range labeled {
+		labelCounts[label] = len(reviews)
+	}
+	for _, label := range topTags(labelCounts, len(labelCounts)) {
+		analysis.LabelCounts = append(analysis.LabelCounts, LabelCount{Label: label, Count: labelCounts[label]})
+	}
+	return analysis, nil
+}
+
+// labeledReviewTags lists the tags of the reviews of a package like ReviewTags, with their label
+func labeledReviewTags(ctx context.Context, store ReviewStore, packageName, version string) ([]ReviewTag, error) {
+	tags, err := store.ReviewTags(ctx, packageName, version)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to retrieve review tags", err)
+	}
+	labels, err := tagLabels(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tags {
+		tags[i].Label = unmappedLabel
+		if m, ok := labels[tagKey(tags[i].Tag)]; ok {
+			tags[i].Label, tags[i].Confidence = m.Label, m.Confidence
+		}
+	}
+	return tags, nil
+}
+
+func (a *App) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("package_name")
+	version := r.URL.Query().Get("version")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	if version != "" {
+		if err := validateVersion(version); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	tags, err := labeledReviewTags(r.Context(), a.store, packageName, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	tag, label := r.URL.Query().Get("tag"), r.URL.Query().Get("label")
+	if tag != "" || label != "" {
+		var matching []ReviewTag
+		for _, t := range tags {
+			if (tag == "" || t.Tag == tag) && (label == "" || t.Label == label) {
+				matching = append(matching, t)
+			}
+		}
+		tags = matching
+	}
+	if tags == nil {
+		tags = []ReviewTag{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
@@ -0,0 +1,265 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package playapi is a client for the reviews methods of the Google Play Developer API
+// (https://developers.google.com/android-publisher/api-ref/rest/v3/reviews).
+//
+// Calls are retried with exponential backoff and jitter on 429 and 5xx answers, honoring
+// Retry-After, and rate limited per app to stay within the API quota.
+package playapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/time/rate"
+)
+
+// DefaultBaseURL is the production endpoint, Options.BaseURL can point to the mock instead
+const DefaultBaseURL = "https://androidpublisher.googleapis.com"
+
+// Scope needed by the credentials of the http.Client given to New
+const Scope = "https://www.googleapis.com/auth/androidpublisher"
+
+// Options tunes a Client. Zero values pick the defaults.
+type Options struct {
+	BaseURL string // DefaultBaseURL if empty
+
+	MaxRetries    int           // retries after the first attempt, 5 by default, negative for none
+	MinBackoff    time.Duration // delay before the first retry, 1s by default
+	MaxBackoff    time.Duration // longest delay between retries, 32s by default
+	MaxRetryAfter time.Duration // longer Retry-After answers are returned as errors, 5m by default
+
+	// Requests per hour and per app, 200 by default (the reviews quota), negative for no limit
+	RequestsPerHour int
+	Burst           int // requests allowed at once before the rate applies, 20 by default
+}
+
+// Client calls the Play Developer API. It is safe for concurrent use.
+type Client struct {
+	httpClient *http.Client
+	opts       Options
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter // by package name
+}
+
+// New returns a client sending requests through httpClient, which must add credentials
+// with the androidpublisher Scope (see golang.org/x/oauth2/google.DefaultClient)
+func New(httpClient *http.Client, opts Options) *Client {
+	if opts.BaseURL == "" {
+		opts.BaseURL = DefaultBaseURL
+	}
+	opts.BaseURL = strings.TrimSuffix(opts.BaseURL, "/")
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = 5
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = time.Second
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = 32 * time.Second
+	}
+	if opts.MaxRetryAfter == 0 {
+		opts.MaxRetryAfter = 5 * time.Minute
+	}
+	if opts.RequestsPerHour == 0 {
+		opts.RequestsPerHour = 200
+	}
+	if opts.Burst == 0 {
+		opts.Burst = 20
+	}
+
+	return &Client{httpClient: httpClient, opts: opts, limiters: map[string]*rate.Limiter{}}
+}
+
+// BaseURL returns the endpoint the client talks to
+func (c *Client) BaseURL() string {
+	return c.opts.BaseURL
+}
+
+// Error is a non 2xx answer of the API
+type Error struct {
+	StatusCode int
+	Status     string // canonical status from the error body, e.g. NOT_FOUND
+	Message    string
+	RetryAfter time.Duration // from the Retry-After header, zero if absent
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("play API answered %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+func (c *Client) limiter(packageName string) *rate.Limiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.limiters[packageName]
+	if !ok {
+		limit := rate.Inf
+		if c.opts.RequestsPerHour > 0 {
+			limit = rate.Every(time.Hour / time.Duration(c.opts.RequestsPerHour))
+		}
+		l = rate.NewLimiter(limit, c.opts.Burst)
+		c.limiters[packageName] = l
+	}
+	return l
+}
+
+// do sends a request about packageName and decodes the JSON answer into out, retrying
+// temporary failures
+func (c *Client) do(ctx context.Context, packageName, method, path string, query url.Values, in, out any) error {
+	reqURL := c.opts.BaseURL + path
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+
+	var reqBody []byte
+	if in != nil {
+		var err error
+		if reqBody, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("error encoding request: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter(packageName).Wait(ctx); err != nil {
+			return err
+		}
+
+		err := c.send(ctx, method, reqURL, reqBody, out)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr *Error
+		retryAfter := time.Duration(0)
+		switch {
+		case errors.As(err, &apiErr):
+			if !apiErr.Temporary() || apiErr.RetryAfter > c.opts.MaxRetryAfter {
+				return err
+			}
+			retryAfter = apiErr.RetryAfter
+		case ctx.Err() != nil:
+			return ctx.Err()
+		default:
+			// Credentials problems do not go away by retrying
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(err, &retrieveErr) {
+				return err
+			}
+		}
+
+		if attempt >= c.opts.MaxRetries {
+			return err
+		}
+
+		delay := c.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// send makes a single attempt
+func (c *Client) send(ctx context.Context, method, reqURL string, reqBody []byte, out any) error {
+	var body io.Reader
+	if reqBody != nil {
+		body = bytes.NewReader(reqBody)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	if reqBody != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newError(resp, respBody)
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("error unmarshalling response: %w", err)
+	}
+	return nil
+}
+
+// backoff returns the delay before retry number attempt+1: exponential, capped, with the
+// upper half jittered so that clients do not retry in lockstep
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.opts.MaxBackoff
+	if attempt < 30 {
+		d = min(c.opts.MinBackoff<<attempt, c.opts.MaxBackoff)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func newError(resp *http.Response, body []byte) *Error {
+	err := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+
+	// Google APIs answer {"error": {"code": 404, "message": "...", "status": "NOT_FOUND"}}
+	var googleErr struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &googleErr) == nil && googleErr.Error.Message != "" {
+		err.Message = googleErr.Error.Message
+		err.Status = googleErr.Error.Status
+	}
+
+	if value := resp.Header.Get("Retry-After"); value != "" {
+		if seconds, convErr := strconv.Atoi(value); convErr == nil {
+			err.RetryAfter = time.Duration(seconds) * time.Second
+		} else if at, convErr := http.ParseTime(value); convErr == nil {
+			err.RetryAfter = max(time.Until(at), 0)
+		}
+	}
+	return err
+}
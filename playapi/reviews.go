@@ -0,0 +1,209 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package playapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// MaxPageSize is the largest page reviews.list answers
+const MaxPageSize = 100
+
+// ListReviewsRequest are the parameters of reviews.list
+type ListReviewsRequest struct {
+	PackageName         string
+	Token               string // page token from a previous TokenPagination.NextPageToken
+	MaxResults          int    // page size, zero for the API default, capped at MaxPageSize
+	StartIndex          int    // index of the first review, zero to omit
+	TranslationLanguage string // e.g. "en", reviews are translated to it when set
+}
+
+// ListReviewsResponse is the answer of reviews.list
+type ListReviewsResponse struct {
+	Reviews         []Review `json:"reviews"`
+	TokenPagination struct {
+		NextPageToken     string `json:"nextPageToken"`
+		PreviousPageToken string `json:"previousPageToken"`
+	} `json:"tokenPagination"`
+	PageInfo struct {
+		TotalResults  int `json:"totalResults"`
+		ResultPerPage int `json:"resultPerPage"`
+		StartIndex    int `json:"startIndex"`
+	} `json:"pageInfo"`
+}
+
+// Review is a user review with its developer reply, if any
+type Review struct {
+	ReviewID   string    `json:"reviewId"`
+	AuthorName string    `json:"authorName"`
+	Comments   []Comment `json:"comments"` // the user comment, then the developer reply if there is one
+}
+
+// UserComment returns the comment of the reviewer, nil if there is none
+func (r *Review) UserComment() *UserComment {
+	for _, c := range r.Comments {
+		if c.UserComment != nil {
+			return c.UserComment
+		}
+	}
+	return nil
+}
+
+// DeveloperComment returns the reply of the developer, nil if there is none
+func (r *Review) DeveloperComment() *DeveloperComment {
+	for _, c := range r.Comments {
+		if c.DeveloperComment != nil {
+			return c.DeveloperComment
+		}
+	}
+	return nil
+}
+
+// Comment holds either a user comment or a developer reply
+type Comment struct {
+	UserComment      *UserComment      `json:"userComment,omitempty"`
+	DeveloperComment *DeveloperComment `json:"developerComment,omitempty"`
+}
+
+type UserComment struct {
+	Text             string          `json:"text"`
+	LastModified     Timestamp       `json:"lastModified"`
+	StarRating       int64           `json:"starRating"`
+	ReviewerLanguage string          `json:"reviewerLanguage"`
+	Device           string          `json:"device"`
+	AndroidOsVersion int64           `json:"androidOsVersion"`
+	AppVersionCode   int64           `json:"appVersionCode"`
+	AppVersionName   string          `json:"appVersionName"`
+	ThumbsUpCount    int64           `json:"thumbsUpCount"`
+	ThumbsDownCount  int64           `json:"thumbsDownCount"`
+	DeviceMetadata   *DeviceMetadata `json:"deviceMetadata"`
+	OriginalText     string          `json:"originalText"`
+}
+
+type DeveloperComment struct {
+	Text         string    `json:"text"`
+	LastModified Timestamp `json:"lastModified"`
+}
+
+type DeviceMetadata struct {
+	ProductName      string `json:"productName"`
+	Manufacturer     string `json:"manufacturer"`
+	DeviceClass      string `json:"deviceClass"`
+	ScreenWidthPx    int64  `json:"screenWidthPx"`
+	ScreenHeightPx   int64  `json:"screenHeightPx"`
+	NativePlatform   string `json:"nativePlatform"`
+	ScreenDensityDpi int64  `json:"screenDensityDpi"`
+	GlEsVersion      int64  `json:"glEsVersion"`
+	CpuModel         string `json:"cpuModel"`
+	CpuMake          string `json:"cpuMake"`
+	RamMb            int64  `json:"ramMb"`
+}
+
+// Timestamp is the protobuf Timestamp of the API. The API sends seconds as a string,
+// the mock as a number, both are accepted.
+type Timestamp struct {
+	Seconds int64
+	Nanos   int64
+}
+
+func (t *Timestamp) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Seconds json.Number `json:"seconds"`
+		Nanos   int64       `json:"nanos"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	t.Nanos = raw.Nanos
+	t.Seconds = 0
+	if raw.Seconds != "" {
+		seconds, err := raw.Seconds.Int64()
+		if err != nil {
+			return fmt.Errorf("invalid timestamp seconds %q: %w", raw.Seconds, err)
+		}
+		t.Seconds = seconds
+	}
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Seconds string `json:"seconds"`
+		Nanos   int64  `json:"nanos"`
+	}{strconv.FormatInt(t.Seconds, 10), t.Nanos})
+}
+
+// Time converts the timestamp, in UTC
+func (t Timestamp) Time() time.Time {
+	return time.Unix(t.Seconds, t.Nanos).UTC()
+}
+
+// ListReviews calls reviews.list, a single page
+func (c *Client) ListReviews(ctx context.Context, req ListReviewsRequest) (*ListReviewsResponse, error) {
+	query := url.Values{}
+	if req.Token != "" {
+		query.Set("token", req.Token)
+	}
+	if req.MaxResults > 0 {
+		query.Set("maxResults", strconv.Itoa(min(req.MaxResults, MaxPageSize)))
+	}
+	if req.StartIndex > 0 {
+		query.Set("startIndex", strconv.Itoa(req.StartIndex))
+	}
+	if req.TranslationLanguage != "" {
+		query.Set("translationLanguage", req.TranslationLanguage)
+	}
+
+	var resp ListReviewsResponse
+	path := fmt.Sprintf("/androidpublisher/v3/applications/%s/reviews", url.PathEscape(req.PackageName))
+	if err := c.do(ctx, req.PackageName, "GET", path, query, nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ReplyRequest are the parameters of reviews.reply
+type ReplyRequest struct {
+	PackageName string
+	ReviewID    string
+	ReplyText   string // at most 350 characters
+}
+
+// ReplyResponse is the answer of reviews.reply
+type ReplyResponse struct {
+	Result struct {
+		ReplyText  string    `json:"replyText"`
+		LastEdited Timestamp `json:"lastEdited"`
+	} `json:"result"`
+}
+
+// Reply calls reviews.reply. Replying again replaces the previous reply.
+func (c *Client) Reply(ctx context.Context, req ReplyRequest) (*ReplyResponse, error) {
+	body := struct {
+		ReplyText string `json:"replyText"`
+	}{req.ReplyText}
+
+	var resp ReplyResponse
+	path := fmt.Sprintf("/androidpublisher/v3/applications/%s/reviews/%s:reply", url.PathEscape(req.PackageName), url.PathEscape(req.ReviewID))
+	if err := c.do(ctx, req.PackageName, "POST", path, nil, body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
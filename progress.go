@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ProgressFunc receives progress updates of a long running stage. A nil ProgressFunc is valid and ignores them.
+type ProgressFunc func(done, total int, message string)
+
+func (p ProgressFunc) report(done, total int, message string) {
+	if p != nil {
+		p(done, total, message)
+	}
+}
+
+// ProgressEvent is a single progress update of a job, as streamed to the browser
+type ProgressEvent struct {
+	JobID   string    `json:"job_id"`
+	Stage   string    `json:"stage"`
+	Done    int       `json:"done"`
+	Total   int       `json:"total"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// progressBroker fans out progress events to the clients following a job
+type progressBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan ProgressEvent]struct{}
+}
+
+func newProgressBroker() *progressBroker {
+	return &progressBroker{subs: map[string]map[chan ProgressEvent]struct{}{}}
+}
+
+// Subscribe returns the events of a job and a function to call once done reading them
+func (b *progressBroker) Subscribe(jobID string) (<-chan ProgressEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan ProgressEvent, 64)
+	if b.subs[jobID] == nil {
+		b.subs[jobID] = map[chan ProgressEvent]struct{}{}
+	}
+	b.subs[jobID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subs[jobID], ch)
+		if len(b.subs[jobID]) == 0 {
+			delete(b.subs, jobID)
+		}
+	}
+}
+
+// Publish never blocks: events are dropped for clients too slow to keep up, except the
+// terminal done and failed events which evict the oldest buffered event, as streams only end
+// on them
+func (b *progressBroker) Publish(e ProgressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	terminal := e.Stage == JobDone || e.Stage == JobFailed
+	for ch := range b.subs[e.JobID] {
+		select {
+		case ch <- e:
+			continue
+		default:
+		}
+		if !terminal {
+			continue
+		}
+		// Only Publish sends, under b.mu, so the freed slot stays free
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// writeSSE writes a single Server-Sent Event with a JSON payload
+func writeSSE(w http.ResponseWriter, event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+	return err
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/NucleusEngineering/play-gemini/playapi"
+)
+
+// Reply is a developer reply sent from the app (review_replies table)
+type Reply struct {
+	AppName    string    `bigquery:"app_name" json:"package_name"`
+	ReviewID   string    `bigquery:"review_id" json:"comment_id"`
+	Text       string    `bigquery:"reply_text" json:"text"`
+	LastEdited time.Time `bigquery:"last_edited" json:"last_edited"` // as stored by Play
+	SentAt     time.Time `bigquery:"sent_at" json:"sent_at"`
+}
+
+// postReply calls the Play Developer API reviews.reply method. Replying again replaces the
+// previous reply. It returns the reply as stored by Play.
+func postReply(ctx context.Context, client *playapi.Client, packageName, reviewID, text string) (*DeveloperComment, error) {
+	resp, err := client.Reply(ctx, playapi.ReplyRequest{PackageName: packageName, ReviewID: reviewID, ReplyText: text})
+	if err != nil {
+		appErr := playAPIError(packageName, err)
+		if errorKind(appErr) == KindNotFound {
+			return nil, &AppError{Kind: KindNotFound, Message: fmt.Sprintf("review %s of %s not found", reviewID, packageName)}
+		}
+		var apiErr *playapi.Error
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+			return nil, &AppError{Kind: KindInvalidArgument, Message: "play API rejected the reply", Err: appErr}
+		}
+		return nil, appErr
+	}
+
+	return &DeveloperComment{
+		Text:         resp.Result.ReplyText,
+		LastModified: resp.Result.LastEdited.Time(),
+	}, nil
+}
+
+// sendReply posts a reply to Play and records it. A reply accepted by Play but not recorded is
+// returned along with the storage error.
+func (a *App) sendReply(ctx context.Context, packageName, reviewID, text string) (*Reply, error) {
+	posted, err := postReply(ctx, a.play, packageName, reviewID, text)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &Reply{
+		AppName:    packageName,
+		ReviewID:   reviewID,
+		Text:       posted.Text,
+		LastEdited: posted.LastModified,
+		SentAt:     time.Now().UTC(),
+	}
+	if reply.Text == "" {
+		reply.Text = text
+	}
+	if err := a.store.SaveReply(ctx, reply); err != nil {
+		// The reply is public already, callers must not fail, that would only invite a second send
+		return reply, newError(KindStorage, "reply sent but could not be recorded", err)
+	}
+	return reply, nil
+}
+
+// replyHandler sends a reply to a review. It takes a JSON body with package_name, comment_id and text.
+func (a *App) replyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		PackageName string `json:"package_name"`
+		CommentID   string `json:"comment_id"`
+		Text        string `json:"text"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, invalidArgument("invalid JSON body"))
+		return
+	}
+	if err := validatePackageName(req.PackageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateReviewID(req.CommentID); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateReplyText(req.Text); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	reply, err := a.sendReply(r.Context(), req.PackageName, req.CommentID, req.Text)
+	if reply == nil {
+		writeError(w, err)
+		return
+	}
+	resp := struct {
+		*Reply
+		Warning string `json:"warning,omitempty"`
+	}{Reply: reply}
+	if err != nil {
+		log.Printf("Reply to review %s of %s: %v", req.CommentID, req.PackageName, err)
+		resp.Warning = err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// repliesHandler lists the replies sent to a review from the app, newest first
+func (a *App) repliesHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("package_name")
+	commentID := r.URL.Query().Get("comment_id")
+
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := validateReviewID(commentID); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	replies, err := a.store.Replies(r.Context(), packageName, commentID)
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to list replies", err))
+		return
+	}
+	if replies == nil {
+		replies = []Reply{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(replies)
+}
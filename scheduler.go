@@ -0,0 +1,461 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Outcome of the last run of a schedule
+const (
+	ScheduleRunning = "running"
+	ScheduleDone    = "done"
+	ScheduleFailed  = "failed"
+	ScheduleSkipped = "skipped" // a run of the package was still in progress
+)
+
+const (
+	scheduleTick  = 30 * time.Second // how often the long-running scheduler looks for due schedules
+	staleRunAfter = 2 * time.Hour    // a run still marked running after this long was lost with its instance
+)
+
+// Schedule runs a fetch job (fetch, insert, analyze, draft) for a registered app on a cron
+// schedule (schedules table). Runs start up to the scheduler jitter after the cron time.
+type Schedule struct {
+	PackageName string `json:"package_name"`
+	Cron        string `json:"cron"` // 5 fields or a descriptor like @daily, in UTC
+	Incremental bool   `json:"incremental"`
+	Enabled     bool   `json:"enabled"`
+
+	LastRunAt  time.Time `json:"last_run_at"` // zero if it never ran
+	LastStatus string    `json:"last_status,omitempty"`
+	LastError  string    `json:"last_error,omitempty"`
+	LastJobID  string    `json:"last_job_id,omitempty"`
+	NextRunAt  time.Time `json:"next_run_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// scheduler starts the jobs of due schedules. Run polls in a long-running process, RunDue
+// does a single pass for one-shot runs triggered from outside (e.g. Cloud Scheduler).
+type scheduler struct {
+	ctx    context.Context // outlives the requests starting runs, cancelled on shutdown
+	store  ReviewStore
+	jobs   *jobQueue
+	jitter time.Duration
+	count  int // reviews fetched for apps without a fetch count
+	now    func() time.Time
+
+	mu      sync.Mutex      // serializes starts, so that overlap checks hold
+	running map[string]bool // packages with a run of this process in flight
+	wg      sync.WaitGroup
+}
+
+func newScheduler(ctx context.Context, store ReviewStore, jobs *jobQueue, jitter time.Duration, count int) *scheduler {
+	return &scheduler{ctx: ctx, store: store, jobs: jobs, jitter: jitter, count: count, now: time.Now, running: map[string]bool{}}
+}
+
+// nextRun returns the first cron time of spec after t, delayed by a random jitter
+func (s *scheduler) nextRun(spec string, t time.Time) (time.Time, error) {
+	schedule, err := cron.ParseStandard(spec)
+	if err != nil {
+		return time.Time{}, invalidArgument(fmt.Sprintf("invalid cron expression %q: %v", spec, err))
+	}
+	next := schedule.Next(t.UTC())
+	if s.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+	}
+	return next, nil
+}
+
+// Run starts the due schedules every scheduleTick until ctx is cancelled
+func (s *scheduler) Run(ctx context.Context) {
+	log.Printf("Scheduler started, jitter %s", s.jitter)
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.RunDue(ctx); err != nil {
+			log.Printf("Scheduler: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue starts every enabled schedule whose next run is due and returns them, leaving out
+// the skipped runs. The outcome of their jobs is recorded in the background, see Wait.
+func (s *scheduler) RunDue(ctx context.Context) ([]Schedule, error) {
+	schedules, err := s.store.Schedules(ctx)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to list schedules", err)
+	}
+
+	started := []Schedule{}
+	for i := range schedules {
+		sched := &schedules[i]
+		if !sched.Enabled || sched.NextRunAt.After(s.now()) {
+			continue
+		}
+		ran, err := s.start(ctx, sched)
+		if err != nil {
+			log.Printf("Scheduled run of %s failed to start: %v", sched.PackageName, err)
+			continue
+		}
+		if ran {
+			started = append(started, *sched)
+		}
+	}
+	return started, nil
+}
+
+// RunNow starts the schedule of a package right away, whatever its next run
+func (s *scheduler) RunNow(ctx context.Context, packageName string) (*Schedule, error) {
+	sched, err := s.store.Schedule(ctx, packageName)
+	if errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read schedule", err)
+	}
+	if _, err := s.start(ctx, sched); err != nil {
+		return nil, err
+	}
+	return sched, nil
+}
+
+// Wait blocks until the jobs started by this process are over, or ctx is done
+func (s *scheduler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start moves the next run of sched and starts a job, unless a run of the package is
+// still in progress. sched is updated with the new state, false is returned if the run was skipped.
+func (s *scheduler) start(ctx context.Context, sched *Schedule) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The schedule may have been edited or deleted since it was listed
+	current, err := s.store.Schedule(ctx, sched.PackageName)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, newError(KindStorage, "failed to read schedule", err)
+	}
+	*sched = *current
+
+	now := s.now().UTC()
+	next, err := s.nextRun(sched.Cron, now)
+	if err != nil {
+		return false, err
+	}
+	sched.NextRunAt = next
+	sched.UpdatedAt = now
+
+	if reason := s.overlap(sched, now); reason != "" {
+		log.Printf("Skipping scheduled run of %s: %s", sched.PackageName, reason)
+		// A run marked running keeps its mark, it guards other instances
+		if sched.LastStatus != ScheduleRunning {
+			sched.LastStatus = ScheduleSkipped
+			sched.LastError = reason
+		}
+		if err := s.store.SaveSchedule(ctx, sched); err != nil {
+			return false, newError(KindStorage, "failed to save schedule", err)
+		}
+		return false, nil
+	}
+
+	count := s.count
+	if app, err := s.store.App(ctx, sched.PackageName); err == nil {
+		count = int(app.FetchCount)
+	} else if !errors.Is(err, ErrNotFound) {
+		return false, newError(KindStorage, "failed to read registered app", err)
+	}
+
+	sched.LastRunAt = now
+	job, err := s.jobs.Enqueue(Job{PackageName: sched.PackageName, ReviewCount: count, Incremental: sched.Incremental})
+	if err != nil {
+		sched.LastStatus = ScheduleFailed
+		sched.LastError = err.Error()
+		sched.LastJobID = ""
+	} else {
+		sched.LastStatus = ScheduleRunning
+		sched.LastError = ""
+		sched.LastJobID = job.ID
+	}
+	if err := s.store.SaveSchedule(ctx, sched); err != nil {
+		return false, newError(KindStorage, "failed to save schedule", err)
+	}
+	if sched.LastStatus != ScheduleRunning {
+		return true, nil
+	}
+
+	log.Printf("Scheduled run of %s started as job %s, next run at %s", sched.PackageName, job.ID, next.Format(time.RFC3339))
+	s.running[sched.PackageName] = true
+	s.wg.Add(1)
+	go s.follow(sched.PackageName, job.ID)
+	return true, nil
+}
+
+// overlap tells why a run of the package cannot start now, "" if it can. Caller must hold s.mu.
+func (s *scheduler) overlap(sched *Schedule, now time.Time) string {
+	if s.running[sched.PackageName] {
+		return "the previous scheduled run is still in progress"
+	}
+	if job, ok := s.jobs.Active(sched.PackageName); ok {
+		return fmt.Sprintf("job %s of the package is still in progress", job.ID)
+	}
+	if sched.LastStatus == ScheduleRunning && now.Sub(sched.LastRunAt) < staleRunAfter {
+		return fmt.Sprintf("the run started at %s by another instance is still in progress", sched.LastRunAt.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// follow waits for the job of a run and records its outcome
+func (s *scheduler) follow(packageName, jobID string) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.running, packageName)
+		s.mu.Unlock()
+	}()
+
+	job, err := s.jobs.Wait(s.ctx, jobID)
+	if err != nil {
+		log.Printf("Lost track of scheduled job %s: %v", jobID, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The schedule may have been edited or deleted in the meantime
+	sched, err := s.store.Schedule(s.ctx, packageName)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			log.Printf("Failed to record scheduled job %s: %v", jobID, err)
+		}
+		return
+	}
+	if sched.LastJobID != jobID {
+		return
+	}
+
+	sched.LastStatus = ScheduleDone
+	sched.LastError = ""
+	if job.Status == JobFailed {
+		sched.LastStatus = ScheduleFailed
+		sched.LastError = job.Error
+	}
+	sched.UpdatedAt = s.now().UTC()
+	if err := s.store.SaveSchedule(s.ctx, sched); err != nil {
+		log.Printf("Failed to record scheduled job %s: %v", jobID, err)
+	}
+}
+
+func (a *App) schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	schedules, err := a.store.Schedules(r.Context())
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to list schedules", err))
+		return
+	}
+	if schedules == nil {
+		schedules = []Schedule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+func (a *App) scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sched, err := a.store.Schedule(r.Context(), packageName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "no schedule for this package"})
+			return
+		}
+		writeError(w, newError(KindStorage, "failed to read schedule", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sched)
+}
+
+// putScheduleHandler creates or replaces the schedule of a registered app. It takes a JSON
+// body with cron, incremental and enabled (true if omitted), the run history is kept.
+func (a *App) putScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req struct {
+		Cron        string `json:"cron"`
+		Incremental bool   `json:"incremental"`
+		Enabled     *bool  `json:"enabled"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, invalidArgument("invalid JSON body"))
+		return
+	}
+
+	registered, err := a.registeredApp(r.Context(), packageName)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if registered == nil {
+		writeError(w, invalidArgument(fmt.Sprintf("app %s is not registered, register it with POST /apps first", packageName)))
+		return
+	}
+
+	now := time.Now().UTC()
+	next, err := a.scheduler.nextRun(strings.TrimSpace(req.Cron), now)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.scheduler.mu.Lock()
+	defer a.scheduler.mu.Unlock()
+
+	sched, err := a.store.Schedule(r.Context(), packageName)
+	if errors.Is(err, ErrNotFound) {
+		sched, err = &Schedule{PackageName: packageName}, nil
+	}
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to read schedule", err))
+		return
+	}
+	sched.Cron = strings.TrimSpace(req.Cron)
+	sched.Incremental = req.Incremental
+	sched.Enabled = req.Enabled == nil || *req.Enabled
+	sched.NextRunAt = next
+	sched.UpdatedAt = now
+	if err := a.store.SaveSchedule(r.Context(), sched); err != nil {
+		writeError(w, newError(KindStorage, "failed to save schedule", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sched)
+}
+
+func (a *App) deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Under the lock of the scheduler, or a run starting meanwhile would save the schedule again
+	a.scheduler.mu.Lock()
+	err := a.store.DeleteSchedule(r.Context(), packageName)
+	a.scheduler.mu.Unlock()
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "no schedule for this package"})
+			return
+		}
+		writeError(w, newError(KindStorage, "failed to delete schedule", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runSchedulesHandler is the one-shot entry point for an external trigger such as Cloud
+// Scheduler: it starts the due schedules, and with wait=true answers once their jobs are over.
+func (a *App) runSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	wait := false
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = strconv.ParseBool(value); err != nil {
+			writeError(w, invalidArgument(fmt.Sprintf("invalid wait flag %q", value)))
+			return
+		}
+	}
+
+	started, err := a.scheduler.RunDue(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if wait {
+		if err := a.scheduler.Wait(r.Context()); err != nil {
+			log.Printf("Stopped waiting for the scheduled runs: %v", err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(started)
+}
+
+func (a *App) runScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("package")
+	if err := validatePackageName(packageName); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sched, err := a.scheduler.RunNow(r.Context(), packageName)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "no schedule for this package"})
+			return
+		}
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(sched)
+}
@@ -0,0 +1,171 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Format used for Review.LastModified, matching what BigQuery accepts for TIMESTAMP columns
+const lastModifiedLayout = "2006-01-02 15:04:05.000000"
+
+// ErrNotFound is returned by a ReviewStore when the requested row does not exist
+var ErrNotFound = errors.New("not found")
+
+// CommentDetails is a single raw review as returned by the /comment endpoint
+type CommentDetails struct {
+	ReviewID         string    `bigquery:"review_id"`
+	AuthorName       string    `bigquery:"author_name"`
+	AppName          string    `bigquery:"app_name"`
+	Comments         string    `bigquery:"comments"`
+	StarRating       int64     `bigquery:"star_rating"`
+	LastModified     time.Time `bigquery:"last_modified"`
+	ReviewerLanguage string    `bigquery:"reviewer_language"`
+	Version          string    `bigquery:"version"` // Add Version field
+
+	Device           string            `bigquery:"device"`
+	AndroidOSVersion int64             `bigquery:"android_os_version"`
+	AppVersionCode   int64             `bigquery:"app_version_code"`
+	ThumbsUpCount    int64             `bigquery:"thumbs_up_count"`
+	ThumbsDownCount  int64             `bigquery:"thumbs_down_count"`
+	DeviceMetadata   *DeviceMetadata   `bigquery:"device_metadata"`
+	OriginalText     string            `bigquery:"original_text"`
+	DeveloperComment *DeveloperComment `bigquery:"developer_comment"`
+}
+
+// ReviewStore persists fetched reviews and the Gemini analysis produced for them.
+// The BigQuery implementation is the production one, the in-memory and SQLite ones
+// allow running the whole flow locally without a Google Cloud project.
+type ReviewStore interface {
+	// InsertReviews stores raw reviews (raw_reviews table). It is idempotent: a review that is
+	// already stored is only replaced by a newer edit, keyed by review_id and last_modified.
+	InsertReviews(ctx context.Context, reviews []*Review) error
+	// DedupReviews keeps only the latest edit of every review and returns the number of rows removed
+	DedupReviews(ctx context.Context) (int64, error)
+	// Versions lists the app versions that have an analysis (version_summaries table)
+	Versions(ctx context.Context, packageName string) ([]string, error)
+	// Comment returns a single raw review, or ErrNotFound
+	Comment(ctx context.Context, packageName, reviewID string) (*CommentDetails, error)
+
+	// VersionsToAnalyze lists non empty versions having a review with at most maxStars modified after since
+	VersionsToAnalyze(ctx context.Context, packageName string, since time.Time, maxStars int64) ([]string, error)
+	// ReviewsForVersion returns a page of the reviews of a version modified after since, ordered by review_id
+	ReviewsForVersion(ctx context.Context, packageName, version string, since time.Time, limit, offset int) ([]*Review, error)
+	// SaveAnalysis stores a raw Gemini response for a chunk of reviews (reviews_to_process table)
+	SaveAnalysis(ctx context.Context, packageName, version, geminiResponse string) error
+	// UncheckedAnalyses lists the analyses of a package without a schema_version: written by the
+	// stored procedure, or before the analysis schema existed
+	UncheckedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error)
+	// ReplaceAnalysis replaces the response of a stored analysis, or deletes it if response is ""
+	ReplaceAnalysis(ctx context.Context, analysis *StoredAnalysis, response string) error
+	// QuarantineAnalysis records an answer that failed validation (analysis_quarantine table)
+	QuarantineAnalysis(ctx context.Context, q *QuarantinedAnalysis) error
+	// QuarantinedAnalyses lists the quarantined answers of a package, newest first
+	QuarantinedAnalyses(ctx context.Context, packageName string) ([]*QuarantinedAnalysis, error)
+	// UnprocessedAnalyses lists the validated analyses of a package without a processed_at, oldest first
+	UnprocessedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error)
+	// SupersedeAnalyses sets the processed_at of the unprocessed analyses of a version without
+	// reducing them, when a new analysis of the version starts
+	SupersedeAnalyses(ctx context.Context, packageName, version string) error
+	// SaveProcessedVersion replaces the summary of a version (version_summaries table), its chunks
+	// (summary_chunks table) and its tags, along with the other tags of the reviews tagged by the
+	// analyses (review_tags table), then sets the processed_at of the analyses
+	SaveProcessedVersion(ctx context.Context, analyses []*StoredAnalysis, summary *VersionSummary, chunks []SummaryChunk, tags []ReviewTag) error
+	// VersionSummary returns the summary of a version, or ErrNotFound
+	VersionSummary(ctx context.Context, packageName, version string) (*VersionSummary, error)
+	// SummaryChunks lists the chunks of the summary of a version, in order
+	SummaryChunks(ctx context.Context, packageName, version string) ([]SummaryChunk, error)
+	// ReviewTags lists the tags of the reviews of a package, of one version if set, ordered by review_id and tag
+	ReviewTags(ctx context.Context, packageName, version string) ([]ReviewTag, error)
+
+	// SaveTaxonomyLabel creates or replaces a label by ID (taxonomy table)
+	SaveTaxonomyLabel(ctx context.Context, label *TaxonomyLabel) error
+	// TaxonomyLabels lists the labels of the taxonomy, ordered by ID
+	TaxonomyLabels(ctx context.Context) ([]TaxonomyLabel, error)
+	// DeleteTaxonomyLabel removes a label, or returns ErrNotFound
+	DeleteTaxonomyLabel(ctx context.Context, id string) error
+	// SaveTagMappings creates or replaces the mappings of tags (tag_mappings table)
+	SaveTagMappings(ctx context.Context, mappings []TagMapping) error
+	// TagMappings lists the mappings of all tags, ordered by tag
+	TagMappings(ctx context.Context) ([]TagMapping, error)
+	// ClearTagMappings removes the mappings that were not set manually, to map the tags again
+	ClearTagMappings(ctx context.Context) error
+
+	// SyncCheckpoint returns the incremental sync checkpoint of a package, or nil if it was never synced
+	SyncCheckpoint(ctx context.Context, packageName string) (*SyncCheckpoint, error)
+	// SaveSyncCheckpoint creates or replaces the checkpoint of cp.PackageName (sync_checkpoints table)
+	SaveSyncCheckpoint(ctx context.Context, cp *SyncCheckpoint) error
+
+	// SaveReply records a reply sent to Play (review_replies table)
+	SaveReply(ctx context.Context, reply *Reply) error
+	// Replies lists the replies sent to a review, newest first
+	Replies(ctx context.Context, packageName, reviewID string) ([]Reply, error)
+
+	// SaveDraft creates or replaces a reply draft by ID (reply_drafts table)
+	SaveDraft(ctx context.Context, draft *ReplyDraft) error
+	// Draft returns a reply draft, or ErrNotFound
+	Draft(ctx context.Context, id string) (*ReplyDraft, error)
+	// Drafts lists the reply drafts of a package with the given status (all if empty), newest first
+	Drafts(ctx context.Context, packageName, status string) ([]ReplyDraft, error)
+	// ReviewsToDraft lists the tagged reviews of a package rated maxStars or less that have
+	// neither a developer reply nor a reply draft, newest first, at most limit
+	ReviewsToDraft(ctx context.Context, packageName string, maxStars int64, limit int) ([]*CommentDetails, error)
+
+	// SaveApp creates or replaces the registration of app.PackageName (apps table)
+	SaveApp(ctx context.Context, app *RegisteredApp) error
+	// App returns a registered app, or ErrNotFound
+	App(ctx context.Context, packageName string) (*RegisteredApp, error)
+	// Apps lists the registered apps
+	Apps(ctx context.Context) ([]RegisteredApp, error)
+	// DeleteApp unregisters an app, or returns ErrNotFound
+	DeleteApp(ctx context.Context, packageName string) error
+	// AppStats sums up the reviews and analyses of the given packages, recent ones being
+	// modified after since. Packages without any review or analysis are left out.
+	AppStats(ctx context.Context, packageNames []string, since time.Time) (map[string]*AppStats, error)
+	// VersionStats sums up the reviews of the given versions of a package. Versions without any
+	// review are left out.
+	VersionStats(ctx context.Context, packageName string, versions []string) (map[string]*VersionStats, error)
+
+	// SaveSchedule creates or replaces the schedule of sched.PackageName (schedules table)
+	SaveSchedule(ctx context.Context, sched *Schedule) error
+	// Schedule returns the schedule of a package, or ErrNotFound
+	Schedule(ctx context.Context, packageName string) (*Schedule, error)
+	// Schedules lists all schedules
+	Schedules(ctx context.Context) ([]Schedule, error)
+	// DeleteSchedule removes the schedule of a package, or returns ErrNotFound
+	DeleteSchedule(ctx context.Context, packageName string) error
+
+	Close() error
+}
+
+// newReviewStore builds the store selected by cfg.ReviewStore. bqClient is only used by the
+// BigQuery store, which does not own it.
+func newReviewStore(cfg Config, bqClient *bigquery.Client) (ReviewStore, error) {
+	switch cfg.ReviewStore {
+	case "", "bigquery":
+		return newBigQueryStore(bqClient, cfg.DatasetID, cfg.TableID, cfg.ReviewInsertMode)
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return newSQLiteStore(cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unknown review store %q (expected bigquery, memory or sqlite)", cfg.ReviewStore)
+	}
+}
@@ -0,0 +1,1468 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// bigQueryStore keeps reviews in the raw_reviews and reviews_to_process tables of a BigQuery dataset.
+// Values always go through query parameters, only the validated dataset ID is interpolated.
+// The client belongs to the App, Close does not close it.
+//
+// Reviews are inserted either with a MERGE upsert (insertMode "merge"), or with the streaming
+// inserter (insertMode "stream"), which is cheaper but only deduplicates on a best effort basis.
+// Rows still in the streaming buffer cannot be merged nor deduplicated, so pick one mode per table.
+type bigQueryStore struct {
+	client     *bigquery.Client
+	dataset    string
+	table      string // raw reviews
+	insertMode string
+}
+
+func newBigQueryStore(client *bigquery.Client, dataset, table, insertMode string) (*bigQueryStore, error) {
+	if client == nil {
+		return nil, fmt.Errorf("the BigQuery store needs a BigQuery client")
+	}
+	if err := validateDatasetID(dataset); err != nil {
+		return nil, err
+	}
+	if err := validateDatasetID(table); err != nil {
+		return nil, err
+	}
+
+	if insertMode != "merge" && insertMode != "stream" {
+		return nil, fmt.Errorf("unknown review insert mode %q (expected merge or stream)", insertMode)
+	}
+
+	return &bigQueryStore{client: client, dataset: dataset, table: table, insertMode: insertMode}, nil
+}
+
+func (s *bigQueryStore) InsertReviews(ctx context.Context, reviews []*Review) error {
+	if s.insertMode == "stream" {
+		return s.streamReviews(ctx, reviews)
+	}
+	return s.mergeReviews(ctx, reviews)
+}
+
+// streamReviews uses the streaming inserter. The insert ID makes BigQuery drop a review sent
+// again within about a minute, later duplicates are left to DedupReviews.
+func (s *bigQueryStore) streamReviews(ctx context.Context, reviews []*Review) error {
+	savers := make([]*bigquery.StructSaver, len(reviews))
+	for i, r := range reviews {
+		savers[i] = &bigquery.StructSaver{Struct: r, InsertID: r.ReviewID + "@" + r.LastModified}
+	}
+
+	u := s.client.Dataset(s.dataset).Table(s.table).Inserter()
+	if err := u.Put(ctx, savers); err != nil {
+		return fmt.Errorf("failed to insert reviews into BigQuery: %w", err)
+	}
+	return nil
+}
+
+// mergeReviews upserts the reviews: new ones are inserted, stored ones are only updated by a newer edit
+func (s *bigQueryStore) mergeReviews(ctx context.Context, reviews []*Review) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.%s AS t
+		USING (
+			SELECT * REPLACE (CAST(last_modified AS TIMESTAMP) AS last_modified)
+			FROM UNNEST(@reviews)
+			WHERE TRUE
+			QUALIFY ROW_NUMBER() OVER (PARTITION BY app_name, review_id ORDER BY last_modified DESC) = 1
+		) AS s
+		ON t.app_name = s.app_name AND t.review_id = s.review_id
+		WHEN MATCHED AND s.last_modified > t.last_modified THEN UPDATE SET
+			author_name = s.author_name,
+			version = s.version,
+			comments = s.comments,
+			star_rating = s.star_rating,
+			last_modified = s.last_modified,
+			reviewer_language = s.reviewer_language,
+			device = s.device,
+			android_os_version = s.android_os_version,
+			app_version_code = s.app_version_code,
+			thumbs_up_count = s.thumbs_up_count,
+			thumbs_down_count = s.thumbs_down_count,
+			device_metadata = s.device_metadata,
+			original_text = s.original_text,
+			developer_comment = s.developer_comment
+		WHEN NOT MATCHED THEN
+			INSERT (app_name, review_id, author_name, version, comments, star_rating, last_modified, reviewer_language,
+				device, android_os_version, app_version_code, thumbs_up_count, thumbs_down_count, device_metadata, original_text, developer_comment)
+			VALUES (s.app_name, s.review_id, s.author_name, s.version, s.comments, s.star_rating, s.last_modified, s.reviewer_language,
+				s.device, s.android_os_version, s.app_version_code, s.thumbs_up_count, s.thumbs_down_count, s.device_metadata, s.original_text, s.developer_comment)
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "reviews", Value: reviews},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to merge reviews into BigQuery: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to merge reviews into BigQuery: %w", err)
+	}
+	return status.Err()
+}
+
+// DedupReviews rewrites the table in a single MERGE, so the table itself, its schema and
+// its options are kept. It fails while rows are in the streaming buffer.
+func (s *bigQueryStore) DedupReviews(ctx context.Context) (int64, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %[1]s.%[2]s AS t
+		USING (
+			SELECT *
+			FROM %[1]s.%[2]s
+			WHERE TRUE
+			QUALIFY ROW_NUMBER() OVER (PARTITION BY app_name, review_id ORDER BY last_modified DESC) = 1
+		) AS s
+		ON FALSE
+		WHEN NOT MATCHED BY SOURCE THEN DELETE
+		WHEN NOT MATCHED THEN INSERT ROW
+	`, s.dataset, s.table))
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deduplicate reviews: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deduplicate reviews: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return 0, fmt.Errorf("failed to deduplicate reviews: %w", err)
+	}
+
+	// Every row is deleted and the kept ones inserted again
+	stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics)
+	if !ok || stats.DMLStats == nil {
+		return 0, nil
+	}
+	return stats.DMLStats.DeletedRowCount - stats.DMLStats.InsertedRowCount, nil
+}
+
+func (s *bigQueryStore) Versions(ctx context.Context, packageName string) ([]string, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT version
+		FROM %s.version_summaries
+		WHERE app_name = @app_name
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var versions []string
+	for {
+		var row map[string]bigquery.Value
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		versions = append(versions, row["version"].(string))
+	}
+
+	return versions, nil
+}
+
+func (s *bigQueryStore) Comment(ctx context.Context, packageName, reviewID string) (*CommentDetails, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.%s
+		WHERE app_name = @app_name AND review_id = @review_id
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "review_id", Value: reviewID},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var commentDetails CommentDetails
+	err = it.Next(&commentDetails)
+	if err != nil {
+		if err == iterator.Done {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to fetch comment: %w", err)
+	}
+
+	return &commentDetails, nil
+}
+
+func (s *bigQueryStore) VersionsToAnalyze(ctx context.Context, packageName string, since time.Time, maxStars int64) ([]string, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT DISTINCT version
+		FROM %s.%s
+		WHERE last_modified >= @since
+			AND star_rating <= @max_stars AND version != '' AND app_name = @app_name
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "since", Value: since},
+		{Name: "max_stars", Value: maxStars},
+		{Name: "app_name", Value: packageName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var versions []string
+	for {
+		var row struct {
+			Version string `bigquery:"version"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		versions = append(versions, row.Version)
+	}
+
+	return versions, nil
+}
+
+func (s *bigQueryStore) ReviewsForVersion(ctx context.Context, packageName, version string, since time.Time, limit, offset int) ([]*Review, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT app_name, review_id, star_rating, comments, version
+		FROM %s.%s
+		WHERE version = @version
+			AND last_modified >= @since
+			AND app_name = @app_name
+		ORDER BY review_id
+		LIMIT @limit OFFSET @offset
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "version", Value: version},
+		{Name: "since", Value: since},
+		{Name: "app_name", Value: packageName},
+		{Name: "limit", Value: limit},
+		{Name: "offset", Value: offset},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var reviews []*Review
+	for {
+		var r Review
+		err = it.Next(&r)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		reviews = append(reviews, &r)
+	}
+
+	return reviews, nil
+}
+
+func (s *bigQueryStore) SaveAnalysis(ctx context.Context, packageName, version, geminiResponse string) error {
+	// DML rather than the streaming inserter so the row can be updated right away
+	query := s.client.Query(fmt.Sprintf(`
+		INSERT INTO %s.reviews_to_process (app_name, gemini_response, created_at, processed_at, version)
+		VALUES (@app_name, @gemini_response, CURRENT_TIMESTAMP(), NULL, @version)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "gemini_response", Value: geminiResponse},
+		{Name: "version", Value: version},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert analysis: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to insert analysis: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) SyncCheckpoint(ctx context.Context, packageName string) (*SyncCheckpoint, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT last_modified, page_token, pending_last_modified, updated_at
+		FROM %s.sync_checkpoints
+		WHERE app_name = @app_name
+		LIMIT 1
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var row struct {
+		LastModified        bigquery.NullTimestamp `bigquery:"last_modified"`
+		PageToken           bigquery.NullString    `bigquery:"page_token"`
+		PendingLastModified bigquery.NullTimestamp `bigquery:"pending_last_modified"`
+		UpdatedAt           time.Time              `bigquery:"updated_at"`
+	}
+	err = it.Next(&row)
+	if err == iterator.Done {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync checkpoint: %w", err)
+	}
+
+	return &SyncCheckpoint{
+		PackageName:         packageName,
+		LastModified:        row.LastModified.Timestamp,
+		PageToken:           row.PageToken.StringVal,
+		PendingLastModified: row.PendingLastModified.Timestamp,
+		UpdatedAt:           row.UpdatedAt,
+	}, nil
+}
+
+func (s *bigQueryStore) SaveSyncCheckpoint(ctx context.Context, cp *SyncCheckpoint) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.sync_checkpoints AS t
+		USING (SELECT @app_name AS app_name) AS s
+		ON t.app_name = s.app_name
+		WHEN MATCHED THEN UPDATE SET
+			last_modified = @last_modified,
+			page_token = @page_token,
+			pending_last_modified = @pending_last_modified,
+			updated_at = @updated_at
+		WHEN NOT MATCHED THEN
+			INSERT (app_name, last_modified, page_token, pending_last_modified, updated_at)
+			VALUES (@app_name, @last_modified, @page_token, @pending_last_modified, @updated_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: cp.PackageName},
+		{Name: "last_modified", Value: nullTimestamp(cp.LastModified)},
+		{Name: "page_token", Value: cp.PageToken},
+		{Name: "pending_last_modified", Value: nullTimestamp(cp.PendingLastModified)},
+		{Name: "updated_at", Value: cp.UpdatedAt},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save sync checkpoint: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save sync checkpoint: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) UncheckedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error) {
+	// JSON_VALUE is NULL for invalid JSON too
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT app_name, IFNULL(version, '') AS version, IFNULL(gemini_response, '') AS gemini_response, created_at
+		FROM %s.reviews_to_process
+		WHERE app_name = @app_name AND JSON_VALUE(gemini_response, '$.schema_version') IS NULL
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{{Name: "app_name", Value: packageName}}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var unchecked []*StoredAnalysis
+	for {
+		var row struct {
+			AppName        string    `bigquery:"app_name"`
+			Version        string    `bigquery:"version"`
+			GeminiResponse string    `bigquery:"gemini_response"`
+			CreatedAt      time.Time `bigquery:"created_at"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		unchecked = append(unchecked, &StoredAnalysis{AppName: row.AppName, Version: row.Version, Response: row.GeminiResponse, CreatedAt: row.CreatedAt})
+	}
+	return unchecked, nil
+}
+
+func (s *bigQueryStore) ReplaceAnalysis(ctx context.Context, analysis *StoredAnalysis, response string) error {
+	// reviews_to_process has no key, a row is matched on all its columns
+	where := `WHERE app_name = @app_name AND IFNULL(version, '') = @version AND created_at = @created_at AND IFNULL(gemini_response, '') = @old_response`
+	sql := fmt.Sprintf(`DELETE FROM %s.reviews_to_process `+where, s.dataset)
+	if response != "" {
+		sql = fmt.Sprintf(`UPDATE %s.reviews_to_process SET gemini_response = @response `+where, s.dataset)
+	}
+
+	query := s.client.Query(sql)
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: analysis.AppName},
+		{Name: "version", Value: analysis.Version},
+		{Name: "created_at", Value: analysis.CreatedAt},
+		{Name: "old_response", Value: analysis.Response},
+	}
+	if response != "" {
+		query.Parameters = append(query.Parameters, bigquery.QueryParameter{Name: "response", Value: response})
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to replace analysis: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to replace analysis: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) QuarantineAnalysis(ctx context.Context, q *QuarantinedAnalysis) error {
+	query := s.client.Query(fmt.Sprintf(`
+		INSERT INTO %s.analysis_quarantine (id, app_name, version, raw_response, reason, attempts, source, created_at)
+		VALUES (@id, @app_name, @version, @raw_response, @reason, @attempts, @source, @created_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "id", Value: q.ID},
+		{Name: "app_name", Value: q.AppName},
+		{Name: "version", Value: q.Version},
+		{Name: "raw_response", Value: q.Response},
+		{Name: "reason", Value: q.Reason},
+		{Name: "attempts", Value: q.Attempts},
+		{Name: "source", Value: q.Source},
+		{Name: "created_at", Value: q.CreatedAt},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine analysis: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to quarantine analysis: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) QuarantinedAnalyses(ctx context.Context, packageName string) ([]*QuarantinedAnalysis, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT id, app_name, IFNULL(version, '') AS version, IFNULL(raw_response, '') AS raw_response, reason, attempts, source, created_at
+		FROM %s.analysis_quarantine
+		WHERE app_name = @app_name
+		ORDER BY created_at DESC
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{{Name: "app_name", Value: packageName}}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var quarantined []*QuarantinedAnalysis
+	for {
+		var q QuarantinedAnalysis
+		err = it.Next(&q)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		quarantined = append(quarantined, &q)
+	}
+	return quarantined, nil
+}
+
+func (s *bigQueryStore) UnprocessedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT app_name, IFNULL(version, '') AS version, gemini_response, created_at
+		FROM %s.reviews_to_process
+		WHERE app_name = @app_name AND processed_at IS NULL AND JSON_VALUE(gemini_response, '$.schema_version') IS NOT NULL
+		ORDER BY created_at
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{{Name: "app_name", Value: packageName}}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var unprocessed []*StoredAnalysis
+	for {
+		var row struct {
+			AppName        string    `bigquery:"app_name"`
+			Version        string    `bigquery:"version"`
+			GeminiResponse string    `bigquery:"gemini_response"`
+			CreatedAt      time.Time `bigquery:"created_at"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		unprocessed = append(unprocessed, &StoredAnalysis{AppName: row.AppName, Version: row.Version, Response: row.GeminiResponse, CreatedAt: row.CreatedAt})
+	}
+	return unprocessed, nil
+}
+
+func (s *bigQueryStore) SupersedeAnalyses(ctx context.Context, packageName, version string) error {
+	query := s.client.Query(fmt.Sprintf(`
+		UPDATE %s.reviews_to_process SET processed_at = CURRENT_TIMESTAMP()
+		WHERE app_name = @app_name AND IFNULL(version, '') = @version AND processed_at IS NULL
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "version", Value: version},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to supersede analyses: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to supersede analyses: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) SaveProcessedVersion(ctx context.Context, analyses []*StoredAnalysis, summary *VersionSummary, chunks []SummaryChunk, tags []ReviewTag) error {
+	type analysisKey struct {
+		CreatedAt time.Time `bigquery:"created_at"`
+		Response  string    `bigquery:"response"`
+	}
+	keys := make([]analysisKey, len(analyses))
+	for i, a := range analyses {
+		keys[i] = analysisKey{CreatedAt: a.CreatedAt, Response: a.Response}
+	}
+
+	// One transaction, so a failed run leaves the analyses unprocessed and is retried as a whole
+	query := s.client.Query(fmt.Sprintf(`
+		BEGIN TRANSACTION;
+
+		MERGE %[1]s.version_summaries AS t
+		USING (SELECT @summary AS s) AS s
+		ON t.app_name = s.s.app_name AND t.version = s.s.version
+		WHEN MATCHED THEN UPDATE SET
+			summary = s.s.summary,
+			schema_version = s.s.schema_version,
+			analyzed_at = s.s.analyzed_at,
+			processed_at = s.s.processed_at
+		WHEN NOT MATCHED THEN
+			INSERT (app_name, version, summary, schema_version, analyzed_at, processed_at)
+			VALUES (s.s.app_name, s.s.version, s.s.summary, s.s.schema_version, s.s.analyzed_at, s.s.processed_at);
+
+		DELETE FROM %[1]s.summary_chunks WHERE app_name = @app_name AND version = @version;
+
+		INSERT INTO %[1]s.summary_chunks (app_name, version, chunk, analyzed_at, summary, review_ids, processed_at)
+		SELECT app_name, version, chunk, analyzed_at, summary, review_ids, processed_at
+		FROM UNNEST(@chunks);
+
+		DELETE FROM %[1]s.review_tags
+		WHERE app_name = @app_name
+			AND (IFNULL(version, '') = @version OR review_id IN (SELECT review_id FROM UNNEST(@tags)));
+
+		INSERT INTO %[1]s.review_tags (review_id, app_name, version, tag, severity, category, processed_at)
+		SELECT DISTINCT review_id, app_name, version, tag, severity, category, processed_at
+		FROM UNNEST(@tags);
+
+		UPDATE %[1]s.reviews_to_process AS t SET processed_at = @processed_at
+		WHERE app_name = @app_name AND IFNULL(version, '') = @version
+			AND EXISTS (SELECT 1 FROM UNNEST(@analyses) AS a WHERE a.created_at = t.created_at AND a.response = t.gemini_response);
+
+		COMMIT TRANSACTION;
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "summary", Value: summary},
+		{Name: "chunks", Value: chunks},
+		{Name: "tags", Value: tags},
+		{Name: "analyses", Value: keys},
+		{Name: "app_name", Value: summary.AppName},
+		{Name: "version", Value: summary.Version},
+		{Name: "processed_at", Value: summary.ProcessedAt},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save processed analyses: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save processed analyses: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) VersionSummary(ctx context.Context, packageName, version string) (*VersionSummary, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT app_name, version, IFNULL(summary, '') AS summary, schema_version, analyzed_at, processed_at
+		FROM %s.version_summaries
+		WHERE app_name = @app_name AND version = @version
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "version", Value: version},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var summary VersionSummary
+	err = it.Next(&summary)
+	if err == iterator.Done {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read row: %w", err)
+	}
+	return &summary, nil
+}
+
+func (s *bigQueryStore) SummaryChunks(ctx context.Context, packageName, version string) ([]SummaryChunk, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT app_name, version, chunk, analyzed_at, IFNULL(summary, '') AS summary, review_ids, processed_at
+		FROM %s.summary_chunks
+		WHERE app_name = @app_name AND version = @version
+		ORDER BY chunk
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "version", Value: version},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var chunks []SummaryChunk
+	for {
+		var chunk SummaryChunk
+		err = it.Next(&chunk)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func (s *bigQueryStore) ReviewTags(ctx context.Context, packageName, version string) ([]ReviewTag, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT review_id, app_name, IFNULL(version, '') AS version, tag, IFNULL(severity, '') AS severity,
+			IFNULL(category, '') AS category, processed_at
+		FROM %s.review_tags
+		WHERE app_name = @app_name AND (@version = '' OR version = @version)
+		ORDER BY review_id, tag
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "version", Value: version},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var tags []ReviewTag
+	for {
+		var tag ReviewTag
+		err = it.Next(&tag)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func (s *bigQueryStore) SaveTaxonomyLabel(ctx context.Context, label *TaxonomyLabel) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.taxonomy AS t
+		USING (SELECT @label AS l) AS s
+		ON t.label_id = s.l.label_id
+		WHEN MATCHED THEN UPDATE SET
+			description = s.l.description,
+			synonyms = s.l.synonyms,
+			updated_at = s.l.updated_at
+		WHEN NOT MATCHED THEN
+			INSERT (label_id, category, issue, description, synonyms, updated_at)
+			VALUES (s.l.label_id, s.l.category, s.l.issue, s.l.description, s.l.synonyms, s.l.updated_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "label", Value: label},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save taxonomy label: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save taxonomy label: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) TaxonomyLabels(ctx context.Context) ([]TaxonomyLabel, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT label_id, category, issue, IFNULL(description, '') AS description, synonyms, updated_at
+		FROM %s.taxonomy
+		ORDER BY label_id
+	`, s.dataset))
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var labels []TaxonomyLabel
+	for {
+		var label TaxonomyLabel
+		err = it.Next(&label)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+func (s *bigQueryStore) DeleteTaxonomyLabel(ctx context.Context, id string) error {
+	query := s.client.Query(fmt.Sprintf(`
+		DELETE FROM %s.taxonomy
+		WHERE label_id = @label_id
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "label_id", Value: id},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete taxonomy label: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete taxonomy label: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && stats.DMLStats != nil && stats.DMLStats.DeletedRowCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *bigQueryStore) SaveTagMappings(ctx context.Context, mappings []TagMapping) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.tag_mappings AS t
+		USING (SELECT * FROM UNNEST(@mappings)) AS s
+		ON t.tag = s.tag
+		WHEN MATCHED THEN UPDATE SET
+			label = NULLIF(s.label, ''),
+			suggestion = NULLIF(s.suggestion, ''),
+			confidence = s.confidence,
+			method = s.method,
+			mapped_at = s.mapped_at
+		WHEN NOT MATCHED THEN
+			INSERT (tag, label, suggestion, confidence, method, mapped_at)
+			VALUES (s.tag, NULLIF(s.label, ''), NULLIF(s.suggestion, ''), s.confidence, s.method, s.mapped_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "mappings", Value: mappings},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save tag mappings: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save tag mappings: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) TagMappings(ctx context.Context) ([]TagMapping, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT tag, IFNULL(label, '') AS label, IFNULL(suggestion, '') AS suggestion, confidence, method, mapped_at
+		FROM %s.tag_mappings
+		ORDER BY tag
+	`, s.dataset))
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var mappings []TagMapping
+	for {
+		var m TagMapping
+		err = it.Next(&m)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+func (s *bigQueryStore) ClearTagMappings(ctx context.Context) error {
+	query := s.client.Query(fmt.Sprintf(`
+		DELETE FROM %s.tag_mappings
+		WHERE method != @manual
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "manual", Value: MappingManual},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to clear tag mappings: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to clear tag mappings: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) SaveReply(ctx context.Context, reply *Reply) error {
+	query := s.client.Query(fmt.Sprintf(`
+		INSERT INTO %s.review_replies (app_name, review_id, reply_text, last_edited, sent_at)
+		VALUES (@app_name, @review_id, @reply_text, @last_edited, @sent_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: reply.AppName},
+		{Name: "review_id", Value: reply.ReviewID},
+		{Name: "reply_text", Value: reply.Text},
+		{Name: "last_edited", Value: nullTimestamp(reply.LastEdited)},
+		{Name: "sent_at", Value: reply.SentAt},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save reply: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save reply: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) Replies(ctx context.Context, packageName, reviewID string) ([]Reply, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT reply_text, last_edited, sent_at
+		FROM %s.review_replies
+		WHERE app_name = @app_name AND review_id = @review_id
+		ORDER BY sent_at DESC
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "review_id", Value: reviewID},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var replies []Reply
+	for {
+		var row struct {
+			Text       string                 `bigquery:"reply_text"`
+			LastEdited bigquery.NullTimestamp `bigquery:"last_edited"`
+			SentAt     time.Time              `bigquery:"sent_at"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		replies = append(replies, Reply{
+			AppName:    packageName,
+			ReviewID:   reviewID,
+			Text:       row.Text,
+			LastEdited: row.LastEdited.Timestamp,
+			SentAt:     row.SentAt,
+		})
+	}
+
+	return replies, nil
+}
+
+func (s *bigQueryStore) SaveDraft(ctx context.Context, draft *ReplyDraft) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.reply_drafts AS t
+		USING (SELECT @draft AS d) AS s
+		ON t.draft_id = s.d.draft_id
+		WHEN MATCHED THEN UPDATE SET
+			draft_text = s.d.draft_text,
+			status = s.d.status,
+			updated_at = s.d.updated_at
+		WHEN NOT MATCHED THEN
+			INSERT (draft_id, app_name, review_id, reviewer_language, star_rating, review_text, tags, draft_text, status, created_at, updated_at)
+			VALUES (s.d.draft_id, s.d.app_name, s.d.review_id, s.d.reviewer_language, s.d.star_rating, s.d.review_text, s.d.tags,
+				s.d.draft_text, s.d.status, s.d.created_at, s.d.updated_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "draft", Value: draft},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save reply draft: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save reply draft: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) Draft(ctx context.Context, id string) (*ReplyDraft, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.reply_drafts
+		WHERE draft_id = @draft_id
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "draft_id", Value: id},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var draft ReplyDraft
+	err = it.Next(&draft)
+	if err == iterator.Done {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reply draft: %w", err)
+	}
+	return &draft, nil
+}
+
+func (s *bigQueryStore) Drafts(ctx context.Context, packageName, status string) ([]ReplyDraft, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.reply_drafts
+		WHERE app_name = @app_name AND (@status = '' OR status = @status)
+		ORDER BY created_at DESC
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "status", Value: status},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var drafts []ReplyDraft
+	for {
+		var draft ReplyDraft
+		err = it.Next(&draft)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		drafts = append(drafts, draft)
+	}
+
+	return drafts, nil
+}
+
+func (s *bigQueryStore) ReviewsToDraft(ctx context.Context, packageName string, maxStars int64, limit int) ([]*CommentDetails, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT r.*
+		FROM (
+			SELECT *
+			FROM %[1]s.%[2]s
+			WHERE app_name = @app_name
+			QUALIFY ROW_NUMBER() OVER (PARTITION BY review_id ORDER BY last_modified DESC) = 1
+		) AS r
+		WHERE r.star_rating <= @max_stars AND r.developer_comment IS NULL
+			AND EXISTS (SELECT 1 FROM %[1]s.review_tags AS t WHERE t.app_name = r.app_name AND t.review_id = r.review_id)
+			AND NOT EXISTS (SELECT 1 FROM %[1]s.reply_drafts AS d WHERE d.app_name = r.app_name AND d.review_id = r.review_id)
+		ORDER BY r.last_modified DESC, r.review_id
+		LIMIT @limit
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "max_stars", Value: maxStars},
+		{Name: "limit", Value: limit},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var reviews []*CommentDetails
+	for {
+		var review CommentDetails
+		err = it.Next(&review)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		reviews = append(reviews, &review)
+	}
+	return reviews, nil
+}
+
+func (s *bigQueryStore) SaveApp(ctx context.Context, app *RegisteredApp) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.apps AS t
+		USING (SELECT @app AS a) AS s
+		ON t.app_name = s.a.app_name
+		WHEN MATCHED THEN UPDATE SET
+			display_name = s.a.display_name,
+			team = s.a.team,
+			fetch_count = s.a.fetch_count,
+			analysis_window_days = s.a.analysis_window_days,
+			analysis_max_stars = s.a.analysis_max_stars,
+			updated_at = s.a.updated_at
+		WHEN NOT MATCHED THEN
+			INSERT (app_name, display_name, team, fetch_count, analysis_window_days, analysis_max_stars, created_at, updated_at)
+			VALUES (s.a.app_name, s.a.display_name, s.a.team, s.a.fetch_count, s.a.analysis_window_days, s.a.analysis_max_stars,
+				s.a.created_at, s.a.updated_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app", Value: app},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save app: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save app: %w", err)
+	}
+	return status.Err()
+}
+
+func (s *bigQueryStore) App(ctx context.Context, packageName string) (*RegisteredApp, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.apps
+		WHERE app_name = @app_name
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var app RegisteredApp
+	err = it.Next(&app)
+	if err == iterator.Done {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch app: %w", err)
+	}
+	return &app, nil
+}
+
+func (s *bigQueryStore) Apps(ctx context.Context) ([]RegisteredApp, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.apps
+		ORDER BY app_name
+	`, s.dataset))
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var apps []RegisteredApp
+	for {
+		var app RegisteredApp
+		err = it.Next(&app)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		apps = append(apps, app)
+	}
+
+	return apps, nil
+}
+
+func (s *bigQueryStore) DeleteApp(ctx context.Context, packageName string) error {
+	query := s.client.Query(fmt.Sprintf(`
+		DELETE FROM %s.apps
+		WHERE app_name = @app_name
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete app: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete app: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && stats.DMLStats != nil && stats.DMLStats.DeletedRowCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *bigQueryStore) AppStats(ctx context.Context, packageNames []string, since time.Time) (map[string]*AppStats, error) {
+	stats := map[string]*AppStats{}
+	if len(packageNames) == 0 {
+		return stats, nil
+	}
+
+	query := s.client.Query(fmt.Sprintf(`
+		WITH reviews AS (
+			SELECT
+				app_name,
+				COUNT(*) AS review_count,
+				AVG(star_rating) AS average_rating,
+				COUNTIF(last_modified >= @since) AS recent_review_count,
+				AVG(IF(last_modified >= @since, star_rating, NULL)) AS recent_rating,
+				MAX(last_modified) AS latest_review_at
+			FROM %[1]s.%[2]s
+			WHERE app_name IN UNNEST(@app_names)
+			GROUP BY app_name
+		), analyses AS (
+			SELECT app_name, MAX(analyzed_at) AS last_analysis_at
+			FROM %[1]s.version_summaries
+			WHERE app_name IN UNNEST(@app_names)
+			GROUP BY app_name
+		)
+		SELECT *
+		FROM reviews FULL OUTER JOIN analyses USING (app_name)
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_names", Value: packageNames},
+		{Name: "since", Value: since},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	for {
+		var row struct {
+			AppName           string                 `bigquery:"app_name"`
+			ReviewCount       bigquery.NullInt64     `bigquery:"review_count"`
+			AverageRating     bigquery.NullFloat64   `bigquery:"average_rating"`
+			RecentReviewCount bigquery.NullInt64     `bigquery:"recent_review_count"`
+			RecentRating      bigquery.NullFloat64   `bigquery:"recent_rating"`
+			LatestReviewAt    bigquery.NullTimestamp `bigquery:"latest_review_at"`
+			LastAnalysisAt    bigquery.NullTimestamp `bigquery:"last_analysis_at"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+
+		stat := &AppStats{
+			ReviewCount:       row.ReviewCount.Int64,
+			AverageRating:     row.AverageRating.Float64,
+			RecentReviewCount: row.RecentReviewCount.Int64,
+			RecentRating:      row.RecentRating.Float64,
+		}
+		if row.LatestReviewAt.Valid {
+			stat.LatestReviewAt = &row.LatestReviewAt.Timestamp
+		}
+		if row.LastAnalysisAt.Valid {
+			stat.LastAnalysisAt = &row.LastAnalysisAt.Timestamp
+		}
+		stats[row.AppName] = stat
+	}
+
+	return stats, nil
+}
+
+func (s *bigQueryStore) VersionStats(ctx context.Context, packageName string, versions []string) (map[string]*VersionStats, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT version, star_rating, COUNT(*) AS review_count
+		FROM %s.%s
+		WHERE app_name = @app_name AND version IN UNNEST(@versions) AND star_rating BETWEEN 1 AND 5
+		GROUP BY version, star_rating
+	`, s.dataset, s.table))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+		{Name: "versions", Value: versions},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	counts := map[string][5]int64{}
+	for {
+		var row struct {
+			Version     string `bigquery:"version"`
+			StarRating  int64  `bigquery:"star_rating"`
+			ReviewCount int64  `bigquery:"review_count"`
+		}
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		c := counts[row.Version]
+		c[row.StarRating-1] = row.ReviewCount
+		counts[row.Version] = c
+	}
+
+	stats := map[string]*VersionStats{}
+	for version, c := range counts {
+		stats[version] = newVersionStats(c)
+	}
+	return stats, nil
+}
+
+func (s *bigQueryStore) SaveSchedule(ctx context.Context, sched *Schedule) error {
+	query := s.client.Query(fmt.Sprintf(`
+		MERGE %s.schedules AS t
+		USING (SELECT @app_name AS app_name) AS s
+		ON t.app_name = s.app_name
+		WHEN MATCHED THEN UPDATE SET
+			cron = @cron,
+			incremental = @incremental,
+			enabled = @enabled,
+			last_run_at = @last_run_at,
+			last_status = @last_status,
+			last_error = @last_error,
+			last_job_id = @last_job_id,
+			next_run_at = @next_run_at,
+			updated_at = @updated_at
+		WHEN NOT MATCHED THEN
+			INSERT (app_name, cron, incremental, enabled, last_run_at, last_status, last_error, last_job_id, next_run_at, updated_at)
+			VALUES (@app_name, @cron, @incremental, @enabled, @last_run_at, @last_status, @last_error, @last_job_id, @next_run_at, @updated_at)
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: sched.PackageName},
+		{Name: "cron", Value: sched.Cron},
+		{Name: "incremental", Value: sched.Incremental},
+		{Name: "enabled", Value: sched.Enabled},
+		{Name: "last_run_at", Value: nullTimestamp(sched.LastRunAt)},
+		{Name: "last_status", Value: sched.LastStatus},
+		{Name: "last_error", Value: sched.LastError},
+		{Name: "last_job_id", Value: sched.LastJobID},
+		{Name: "next_run_at", Value: nullTimestamp(sched.NextRunAt)},
+		{Name: "updated_at", Value: sched.UpdatedAt},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return status.Err()
+}
+
+// bigQuerySchedule is a row of the schedules table
+type bigQuerySchedule struct {
+	AppName     string                 `bigquery:"app_name"`
+	Cron        string                 `bigquery:"cron"`
+	Incremental bool                   `bigquery:"incremental"`
+	Enabled     bool                   `bigquery:"enabled"`
+	LastRunAt   bigquery.NullTimestamp `bigquery:"last_run_at"`
+	LastStatus  bigquery.NullString    `bigquery:"last_status"`
+	LastError   bigquery.NullString    `bigquery:"last_error"`
+	LastJobID   bigquery.NullString    `bigquery:"last_job_id"`
+	NextRunAt   bigquery.NullTimestamp `bigquery:"next_run_at"`
+	UpdatedAt   time.Time              `bigquery:"updated_at"`
+}
+
+func (row *bigQuerySchedule) schedule() Schedule {
+	return Schedule{
+		PackageName: row.AppName,
+		Cron:        row.Cron,
+		Incremental: row.Incremental,
+		Enabled:     row.Enabled,
+		LastRunAt:   row.LastRunAt.Timestamp,
+		LastStatus:  row.LastStatus.StringVal,
+		LastError:   row.LastError.StringVal,
+		LastJobID:   row.LastJobID.StringVal,
+		NextRunAt:   row.NextRunAt.Timestamp,
+		UpdatedAt:   row.UpdatedAt,
+	}
+}
+
+func (s *bigQueryStore) Schedule(ctx context.Context, packageName string) (*Schedule, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.schedules
+		WHERE app_name = @app_name
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+	}
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var row bigQuerySchedule
+	err = it.Next(&row)
+	if err == iterator.Done {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch schedule: %w", err)
+	}
+	sched := row.schedule()
+	return &sched, nil
+}
+
+func (s *bigQueryStore) Schedules(ctx context.Context) ([]Schedule, error) {
+	query := s.client.Query(fmt.Sprintf(`
+		SELECT *
+		FROM %s.schedules
+		ORDER BY app_name
+	`, s.dataset))
+
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	var schedules []Schedule
+	for {
+		var row bigQuerySchedule
+		err = it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		schedules = append(schedules, row.schedule())
+	}
+
+	return schedules, nil
+}
+
+func (s *bigQueryStore) DeleteSchedule(ctx context.Context, packageName string) error {
+	query := s.client.Query(fmt.Sprintf(`
+		DELETE FROM %s.schedules
+		WHERE app_name = @app_name
+	`, s.dataset))
+	query.Parameters = []bigquery.QueryParameter{
+		{Name: "app_name", Value: packageName},
+	}
+
+	job, err := query.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	if err := status.Err(); err != nil {
+		return err
+	}
+	if stats, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok && stats.DMLStats != nil && stats.DMLStats.DeletedRowCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *bigQueryStore) Close() error {
+	return nil
+}
+
+// nullTimestamp turns the zero time into a NULL query parameter
+func nullTimestamp(t time.Time) bigquery.NullTimestamp {
+	return bigquery.NullTimestamp{Timestamp: t, Valid: !t.IsZero()}
+}
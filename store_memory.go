@@ -0,0 +1,722 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// analysisRow mirrors a row of the reviews_to_process table
+type analysisRow struct {
+	AppName        string
+	Version        string
+	GeminiResponse string
+	CreatedAt      time.Time
+	ProcessedAt    time.Time
+}
+
+// memoryStore keeps everything in process memory. Data is lost on restart,
+// which is what we want for tests and quick local runs.
+type memoryStore struct {
+	mu          sync.RWMutex
+	reviews     []Review
+	reviewIndex map[string]int // app_name/review_id -> position in reviews
+	analyses    []analysisRow
+	quarantine  []QuarantinedAnalysis
+	summaries   []VersionSummary
+	chunks      []SummaryChunk
+	tags        []ReviewTag
+	taxonomy    map[string]TaxonomyLabel
+	mappings    map[string]TagMapping
+	checkpoints map[string]SyncCheckpoint
+	replies     []Reply
+	drafts      []ReplyDraft
+	apps        map[string]RegisteredApp
+	schedules   map[string]Schedule
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{reviewIndex: map[string]int{}, taxonomy: map[string]TaxonomyLabel{}, mappings: map[string]TagMapping{}, checkpoints: map[string]SyncCheckpoint{}, apps: map[string]RegisteredApp{}, schedules: map[string]Schedule{}}
+}
+
+func (s *memoryStore) InsertReviews(ctx context.Context, reviews []*Review) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range reviews {
+		key := r.AppName + "/" + r.ReviewID
+		i, ok := s.reviewIndex[key]
+		if !ok {
+			s.reviewIndex[key] = len(s.reviews)
+			s.reviews = append(s.reviews, *r)
+			continue
+		}
+		// Same layout on both sides, so newer edits compare greater
+		if r.LastModified > s.reviews[i].LastModified {
+			s.reviews[i] = *r
+		}
+	}
+	return nil
+}
+
+// DedupReviews has nothing to do, InsertReviews never stores duplicates
+func (s *memoryStore) DedupReviews(ctx context.Context) (int64, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) Versions(ctx context.Context, packageName string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var versions []string
+	for _, summary := range s.summaries {
+		if summary.AppName == packageName {
+			versions = append(versions, summary.Version)
+		}
+	}
+	return versions, nil
+}
+
+func (s *memoryStore) Comment(ctx context.Context, packageName, reviewID string) (*CommentDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, r := range s.reviews {
+		if r.AppName != packageName || r.ReviewID != reviewID {
+			continue
+		}
+		return reviewToCommentDetails(&r)
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) VersionsToAnalyze(ctx context.Context, packageName string, since time.Time, maxStars int64) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[string]bool{}
+	var versions []string
+	for _, r := range s.reviews {
+		if r.AppName != packageName || r.Version == "" || r.StarRating > maxStars || seen[r.Version] {
+			continue
+		}
+		if !modifiedSince(&r, since) {
+			continue
+		}
+		seen[r.Version] = true
+		versions = append(versions, r.Version)
+	}
+	return versions, nil
+}
+
+func (s *memoryStore) ReviewsForVersion(ctx context.Context, packageName, version string, since time.Time, limit, offset int) ([]*Review, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matching []*Review
+	for _, r := range s.reviews {
+		if r.AppName != packageName || r.Version != version || !modifiedSince(&r, since) {
+			continue
+		}
+		r := r
+		matching = append(matching, &r)
+	}
+	sort.Slice(matching, func(i, j int) bool { return matching[i].ReviewID < matching[j].ReviewID })
+
+	if offset >= len(matching) {
+		return nil, nil
+	}
+	matching = matching[offset:]
+	if len(matching) > limit {
+		matching = matching[:limit]
+	}
+	return matching, nil
+}
+
+func (s *memoryStore) SaveAnalysis(ctx context.Context, packageName, version, geminiResponse string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.analyses = append(s.analyses, analysisRow{
+		AppName:        packageName,
+		Version:        version,
+		GeminiResponse: geminiResponse,
+		CreatedAt:      time.Now(),
+	})
+	return nil
+}
+
+func (s *memoryStore) UncheckedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var unchecked []*StoredAnalysis
+	for _, a := range s.analyses {
+		var versioned struct {
+			SchemaVersion *int `json:"schema_version"`
+		}
+		if a.AppName != packageName {
+			continue
+		}
+		if err := json.Unmarshal([]byte(a.GeminiResponse), &versioned); err == nil && versioned.SchemaVersion != nil {
+			continue
+		}
+		unchecked = append(unchecked, &StoredAnalysis{AppName: a.AppName, Version: a.Version, Response: a.GeminiResponse, CreatedAt: a.CreatedAt})
+	}
+	return unchecked, nil
+}
+
+func (s *memoryStore) ReplaceAnalysis(ctx context.Context, analysis *StoredAnalysis, response string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, a := range s.analyses {
+		if a.AppName != analysis.AppName || a.Version != analysis.Version || !a.CreatedAt.Equal(analysis.CreatedAt) || a.GeminiResponse != analysis.Response {
+			continue
+		}
+		if response == "" {
+			s.analyses = append(s.analyses[:i], s.analyses[i+1:]...)
+		} else {
+			s.analyses[i].GeminiResponse = response
+		}
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (s *memoryStore) QuarantineAnalysis(ctx context.Context, q *QuarantinedAnalysis) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.quarantine = append(s.quarantine, *q)
+	return nil
+}
+
+func (s *memoryStore) QuarantinedAnalyses(ctx context.Context, packageName string) ([]*QuarantinedAnalysis, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var quarantined []*QuarantinedAnalysis
+	for _, q := range s.quarantine {
+		if q.AppName == packageName {
+			q := q
+			quarantined = append(quarantined, &q)
+		}
+	}
+	sort.Slice(quarantined, func(i, j int) bool { return quarantined[i].CreatedAt.After(quarantined[j].CreatedAt) })
+	return quarantined, nil
+}
+
+func (s *memoryStore) UnprocessedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var unprocessed []*StoredAnalysis
+	for _, a := range s.analyses {
+		var versioned struct {
+			SchemaVersion *int `json:"schema_version"`
+		}
+		if a.AppName != packageName || !a.ProcessedAt.IsZero() {
+			continue
+		}
+		if err := json.Unmarshal([]byte(a.GeminiResponse), &versioned); err != nil || versioned.SchemaVersion == nil {
+			continue
+		}
+		unprocessed = append(unprocessed, &StoredAnalysis{AppName: a.AppName, Version: a.Version, Response: a.GeminiResponse, CreatedAt: a.CreatedAt})
+	}
+	sort.SliceStable(unprocessed, func(i, j int) bool { return unprocessed[i].CreatedAt.Before(unprocessed[j].CreatedAt) })
+	return unprocessed, nil
+}
+
+func (s *memoryStore) SupersedeAnalyses(ctx context.Context, packageName, version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for i := range s.analyses {
+		a := &s.analyses[i]
+		if a.AppName == packageName && a.Version == version && a.ProcessedAt.IsZero() {
+			a.ProcessedAt = now
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SaveProcessedVersion(ctx context.Context, analyses []*StoredAnalysis, summary *VersionSummary, chunks []SummaryChunk, tags []ReviewTag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, analysis := range analyses {
+		for i, a := range s.analyses {
+			if a.AppName == analysis.AppName && a.Version == analysis.Version && a.CreatedAt.Equal(analysis.CreatedAt) && a.GeminiResponse == analysis.Response {
+				s.analyses[i].ProcessedAt = summary.ProcessedAt
+			}
+		}
+	}
+
+	replaced := false
+	for i, existing := range s.summaries {
+		if existing.AppName == summary.AppName && existing.Version == summary.Version {
+			s.summaries[i] = *summary
+			replaced = true
+		}
+	}
+	if !replaced {
+		s.summaries = append(s.summaries, *summary)
+	}
+
+	keptChunks := s.chunks[:0]
+	for _, chunk := range s.chunks {
+		if chunk.AppName != summary.AppName || chunk.Version != summary.Version {
+			keptChunks = append(keptChunks, chunk)
+		}
+	}
+	s.chunks = append(keptChunks, chunks...)
+
+	tagged := map[string]bool{}
+	for _, tag := range tags {
+		tagged[tag.ReviewID] = true
+	}
+	kept := s.tags[:0]
+	for _, tag := range s.tags {
+		if tag.AppName != summary.AppName || (tag.Version != summary.Version && !tagged[tag.ReviewID]) {
+			kept = append(kept, tag)
+		}
+	}
+	s.tags = append(kept, tags...)
+	return nil
+}
+
+func (s *memoryStore) VersionSummary(ctx context.Context, packageName, version string) (*VersionSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, summary := range s.summaries {
+		if summary.AppName == packageName && summary.Version == version {
+			return &summary, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) SummaryChunks(ctx context.Context, packageName, version string) ([]SummaryChunk, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var chunks []SummaryChunk
+	for _, chunk := range s.chunks {
+		if chunk.AppName == packageName && chunk.Version == version {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Chunk < chunks[j].Chunk })
+	return chunks, nil
+}
+
+func (s *memoryStore) ReviewTags(ctx context.Context, packageName, version string) ([]ReviewTag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tags []ReviewTag
+	for _, tag := range s.tags {
+		if tag.AppName == packageName && (version == "" || tag.Version == version) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].ReviewID != tags[j].ReviewID {
+			return tags[i].ReviewID < tags[j].ReviewID
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
+
+func (s *memoryStore) SaveTaxonomyLabel(ctx context.Context, label *TaxonomyLabel) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := *label
+	l.Synonyms = append([]string(nil), label.Synonyms...)
+	s.taxonomy[l.ID] = l
+	return nil
+}
+
+func (s *memoryStore) TaxonomyLabels(ctx context.Context) ([]TaxonomyLabel, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var labels []TaxonomyLabel
+	for _, l := range s.taxonomy {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].ID < labels[j].ID })
+	return labels, nil
+}
+
+func (s *memoryStore) DeleteTaxonomyLabel(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.taxonomy[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.taxonomy, id)
+	return nil
+}
+
+func (s *memoryStore) SaveTagMappings(ctx context.Context, mappings []TagMapping) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range mappings {
+		s.mappings[m.Tag] = m
+	}
+	return nil
+}
+
+func (s *memoryStore) TagMappings(ctx context.Context) ([]TagMapping, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var mappings []TagMapping
+	for _, m := range s.mappings {
+		mappings = append(mappings, m)
+	}
+	sort.Slice(mappings, func(i, j int) bool { return mappings[i].Tag < mappings[j].Tag })
+	return mappings, nil
+}
+
+func (s *memoryStore) ClearTagMappings(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tag, m := range s.mappings {
+		if m.Method != MappingManual {
+			delete(s.mappings, tag)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) SyncCheckpoint(ctx context.Context, packageName string) (*SyncCheckpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cp, ok := s.checkpoints[packageName]
+	if !ok {
+		return nil, nil
+	}
+	return &cp, nil
+}
+
+func (s *memoryStore) SaveSyncCheckpoint(ctx context.Context, cp *SyncCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.checkpoints[cp.PackageName] = *cp
+	return nil
+}
+
+func (s *memoryStore) SaveReply(ctx context.Context, reply *Reply) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replies = append(s.replies, *reply)
+	return nil
+}
+
+func (s *memoryStore) Replies(ctx context.Context, packageName, reviewID string) ([]Reply, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var replies []Reply
+	for i := len(s.replies) - 1; i >= 0; i-- {
+		if s.replies[i].AppName == packageName && s.replies[i].ReviewID == reviewID {
+			replies = append(replies, s.replies[i])
+		}
+	}
+	return replies, nil
+}
+
+func (s *memoryStore) SaveDraft(ctx context.Context, draft *ReplyDraft) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.drafts {
+		if s.drafts[i].ID == draft.ID {
+			s.drafts[i] = *draft
+			return nil
+		}
+	}
+	s.drafts = append(s.drafts, *draft)
+	return nil
+}
+
+func (s *memoryStore) Draft(ctx context.Context, id string) (*ReplyDraft, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, d := range s.drafts {
+		if d.ID == id {
+			return &d, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *memoryStore) Drafts(ctx context.Context, packageName, status string) ([]ReplyDraft, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var drafts []ReplyDraft
+	for i := len(s.drafts) - 1; i >= 0; i-- {
+		d := s.drafts[i]
+		if d.AppName == packageName && (status == "" || d.Status == status) {
+			drafts = append(drafts, d)
+		}
+	}
+	return drafts, nil
+}
+
+func (s *memoryStore) ReviewsToDraft(ctx context.Context, packageName string, maxStars int64, limit int) ([]*CommentDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tagged := map[string]bool{}
+	for _, tag := range s.tags {
+		if tag.AppName == packageName {
+			tagged[tag.ReviewID] = true
+		}
+	}
+	drafted := map[string]bool{}
+	for _, d := range s.drafts {
+		if d.AppName == packageName {
+			drafted[d.ReviewID] = true
+		}
+	}
+
+	var reviews []*CommentDetails
+	for _, r := range s.reviews {
+		if r.AppName != packageName || r.StarRating > maxStars || r.DeveloperComment != nil || !tagged[r.ReviewID] || drafted[r.ReviewID] {
+			continue
+		}
+		review, err := reviewToCommentDetails(&r)
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, review)
+	}
+	sort.Slice(reviews, func(i, j int) bool {
+		if !reviews[i].LastModified.Equal(reviews[j].LastModified) {
+			return reviews[i].LastModified.After(reviews[j].LastModified)
+		}
+		return reviews[i].ReviewID < reviews[j].ReviewID
+	})
+	if len(reviews) > limit {
+		reviews = reviews[:limit]
+	}
+	return reviews, nil
+}
+
+func (s *memoryStore) SaveApp(ctx context.Context, app *RegisteredApp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apps[app.PackageName] = *app
+	return nil
+}
+
+func (s *memoryStore) App(ctx context.Context, packageName string) (*RegisteredApp, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	app, ok := s.apps[packageName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &app, nil
+}
+
+func (s *memoryStore) Apps(ctx context.Context) ([]RegisteredApp, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	apps := make([]RegisteredApp, 0, len(s.apps))
+	for _, app := range s.apps {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].PackageName < apps[j].PackageName })
+	return apps, nil
+}
+
+func (s *memoryStore) DeleteApp(ctx context.Context, packageName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.apps[packageName]; !ok {
+		return ErrNotFound
+	}
+	delete(s.apps, packageName)
+	return nil
+}
+
+func (s *memoryStore) AppStats(ctx context.Context, packageNames []string, since time.Time) (map[string]*AppStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := map[string]*AppStats{}
+	for _, packageName := range packageNames {
+		st := &AppStats{}
+		var stars, recentStars int64
+		for i := range s.reviews {
+			r := &s.reviews[i]
+			if r.AppName != packageName {
+				continue
+			}
+			st.ReviewCount++
+			stars += r.StarRating
+			if modifiedSince(r, since) {
+				st.RecentReviewCount++
+				recentStars += r.StarRating
+			}
+			if lastModified, err := time.Parse(lastModifiedLayout, r.LastModified); err == nil && (st.LatestReviewAt == nil || lastModified.After(*st.LatestReviewAt)) {
+				st.LatestReviewAt = &lastModified
+			}
+		}
+		if st.ReviewCount > 0 {
+			st.AverageRating = float64(stars) / float64(st.ReviewCount)
+		}
+		if st.RecentReviewCount > 0 {
+			st.RecentRating = float64(recentStars) / float64(st.RecentReviewCount)
+		}
+
+		for _, summary := range s.summaries {
+			if summary.AppName == packageName && (st.LastAnalysisAt == nil || summary.AnalyzedAt.After(*st.LastAnalysisAt)) {
+				analyzedAt := summary.AnalyzedAt
+				st.LastAnalysisAt = &analyzedAt
+			}
+		}
+
+		if st.ReviewCount > 0 || st.LastAnalysisAt != nil {
+			stats[packageName] = st
+		}
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) VersionStats(ctx context.Context, packageName string, versions []string) (map[string]*VersionStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := map[string][5]int64{}
+	for _, r := range s.reviews {
+		if r.AppName == packageName && slices.Contains(versions, r.Version) && r.StarRating >= 1 && r.StarRating <= 5 {
+			c := counts[r.Version]
+			c[r.StarRating-1]++
+			counts[r.Version] = c
+		}
+	}
+	stats := map[string]*VersionStats{}
+	for version, c := range counts {
+		stats[version] = newVersionStats(c)
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) SaveSchedule(ctx context.Context, sched *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules[sched.PackageName] = *sched
+	return nil
+}
+
+func (s *memoryStore) Schedule(ctx context.Context, packageName string) (*Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sched, ok := s.schedules[packageName]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &sched, nil
+}
+
+func (s *memoryStore) Schedules(ctx context.Context) ([]Schedule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	schedules := make([]Schedule, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		schedules = append(schedules, sched)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].PackageName < schedules[j].PackageName })
+	return schedules, nil
+}
+
+func (s *memoryStore) DeleteSchedule(ctx context.Context, packageName string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[packageName]; !ok {
+		return ErrNotFound
+	}
+	delete(s.schedules, packageName)
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// modifiedSince reports whether a review was last modified at or after since
+func modifiedSince(r *Review, since time.Time) bool {
+	lastModified, err := time.Parse(lastModifiedLayout, r.LastModified)
+	return err == nil && !lastModified.Before(since)
+}
+
+// reviewToCommentDetails converts a stored Review into the shape returned by /comment
+func reviewToCommentDetails(r *Review) (*CommentDetails, error) {
+	lastModified, err := time.Parse(lastModifiedLayout, r.LastModified)
+	if err != nil {
+		return nil, fmt.Errorf("invalid last_modified %q: %w", r.LastModified, err)
+	}
+
+	return &CommentDetails{
+		ReviewID:         r.ReviewID,
+		AuthorName:       r.AuthorName,
+		AppName:          r.AppName,
+		Comments:         r.Comments,
+		StarRating:       r.StarRating,
+		LastModified:     lastModified,
+		ReviewerLanguage: r.ReviewerLanguage,
+		Version:          r.Version,
+		Device:           r.Device,
+		AndroidOSVersion: r.AndroidOSVersion,
+		AppVersionCode:   r.AppVersionCode,
+		ThumbsUpCount:    r.ThumbsUpCount,
+		ThumbsDownCount:  r.ThumbsDownCount,
+		DeviceMetadata:   r.DeviceMetadata,
+		OriginalText:     r.OriginalText,
+		DeveloperComment: r.DeveloperComment,
+	}, nil
+}
@@ -0,0 +1,1390 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	_ "modernc.org/sqlite" // pure Go driver, no cgo required
+)
+
+// Same tables as the BigQuery dataset (see bq-schema), adapted to SQLite types
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS raw_reviews (
+	app_name          TEXT NOT NULL,
+	review_id         TEXT NOT NULL,
+	author_name       TEXT,
+	version           TEXT,
+	comments          TEXT,
+	star_rating       INTEGER,
+	last_modified     TEXT NOT NULL,
+	reviewer_language TEXT
+);
+
+CREATE TABLE IF NOT EXISTS reviews_to_process (
+	app_name        TEXT NOT NULL,
+	gemini_response TEXT,
+	created_at      TEXT NOT NULL,
+	processed_at    TEXT,
+	version         TEXT
+);
+CREATE INDEX IF NOT EXISTS reviews_to_process_app_version ON reviews_to_process (app_name, version);
+
+CREATE TABLE IF NOT EXISTS version_summaries (
+	app_name       TEXT NOT NULL,
+	version        TEXT NOT NULL,
+	summary        TEXT,
+	schema_version INTEGER NOT NULL,
+	analyzed_at    TEXT NOT NULL,
+	processed_at   TEXT NOT NULL,
+	PRIMARY KEY (app_name, version)
+);
+
+CREATE TABLE IF NOT EXISTS summary_chunks (
+	app_name     TEXT NOT NULL,
+	version      TEXT NOT NULL,
+	chunk        INTEGER NOT NULL,
+	analyzed_at  TEXT NOT NULL,
+	summary      TEXT,
+	review_ids   TEXT NOT NULL, -- JSON array
+	processed_at TEXT NOT NULL,
+	PRIMARY KEY (app_name, version, chunk)
+);
+
+CREATE TABLE IF NOT EXISTS review_tags (
+	review_id    TEXT NOT NULL,
+	app_name     TEXT NOT NULL,
+	version      TEXT,
+	tag          TEXT NOT NULL,
+	severity     TEXT,
+	category     TEXT,
+	processed_at TEXT NOT NULL,
+	PRIMARY KEY (app_name, review_id, tag)
+);
+CREATE INDEX IF NOT EXISTS review_tags_app_version ON review_tags (app_name, version);
+
+CREATE TABLE IF NOT EXISTS taxonomy (
+	label_id    TEXT PRIMARY KEY,
+	category    TEXT NOT NULL,
+	issue       TEXT NOT NULL,
+	description TEXT,
+	synonyms    TEXT NOT NULL, -- JSON array
+	updated_at  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS tag_mappings (
+	tag        TEXT PRIMARY KEY,
+	label      TEXT,
+	suggestion TEXT,
+	confidence REAL NOT NULL,
+	method     TEXT NOT NULL,
+	mapped_at  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS analysis_quarantine (
+	id           TEXT PRIMARY KEY,
+	app_name     TEXT NOT NULL,
+	version      TEXT,
+	raw_response TEXT,
+	reason       TEXT NOT NULL,
+	attempts     INTEGER NOT NULL,
+	source       TEXT NOT NULL,
+	created_at   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS analysis_quarantine_app ON analysis_quarantine (app_name, created_at);
+
+CREATE TABLE IF NOT EXISTS sync_checkpoints (
+	app_name              TEXT PRIMARY KEY,
+	last_modified         TEXT,
+	page_token            TEXT,
+	pending_last_modified TEXT,
+	updated_at            TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS review_replies (
+	app_name    TEXT NOT NULL,
+	review_id   TEXT NOT NULL,
+	reply_text  TEXT NOT NULL,
+	last_edited TEXT,
+	sent_at     TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS review_replies_app_review ON review_replies (app_name, review_id);
+
+CREATE TABLE IF NOT EXISTS reply_drafts (
+	draft_id          TEXT PRIMARY KEY,
+	app_name          TEXT NOT NULL,
+	review_id         TEXT NOT NULL,
+	reviewer_language TEXT,
+	star_rating       INTEGER,
+	review_text       TEXT,
+	tags              TEXT,
+	draft_text        TEXT,
+	status            TEXT NOT NULL,
+	created_at        TEXT NOT NULL,
+	updated_at        TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS reply_drafts_app_status ON reply_drafts (app_name, status);
+
+CREATE TABLE IF NOT EXISTS schedules (
+	app_name    TEXT PRIMARY KEY,
+	cron        TEXT NOT NULL,
+	incremental INTEGER NOT NULL,
+	enabled     INTEGER NOT NULL,
+	last_run_at TEXT,
+	last_status TEXT,
+	last_error  TEXT,
+	last_job_id TEXT,
+	next_run_at TEXT,
+	updated_at  TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS apps (
+	app_name             TEXT PRIMARY KEY,
+	display_name         TEXT,
+	team                 TEXT,
+	fetch_count          INTEGER,
+	analysis_window_days INTEGER,
+	analysis_max_stars   INTEGER,
+	created_at           TEXT NOT NULL,
+	updated_at           TEXT NOT NULL
+);
+`
+
+// Columns added to raw_reviews after the first release, created on open when missing.
+// Nested BigQuery records are flattened, device_metadata is stored as JSON.
+var sqliteReviewColumns = []struct{ name, typ string }{
+	{"device", "TEXT"},
+	{"android_os_version", "INTEGER"},
+	{"app_version_code", "INTEGER"},
+	{"thumbs_up_count", "INTEGER"},
+	{"thumbs_down_count", "INTEGER"},
+	{"device_metadata", "TEXT"},
+	{"original_text", "TEXT"},
+	{"developer_comment", "TEXT"},
+	{"developer_comment_last_modified", "TEXT"},
+}
+
+// sqliteStore keeps reviews in an embedded SQLite database file
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database %s: %w", path, err)
+	}
+	// SQLite does not like concurrent writers
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQLite schema: %w", err)
+	}
+	if err := addMissingReviewColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Databases created before reviews were upserted can hold duplicates,
+	// which must go before the unique index can be built
+	s := &sqliteStore{db: db}
+	if removed, err := s.DedupReviews(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	} else if removed > 0 {
+		log.Printf("Removed %d duplicate reviews from %s", removed, path)
+	}
+	if _, err := db.Exec(`
+		DROP INDEX IF EXISTS raw_reviews_app_review;
+		CREATE UNIQUE INDEX IF NOT EXISTS raw_reviews_app_review_id ON raw_reviews (app_name, review_id);
+	`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create SQLite unique index: %w", err)
+	}
+
+	return s, nil
+}
+
+func (s *sqliteStore) InsertReviews(ctx context.Context, reviews []*Review) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO raw_reviews (app_name, review_id, author_name, version, comments, star_rating, last_modified, reviewer_language,
+			device, android_os_version, app_version_code, thumbs_up_count, thumbs_down_count, device_metadata, original_text,
+			developer_comment, developer_comment_last_modified)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (app_name, review_id) DO UPDATE SET
+			author_name = excluded.author_name,
+			version = excluded.version,
+			comments = excluded.comments,
+			star_rating = excluded.star_rating,
+			last_modified = excluded.last_modified,
+			reviewer_language = excluded.reviewer_language,
+			device = excluded.device,
+			android_os_version = excluded.android_os_version,
+			app_version_code = excluded.app_version_code,
+			thumbs_up_count = excluded.thumbs_up_count,
+			thumbs_down_count = excluded.thumbs_down_count,
+			device_metadata = excluded.device_metadata,
+			original_text = excluded.original_text,
+			developer_comment = excluded.developer_comment,
+			developer_comment_last_modified = excluded.developer_comment_last_modified
+		WHERE excluded.last_modified > raw_reviews.last_modified
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, r := range reviews {
+		var deviceMetadata, developerComment, developerCommentLastModified sql.NullString
+		if r.DeviceMetadata != nil {
+			b, err := json.Marshal(r.DeviceMetadata)
+			if err != nil {
+				return fmt.Errorf("failed to encode device metadata of review %s: %w", r.ReviewID, err)
+			}
+			deviceMetadata = sql.NullString{String: string(b), Valid: true}
+		}
+		if r.DeveloperComment != nil {
+			developerComment = sql.NullString{String: r.DeveloperComment.Text, Valid: true}
+			developerCommentLastModified = sqliteTime(r.DeveloperComment.LastModified)
+		}
+
+		_, err := stmt.ExecContext(ctx, r.AppName, r.ReviewID, r.AuthorName, r.Version, r.Comments, r.StarRating, r.LastModified, r.ReviewerLanguage,
+			r.Device, r.AndroidOSVersion, r.AppVersionCode, r.ThumbsUpCount, r.ThumbsDownCount, deviceMetadata, r.OriginalText,
+			developerComment, developerCommentLastModified)
+		if err != nil {
+			return fmt.Errorf("failed to insert review %s: %w", r.ReviewID, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DedupReviews(ctx context.Context) (int64, error) {
+	// Keeps the latest edit, and of identical rows the first one inserted
+	res, err := s.db.ExecContext(ctx, `
+		DELETE FROM raw_reviews
+		WHERE rowid NOT IN (
+			SELECT rowid FROM (
+				SELECT rowid, ROW_NUMBER() OVER (PARTITION BY app_name, review_id ORDER BY last_modified DESC, rowid) AS n
+				FROM raw_reviews
+			)
+			WHERE n = 1
+		)
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to deduplicate reviews: %w", err)
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqliteStore) Versions(ctx context.Context, packageName string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT version
+		FROM version_summaries
+		WHERE app_name = ?
+	`, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+// Columns of raw_reviews in the order scanned by scanComment
+const sqliteCommentColumns = `app_name, review_id, author_name, version, comments, star_rating, last_modified, reviewer_language,
+	device, android_os_version, app_version_code, thumbs_up_count, thumbs_down_count, device_metadata, original_text,
+	developer_comment, developer_comment_last_modified`
+
+func scanComment(scan func(dest ...any) error) (*CommentDetails, error) {
+	var r Review
+	var authorName, version, comments, language, device, deviceMetadata, originalText sql.NullString
+	var developerComment, developerCommentLastModified sql.NullString
+	var starRating, androidOSVersion, appVersionCode, thumbsUp, thumbsDown sql.NullInt64
+	err := scan(&r.AppName, &r.ReviewID, &authorName, &version, &comments, &starRating, &r.LastModified, &language,
+		&device, &androidOSVersion, &appVersionCode, &thumbsUp, &thumbsDown, &deviceMetadata, &originalText,
+		&developerComment, &developerCommentLastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	r.AuthorName = authorName.String
+	r.Version = version.String
+	r.Comments = comments.String
+	r.StarRating = starRating.Int64
+	r.ReviewerLanguage = language.String
+	r.Device = device.String
+	r.AndroidOSVersion = androidOSVersion.Int64
+	r.AppVersionCode = appVersionCode.Int64
+	r.ThumbsUpCount = thumbsUp.Int64
+	r.ThumbsDownCount = thumbsDown.Int64
+	r.OriginalText = originalText.String
+	if deviceMetadata.Valid {
+		r.DeviceMetadata = &DeviceMetadata{}
+		if err := json.Unmarshal([]byte(deviceMetadata.String), r.DeviceMetadata); err != nil {
+			return nil, fmt.Errorf("invalid device metadata of review %s: %w", r.ReviewID, err)
+		}
+	}
+	if developerComment.Valid {
+		r.DeveloperComment = &DeveloperComment{Text: developerComment.String}
+		if r.DeveloperComment.LastModified, err = parseSQLiteTime(developerCommentLastModified); err != nil {
+			return nil, err
+		}
+	}
+
+	return reviewToCommentDetails(&r)
+}
+
+func (s *sqliteStore) Comment(ctx context.Context, packageName, reviewID string) (*CommentDetails, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT `+sqliteCommentColumns+`
+		FROM raw_reviews
+		WHERE app_name = ? AND review_id = ?
+		LIMIT 1
+	`, packageName, reviewID)
+	review, err := scanComment(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch comment: %w", err)
+	}
+	return review, nil
+}
+
+func (s *sqliteStore) VersionsToAnalyze(ctx context.Context, packageName string, since time.Time, maxStars int64) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT DISTINCT version
+		FROM raw_reviews
+		WHERE last_modified >= ?
+			AND star_rating <= ? AND version != '' AND app_name = ?
+	`, since.UTC().Format(lastModifiedLayout), maxStars, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var versions []string
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+func (s *sqliteStore) ReviewsForVersion(ctx context.Context, packageName, version string, since time.Time, limit, offset int) ([]*Review, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT review_id, star_rating, comments
+		FROM raw_reviews
+		WHERE version = ?
+			AND last_modified >= ?
+			AND app_name = ?
+		ORDER BY review_id
+		LIMIT ? OFFSET ?
+	`, version, since.UTC().Format(lastModifiedLayout), packageName, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var reviews []*Review
+	for rows.Next() {
+		r := Review{AppName: packageName, Version: version}
+		var starRating sql.NullInt64
+		var comments sql.NullString
+		if err := rows.Scan(&r.ReviewID, &starRating, &comments); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		r.StarRating = starRating.Int64
+		r.Comments = comments.String
+		reviews = append(reviews, &r)
+	}
+
+	return reviews, rows.Err()
+}
+
+func (s *sqliteStore) SaveAnalysis(ctx context.Context, packageName, version, geminiResponse string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO reviews_to_process (app_name, gemini_response, created_at, processed_at, version)
+		VALUES (?, ?, ?, NULL, ?)
+	`, packageName, geminiResponse, time.Now().UTC().Format(lastModifiedLayout), version)
+	if err != nil {
+		return fmt.Errorf("failed to insert analysis: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) UncheckedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error) {
+	// json_extract fails on invalid JSON, the CASE keeps it away from it
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT COALESCE(version, ''), COALESCE(gemini_response, ''), created_at
+		FROM reviews_to_process
+		WHERE app_name = ?
+			AND CASE WHEN json_valid(gemini_response) THEN json_extract(gemini_response, '$.schema_version') END IS NULL
+	`, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var unchecked []*StoredAnalysis
+	for rows.Next() {
+		a := &StoredAnalysis{AppName: packageName}
+		var createdAt string
+		if err := rows.Scan(&a.Version, &a.Response, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if a.CreatedAt, err = parseSQLiteTime(sql.NullString{String: createdAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		unchecked = append(unchecked, a)
+	}
+	return unchecked, rows.Err()
+}
+
+func (s *sqliteStore) ReplaceAnalysis(ctx context.Context, analysis *StoredAnalysis, response string) error {
+	where := `WHERE app_name = ? AND COALESCE(version, '') = ? AND created_at = ? AND COALESCE(gemini_response, '') = ?`
+	args := []any{analysis.AppName, analysis.Version, sqliteTime(analysis.CreatedAt), analysis.Response}
+
+	var res sql.Result
+	var err error
+	if response == "" {
+		res, err = s.db.ExecContext(ctx, `DELETE FROM reviews_to_process `+where, args...)
+	} else {
+		res, err = s.db.ExecContext(ctx, `UPDATE reviews_to_process SET gemini_response = ? `+where, append([]any{response}, args...)...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replace analysis: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) QuarantineAnalysis(ctx context.Context, q *QuarantinedAnalysis) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO analysis_quarantine (id, app_name, version, raw_response, reason, attempts, source, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, q.ID, q.AppName, q.Version, q.Response, q.Reason, q.Attempts, q.Source, sqliteTime(q.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to quarantine analysis: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) QuarantinedAnalyses(ctx context.Context, packageName string) ([]*QuarantinedAnalysis, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, app_name, COALESCE(version, ''), COALESCE(raw_response, ''), reason, attempts, source, created_at
+		FROM analysis_quarantine
+		WHERE app_name = ?
+		ORDER BY created_at DESC
+	`, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var quarantined []*QuarantinedAnalysis
+	for rows.Next() {
+		var q QuarantinedAnalysis
+		var createdAt string
+		if err := rows.Scan(&q.ID, &q.AppName, &q.Version, &q.Response, &q.Reason, &q.Attempts, &q.Source, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if q.CreatedAt, err = parseSQLiteTime(sql.NullString{String: createdAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		quarantined = append(quarantined, &q)
+	}
+	return quarantined, rows.Err()
+}
+
+func (s *sqliteStore) UnprocessedAnalyses(ctx context.Context, packageName string) ([]*StoredAnalysis, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT COALESCE(version, ''), gemini_response, created_at
+		FROM reviews_to_process
+		WHERE app_name = ? AND processed_at IS NULL
+			AND CASE WHEN json_valid(gemini_response) THEN json_extract(gemini_response, '$.schema_version') END IS NOT NULL
+		ORDER BY created_at
+	`, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var unprocessed []*StoredAnalysis
+	for rows.Next() {
+		a := &StoredAnalysis{AppName: packageName}
+		var createdAt string
+		if err := rows.Scan(&a.Version, &a.Response, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if a.CreatedAt, err = parseSQLiteTime(sql.NullString{String: createdAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		unprocessed = append(unprocessed, a)
+	}
+	return unprocessed, rows.Err()
+}
+
+func (s *sqliteStore) SupersedeAnalyses(ctx context.Context, packageName, version string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE reviews_to_process SET processed_at = ?
+		WHERE app_name = ? AND COALESCE(version, '') = ? AND processed_at IS NULL
+	`, time.Now().UTC().Format(lastModifiedLayout), packageName, version)
+	if err != nil {
+		return fmt.Errorf("failed to supersede analyses: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) SaveProcessedVersion(ctx context.Context, analyses []*StoredAnalysis, summary *VersionSummary, chunks []SummaryChunk, tags []ReviewTag) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, analysis := range analyses {
+		_, err := tx.ExecContext(ctx, `
+			UPDATE reviews_to_process SET processed_at = ?
+			WHERE app_name = ? AND COALESCE(version, '') = ? AND created_at = ? AND gemini_response = ?
+		`, sqliteTime(summary.ProcessedAt), analysis.AppName, analysis.Version, sqliteTime(analysis.CreatedAt), analysis.Response)
+		if err != nil {
+			return fmt.Errorf("failed to mark analysis as processed: %w", err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO version_summaries (app_name, version, summary, schema_version, analyzed_at, processed_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (app_name, version) DO UPDATE SET
+			summary = excluded.summary,
+			schema_version = excluded.schema_version,
+			analyzed_at = excluded.analyzed_at,
+			processed_at = excluded.processed_at
+	`, summary.AppName, summary.Version, summary.Summary, summary.SchemaVersion, sqliteTime(summary.AnalyzedAt), sqliteTime(summary.ProcessedAt))
+	if err != nil {
+		return fmt.Errorf("failed to save version summary: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM summary_chunks WHERE app_name = ? AND version = ?`, summary.AppName, summary.Version); err != nil {
+		return fmt.Errorf("failed to delete summary chunks: %w", err)
+	}
+	for _, chunk := range chunks {
+		reviewIDs, err := json.Marshal(chunk.ReviewIDs)
+		if err != nil {
+			return fmt.Errorf("failed to encode review IDs: %w", err)
+		}
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO summary_chunks (app_name, version, chunk, analyzed_at, summary, review_ids, processed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, chunk.AppName, chunk.Version, chunk.Chunk, sqliteTime(chunk.AnalyzedAt), chunk.Summary, string(reviewIDs), sqliteTime(chunk.ProcessedAt))
+		if err != nil {
+			return fmt.Errorf("failed to save summary chunk: %w", err)
+		}
+	}
+
+	// The tags of the version are replaced, along with those of its reviews under another version
+	if _, err := tx.ExecContext(ctx, `DELETE FROM review_tags WHERE app_name = ? AND version = ?`, summary.AppName, summary.Version); err != nil {
+		return fmt.Errorf("failed to delete review tags: %w", err)
+	}
+	deleted := map[string]bool{}
+	for _, tag := range tags {
+		if deleted[tag.ReviewID] {
+			continue
+		}
+		deleted[tag.ReviewID] = true
+		if _, err := tx.ExecContext(ctx, `DELETE FROM review_tags WHERE app_name = ? AND review_id = ?`, tag.AppName, tag.ReviewID); err != nil {
+			return fmt.Errorf("failed to delete review tags: %w", err)
+		}
+	}
+	for _, tag := range tags {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO review_tags (review_id, app_name, version, tag, severity, category, processed_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (app_name, review_id, tag) DO NOTHING
+		`, tag.ReviewID, tag.AppName, tag.Version, tag.Tag, tag.Severity, tag.Category, sqliteTime(tag.ProcessedAt))
+		if err != nil {
+			return fmt.Errorf("failed to save review tag: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) VersionSummary(ctx context.Context, packageName, version string) (*VersionSummary, error) {
+	summary := &VersionSummary{AppName: packageName, Version: version}
+	var text sql.NullString
+	var analyzedAt, processedAt string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT summary, schema_version, analyzed_at, processed_at
+		FROM version_summaries
+		WHERE app_name = ? AND version = ?
+	`, packageName, version).Scan(&text, &summary.SchemaVersion, &analyzedAt, &processedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+
+	summary.Summary = text.String
+	if summary.AnalyzedAt, err = parseSQLiteTime(sql.NullString{String: analyzedAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	if summary.ProcessedAt, err = parseSQLiteTime(sql.NullString{String: processedAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+func (s *sqliteStore) SummaryChunks(ctx context.Context, packageName, version string) ([]SummaryChunk, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT chunk, analyzed_at, COALESCE(summary, ''), review_ids, processed_at
+		FROM summary_chunks
+		WHERE app_name = ? AND version = ?
+		ORDER BY chunk
+	`, packageName, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var chunks []SummaryChunk
+	for rows.Next() {
+		chunk := SummaryChunk{AppName: packageName, Version: version}
+		var analyzedAt, processedAt, reviewIDs string
+		if err := rows.Scan(&chunk.Chunk, &analyzedAt, &chunk.Summary, &reviewIDs, &processedAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if err := json.Unmarshal([]byte(reviewIDs), &chunk.ReviewIDs); err != nil {
+			return nil, fmt.Errorf("invalid review IDs of chunk %d: %w", chunk.Chunk, err)
+		}
+		if chunk.AnalyzedAt, err = parseSQLiteTime(sql.NullString{String: analyzedAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		if chunk.ProcessedAt, err = parseSQLiteTime(sql.NullString{String: processedAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, rows.Err()
+}
+
+func (s *sqliteStore) ReviewTags(ctx context.Context, packageName, version string) ([]ReviewTag, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT review_id, app_name, COALESCE(version, ''), tag, COALESCE(severity, ''), COALESCE(category, ''), processed_at
+		FROM review_tags
+		WHERE app_name = ? AND (? = '' OR version = ?)
+		ORDER BY review_id, tag
+	`, packageName, version, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []ReviewTag
+	for rows.Next() {
+		var tag ReviewTag
+		var processedAt string
+		if err := rows.Scan(&tag.ReviewID, &tag.AppName, &tag.Version, &tag.Tag, &tag.Severity, &tag.Category, &processedAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if tag.ProcessedAt, err = parseSQLiteTime(sql.NullString{String: processedAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (s *sqliteStore) SaveTaxonomyLabel(ctx context.Context, label *TaxonomyLabel) error {
+	synonyms, err := json.Marshal(label.Synonyms)
+	if err != nil {
+		return fmt.Errorf("failed to encode synonyms: %w", err)
+	}
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO taxonomy (label_id, category, issue, description, synonyms, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (label_id) DO UPDATE SET
+			description = excluded.description,
+			synonyms = excluded.synonyms,
+			updated_at = excluded.updated_at
+	`, label.ID, label.Category, label.Issue, label.Description, string(synonyms), sqliteTime(label.UpdatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to save taxonomy label: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) TaxonomyLabels(ctx context.Context) ([]TaxonomyLabel, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT label_id, category, issue, COALESCE(description, ''), synonyms, updated_at
+		FROM taxonomy
+		ORDER BY label_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var labels []TaxonomyLabel
+	for rows.Next() {
+		var label TaxonomyLabel
+		var synonyms, updatedAt string
+		if err := rows.Scan(&label.ID, &label.Category, &label.Issue, &label.Description, &synonyms, &updatedAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if err := json.Unmarshal([]byte(synonyms), &label.Synonyms); err != nil {
+			return nil, fmt.Errorf("invalid synonyms of label %s: %w", label.ID, err)
+		}
+		if label.UpdatedAt, err = parseSQLiteTime(sql.NullString{String: updatedAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, rows.Err()
+}
+
+func (s *sqliteStore) DeleteTaxonomyLabel(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM taxonomy WHERE label_id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete taxonomy label: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) SaveTagMappings(ctx context.Context, mappings []TagMapping) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, m := range mappings {
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO tag_mappings (tag, label, suggestion, confidence, method, mapped_at)
+			VALUES (?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?)
+			ON CONFLICT (tag) DO UPDATE SET
+				label = excluded.label,
+				suggestion = excluded.suggestion,
+				confidence = excluded.confidence,
+				method = excluded.method,
+				mapped_at = excluded.mapped_at
+		`, m.Tag, m.Label, m.Suggestion, m.Confidence, m.Method, sqliteTime(m.MappedAt))
+		if err != nil {
+			return fmt.Errorf("failed to save tag mapping: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) TagMappings(ctx context.Context) ([]TagMapping, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT tag, COALESCE(label, ''), COALESCE(suggestion, ''), confidence, method, mapped_at
+		FROM tag_mappings
+		ORDER BY tag
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var mappings []TagMapping
+	for rows.Next() {
+		var m TagMapping
+		var mappedAt string
+		if err := rows.Scan(&m.Tag, &m.Label, &m.Suggestion, &m.Confidence, &m.Method, &mappedAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if m.MappedAt, err = parseSQLiteTime(sql.NullString{String: mappedAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, rows.Err()
+}
+
+func (s *sqliteStore) ClearTagMappings(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM tag_mappings WHERE method != ?`, MappingManual); err != nil {
+		return fmt.Errorf("failed to clear tag mappings: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) SyncCheckpoint(ctx context.Context, packageName string) (*SyncCheckpoint, error) {
+	var lastModified, pageToken, pendingLastModified sql.NullString
+	var updatedAt string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT last_modified, page_token, pending_last_modified, updated_at
+		FROM sync_checkpoints
+		WHERE app_name = ?
+	`, packageName).Scan(&lastModified, &pageToken, &pendingLastModified, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync checkpoint: %w", err)
+	}
+
+	cp := &SyncCheckpoint{PackageName: packageName, PageToken: pageToken.String}
+	if cp.LastModified, err = parseSQLiteTime(lastModified); err != nil {
+		return nil, err
+	}
+	if cp.PendingLastModified, err = parseSQLiteTime(pendingLastModified); err != nil {
+		return nil, err
+	}
+	if cp.UpdatedAt, err = parseSQLiteTime(sql.NullString{String: updatedAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func (s *sqliteStore) SaveSyncCheckpoint(ctx context.Context, cp *SyncCheckpoint) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO sync_checkpoints (app_name, last_modified, page_token, pending_last_modified, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (app_name) DO UPDATE SET
+			last_modified = excluded.last_modified,
+			page_token = excluded.page_token,
+			pending_last_modified = excluded.pending_last_modified,
+			updated_at = excluded.updated_at
+	`, cp.PackageName, sqliteTime(cp.LastModified), cp.PageToken, sqliteTime(cp.PendingLastModified), cp.UpdatedAt.UTC().Format(lastModifiedLayout))
+	if err != nil {
+		return fmt.Errorf("failed to save sync checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) SaveReply(ctx context.Context, reply *Reply) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO review_replies (app_name, review_id, reply_text, last_edited, sent_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, reply.AppName, reply.ReviewID, reply.Text, sqliteTime(reply.LastEdited), reply.SentAt.UTC().Format(lastModifiedLayout))
+	if err != nil {
+		return fmt.Errorf("failed to save reply: %w", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Replies(ctx context.Context, packageName, reviewID string) ([]Reply, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT reply_text, last_edited, sent_at
+		FROM review_replies
+		WHERE app_name = ? AND review_id = ?
+		ORDER BY sent_at DESC
+	`, packageName, reviewID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var replies []Reply
+	for rows.Next() {
+		reply := Reply{AppName: packageName, ReviewID: reviewID}
+		var lastEdited sql.NullString
+		var sentAt string
+		if err := rows.Scan(&reply.Text, &lastEdited, &sentAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if reply.LastEdited, err = parseSQLiteTime(lastEdited); err != nil {
+			return nil, err
+		}
+		if reply.SentAt, err = parseSQLiteTime(sql.NullString{String: sentAt, Valid: true}); err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+
+	return replies, rows.Err()
+}
+
+func (s *sqliteStore) SaveDraft(ctx context.Context, draft *ReplyDraft) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO reply_drafts (draft_id, app_name, review_id, reviewer_language, star_rating, review_text, tags, draft_text, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, draft.ID, draft.AppName, draft.ReviewID, draft.Language, draft.StarRating, draft.Review, draft.Tags, draft.Text, draft.Status,
+		draft.CreatedAt.UTC().Format(lastModifiedLayout), draft.UpdatedAt.UTC().Format(lastModifiedLayout))
+	if err != nil {
+		return fmt.Errorf("failed to save reply draft: %w", err)
+	}
+	return nil
+}
+
+// Columns of reply_drafts in the order scanned by scanDraft
+const sqliteDraftColumns = "draft_id, app_name, review_id, reviewer_language, star_rating, review_text, tags, draft_text, status, created_at, updated_at"
+
+func scanDraft(scan func(dest ...any) error) (*ReplyDraft, error) {
+	var d ReplyDraft
+	var language, reviewText, tags, text sql.NullString
+	var starRating sql.NullInt64
+	var createdAt, updatedAt string
+	if err := scan(&d.ID, &d.AppName, &d.ReviewID, &language, &starRating, &reviewText, &tags, &text, &d.Status, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	d.Language = language.String
+	d.StarRating = starRating.Int64
+	d.Review = reviewText.String
+	d.Tags = tags.String
+	d.Text = text.String
+
+	var err error
+	if d.CreatedAt, err = parseSQLiteTime(sql.NullString{String: createdAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	if d.UpdatedAt, err = parseSQLiteTime(sql.NullString{String: updatedAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (s *sqliteStore) Draft(ctx context.Context, id string) (*ReplyDraft, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqliteDraftColumns+` FROM reply_drafts WHERE draft_id = ?`, id)
+	draft, err := scanDraft(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch reply draft: %w", err)
+	}
+	return draft, nil
+}
+
+func (s *sqliteStore) Drafts(ctx context.Context, packageName, status string) ([]ReplyDraft, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+sqliteDraftColumns+`
+		FROM reply_drafts
+		WHERE app_name = ? AND (? = '' OR status = ?)
+		ORDER BY created_at DESC
+	`, packageName, status, status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var drafts []ReplyDraft
+	for rows.Next() {
+		draft, err := scanDraft(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		drafts = append(drafts, *draft)
+	}
+
+	return drafts, rows.Err()
+}
+
+func (s *sqliteStore) ReviewsToDraft(ctx context.Context, packageName string, maxStars int64, limit int) ([]*CommentDetails, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT `+sqliteCommentColumns+`
+		FROM raw_reviews AS r
+		WHERE app_name = ? AND star_rating <= ? AND developer_comment IS NULL
+			AND EXISTS (SELECT 1 FROM review_tags AS t WHERE t.app_name = r.app_name AND t.review_id = r.review_id)
+			AND NOT EXISTS (SELECT 1 FROM reply_drafts AS d WHERE d.app_name = r.app_name AND d.review_id = r.review_id)
+		ORDER BY last_modified DESC, review_id
+		LIMIT ?
+	`, packageName, maxStars, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var reviews []*CommentDetails
+	for rows.Next() {
+		review, err := scanComment(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		reviews = append(reviews, review)
+	}
+	return reviews, rows.Err()
+}
+
+func (s *sqliteStore) SaveApp(ctx context.Context, app *RegisteredApp) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO apps (app_name, display_name, team, fetch_count, analysis_window_days, analysis_max_stars, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (app_name) DO UPDATE SET
+			display_name = excluded.display_name,
+			team = excluded.team,
+			fetch_count = excluded.fetch_count,
+			analysis_window_days = excluded.analysis_window_days,
+			analysis_max_stars = excluded.analysis_max_stars,
+			updated_at = excluded.updated_at
+	`, app.PackageName, app.DisplayName, app.Team, app.FetchCount, app.AnalysisWindowDays, app.AnalysisMaxStars,
+		sqliteTime(app.CreatedAt), sqliteTime(app.UpdatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to save app: %w", err)
+	}
+	return nil
+}
+
+// Columns of apps in the order scanned by scanApp
+const sqliteAppColumns = "app_name, display_name, team, fetch_count, analysis_window_days, analysis_max_stars, created_at, updated_at"
+
+func scanApp(scan func(dest ...any) error) (*RegisteredApp, error) {
+	var app RegisteredApp
+	var displayName, team sql.NullString
+	var fetchCount, windowDays, maxStars sql.NullInt64
+	var createdAt, updatedAt string
+	if err := scan(&app.PackageName, &displayName, &team, &fetchCount, &windowDays, &maxStars, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	app.DisplayName = displayName.String
+	app.Team = team.String
+	app.FetchCount = fetchCount.Int64
+	app.AnalysisWindowDays = windowDays.Int64
+	app.AnalysisMaxStars = maxStars.Int64
+
+	var err error
+	if app.CreatedAt, err = parseSQLiteTime(sql.NullString{String: createdAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	if app.UpdatedAt, err = parseSQLiteTime(sql.NullString{String: updatedAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+func (s *sqliteStore) App(ctx context.Context, packageName string) (*RegisteredApp, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqliteAppColumns+` FROM apps WHERE app_name = ?`, packageName)
+	app, err := scanApp(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch app: %w", err)
+	}
+	return app, nil
+}
+
+func (s *sqliteStore) Apps(ctx context.Context) ([]RegisteredApp, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteAppColumns+` FROM apps ORDER BY app_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var apps []RegisteredApp
+	for rows.Next() {
+		app, err := scanApp(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		apps = append(apps, *app)
+	}
+
+	return apps, rows.Err()
+}
+
+func (s *sqliteStore) DeleteApp(ctx context.Context, packageName string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM apps WHERE app_name = ?`, packageName)
+	if err != nil {
+		return fmt.Errorf("failed to delete app: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) AppStats(ctx context.Context, packageNames []string, since time.Time) (map[string]*AppStats, error) {
+	wanted := map[string]bool{}
+	for _, name := range packageNames {
+		wanted[name] = true
+	}
+	stats := map[string]*AppStats{}
+	stat := func(packageName string) *AppStats {
+		if stats[packageName] == nil {
+			stats[packageName] = &AppStats{}
+		}
+		return stats[packageName]
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT app_name, COUNT(*), AVG(star_rating),
+			SUM(last_modified >= ?), AVG(CASE WHEN last_modified >= ? THEN star_rating END),
+			MAX(last_modified)
+		FROM raw_reviews
+		GROUP BY app_name
+	`, since.UTC().Format(lastModifiedLayout), since.UTC().Format(lastModifiedLayout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var packageName string
+		var count, recentCount sql.NullInt64
+		var average, recentAverage sql.NullFloat64
+		var latest sql.NullString
+		if err := rows.Scan(&packageName, &count, &average, &recentCount, &recentAverage, &latest); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if !wanted[packageName] {
+			continue
+		}
+		latestReviewAt, err := parseSQLiteTime(latest)
+		if err != nil {
+			return nil, err
+		}
+
+		st := stat(packageName)
+		st.ReviewCount = count.Int64
+		st.AverageRating = average.Float64
+		st.RecentReviewCount = recentCount.Int64
+		st.RecentRating = recentAverage.Float64
+		if !latestReviewAt.IsZero() {
+			st.LatestReviewAt = &latestReviewAt
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `
+		SELECT app_name, MAX(analyzed_at)
+		FROM version_summaries
+		GROUP BY app_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var packageName string
+		var createdAt sql.NullString
+		if err := rows.Scan(&packageName, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if !wanted[packageName] {
+			continue
+		}
+		lastAnalysisAt, err := parseSQLiteTime(createdAt)
+		if err != nil {
+			return nil, err
+		}
+		if !lastAnalysisAt.IsZero() {
+			stat(packageName).LastAnalysisAt = &lastAnalysisAt
+		}
+	}
+
+	return stats, rows.Err()
+}
+
+func (s *sqliteStore) VersionStats(ctx context.Context, packageName string, versions []string) (map[string]*VersionStats, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT version, star_rating, COUNT(*)
+		FROM raw_reviews
+		WHERE app_name = ? AND star_rating BETWEEN 1 AND 5
+		GROUP BY version, star_rating
+	`, packageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := map[string][5]int64{}
+	for rows.Next() {
+		var version sql.NullString
+		var stars, count int64
+		if err := rows.Scan(&version, &stars, &count); err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		if !slices.Contains(versions, version.String) {
+			continue
+		}
+		c := counts[version.String]
+		c[stars-1] = count
+		counts[version.String] = c
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]*VersionStats{}
+	for version, c := range counts {
+		stats[version] = newVersionStats(c)
+	}
+	return stats, nil
+}
+
+func (s *sqliteStore) SaveSchedule(ctx context.Context, sched *Schedule) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR REPLACE INTO schedules (app_name, cron, incremental, enabled, last_run_at, last_status, last_error, last_job_id, next_run_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, sched.PackageName, sched.Cron, sched.Incremental, sched.Enabled, sqliteTime(sched.LastRunAt), sched.LastStatus, sched.LastError,
+		sched.LastJobID, sqliteTime(sched.NextRunAt), sqliteTime(sched.UpdatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to save schedule: %w", err)
+	}
+	return nil
+}
+
+// Columns of schedules in the order scanned by scanSchedule
+const sqliteScheduleColumns = "app_name, cron, incremental, enabled, last_run_at, last_status, last_error, last_job_id, next_run_at, updated_at"
+
+func scanSchedule(scan func(dest ...any) error) (*Schedule, error) {
+	var sched Schedule
+	var lastRunAt, lastStatus, lastError, lastJobID, nextRunAt sql.NullString
+	var updatedAt string
+	if err := scan(&sched.PackageName, &sched.Cron, &sched.Incremental, &sched.Enabled, &lastRunAt, &lastStatus, &lastError, &lastJobID, &nextRunAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	sched.LastStatus = lastStatus.String
+	sched.LastError = lastError.String
+	sched.LastJobID = lastJobID.String
+
+	var err error
+	if sched.LastRunAt, err = parseSQLiteTime(lastRunAt); err != nil {
+		return nil, err
+	}
+	if sched.NextRunAt, err = parseSQLiteTime(nextRunAt); err != nil {
+		return nil, err
+	}
+	if sched.UpdatedAt, err = parseSQLiteTime(sql.NullString{String: updatedAt, Valid: true}); err != nil {
+		return nil, err
+	}
+	return &sched, nil
+}
+
+func (s *sqliteStore) Schedule(ctx context.Context, packageName string) (*Schedule, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+sqliteScheduleColumns+` FROM schedules WHERE app_name = ?`, packageName)
+	sched, err := scanSchedule(row.Scan)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch schedule: %w", err)
+	}
+	return sched, nil
+}
+
+func (s *sqliteStore) Schedules(ctx context.Context) ([]Schedule, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+sqliteScheduleColumns+` FROM schedules ORDER BY app_name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []Schedule
+	for rows.Next() {
+		sched, err := scanSchedule(rows.Scan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %w", err)
+		}
+		schedules = append(schedules, *sched)
+	}
+
+	return schedules, rows.Err()
+}
+
+func (s *sqliteStore) DeleteSchedule(ctx context.Context, packageName string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM schedules WHERE app_name = ?`, packageName)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+// sqliteTime formats a time the way last_modified is stored, the zero time as NULL
+func sqliteTime(t time.Time) sql.NullString {
+	if t.IsZero() {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: t.UTC().Format(lastModifiedLayout), Valid: true}
+}
+
+// parseSQLiteTime reverses sqliteTime
+func parseSQLiteTime(s sql.NullString) (time.Time, error) {
+	if !s.Valid || s.String == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(lastModifiedLayout, s.String)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q: %w", s.String, err)
+	}
+	return t, nil
+}
+
+// addMissingReviewColumns upgrades raw_reviews tables created by older versions
+func addMissingReviewColumns(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('raw_reviews')`)
+	if err != nil {
+		return fmt.Errorf("failed to read raw_reviews columns: %w", err)
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to read raw_reviews columns: %w", err)
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read raw_reviews columns: %w", err)
+	}
+
+	for _, c := range sqliteReviewColumns {
+		if existing[c.name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE raw_reviews ADD COLUMN %s %s", c.name, c.typ)); err != nil {
+			return fmt.Errorf("failed to add raw_reviews column %s: %w", c.name, err)
+		}
+	}
+	return nil
+}
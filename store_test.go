@@ -0,0 +1,105 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testStores returns the stores that run without Google Cloud
+func testStores(t *testing.T) map[string]ReviewStore {
+	t.Helper()
+	sqlite, err := newSQLiteStore(filepath.Join(t.TempDir(), "reviews.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+	return map[string]ReviewStore{"memory": newMemoryStore(), "sqlite": sqlite}
+}
+
+// Stores never validate: whatever reaches them is plain data
+func TestStoresKeepMaliciousInputAsData(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			canary := &Review{ReviewID: "canary", AppName: "com.example.app", Version: "1.0", Comments: "still here", StarRating: 1, LastModified: now.Format(lastModifiedLayout)}
+			if err := store.InsertReviews(ctx, []*Review{canary}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, tc := range maliciousInputs {
+				if tc.input == "" {
+					continue
+				}
+				review := &Review{
+					ReviewID:     tc.input,
+					AppName:      tc.input,
+					Version:      tc.input,
+					AuthorName:   tc.input,
+					Comments:     tc.input,
+					StarRating:   1,
+					LastModified: now.Format(lastModifiedLayout),
+				}
+				if err := store.InsertReviews(ctx, []*Review{review}); err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+
+				got, err := store.Comment(ctx, tc.input, tc.input)
+				if err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+				if got.ReviewID != tc.input || got.AppName != tc.input || got.Version != tc.input || got.AuthorName != tc.input || got.Comments != tc.input {
+					t.Errorf("%s: read back %+v", tc.name, got)
+				}
+
+				versions, err := store.VersionsToAnalyze(ctx, tc.input, now.Add(-time.Hour), 5)
+				if err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+				if !slices.Equal(versions, []string{tc.input}) {
+					t.Errorf("%s: versions = %q", tc.name, versions)
+				}
+				reviews, err := store.ReviewsForVersion(ctx, tc.input, tc.input, now.Add(-time.Hour), 10, 0)
+				if err != nil {
+					t.Fatalf("%s: %v", tc.name, err)
+				}
+				if len(reviews) != 1 || reviews[0].Comments != tc.input {
+					t.Errorf("%s: reviews = %+v", tc.name, reviews)
+				}
+
+				// Matching is exact, a payload does not widen a query to other apps
+				if _, err := store.Comment(ctx, tc.input, "canary"); !errors.Is(err, ErrNotFound) {
+					t.Errorf("%s: canary read through the payload package: %v", tc.name, err)
+				}
+			}
+
+			// Nothing was dropped or deleted on the way
+			got, err := store.Comment(ctx, "com.example.app", "canary")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Comments != canary.Comments {
+				t.Errorf("canary = %+v", got)
+			}
+		})
+	}
+}
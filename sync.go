@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SyncCheckpoint is the high-water mark of the incremental sync of one package.
+//
+// The Play Developer API lists reviews by last modification, newest first, so a sync pages
+// until it reaches a review modified before the second of LastModified, those of that second
+// being fetched again in case they were edited after it was stored. When the review count runs out
+// before that, the sync is unfinished: the next one resumes from PageToken, still stops at
+// LastModified, and only then moves the mark up to PendingLastModified. Reviews added in
+// between are newer than that and picked up by the following sync.
+type SyncCheckpoint struct {
+	PackageName         string    `json:"package_name"`
+	LastModified        time.Time `json:"last_modified"`                   // every review modified up to this time is stored
+	PageToken           string    `json:"page_token,omitempty"`            // where an unfinished sync resumes
+	PendingLastModified time.Time `json:"pending_last_modified,omitempty"` // newest review seen by the unfinished sync
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// fetchResult is what the fetching stage of a job hands to the inserting stage
+type fetchResult struct {
+	Reviews    []*Review
+	Checkpoint *SyncCheckpoint // saved once the reviews are stored, nil for full fetches
+}
+
+// syncReviews fetches the reviews of a package that are new or edited since its checkpoint,
+// at most count of them (plus the rest of the last page), and computes the next checkpoint
+func (a *App) syncReviews(ctx context.Context, packageName string, count int, translationLanguage string, progress ProgressFunc) (*fetchResult, error) {
+	cp, err := a.store.SyncCheckpoint(ctx, packageName)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read sync checkpoint", err)
+	}
+	if cp == nil {
+		cp = &SyncCheckpoint{PackageName: packageName}
+	}
+
+	opts := fetchOptions{PageToken: cp.PageToken, TranslationLanguage: translationLanguage, After: cp.LastModified, WholePages: true}
+	reviews, nextPageToken, err := fetchReviews(ctx, a.play, packageName, count, opts, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := nextCheckpoint(cp, reviews, nextPageToken)
+	if err != nil {
+		return nil, newError(KindInternal, "failed to compute sync checkpoint", err)
+	}
+	log.Printf("Synced %d new or edited reviews of %s", len(reviews), packageName)
+
+	return &fetchResult{Reviews: reviews, Checkpoint: next}, nil
+}
+
+// nextCheckpoint moves cp past the fetched reviews. nextPageToken is empty when the sync
+// caught up, either on a known review or at the end of the list.
+func nextCheckpoint(cp *SyncCheckpoint, reviews []*Review, nextPageToken string) (*SyncCheckpoint, error) {
+	next := *cp
+	next.UpdatedAt = time.Now().UTC()
+
+	newest := cp.PendingLastModified
+	for _, r := range reviews {
+		lastModified, err := time.Parse(lastModifiedLayout, r.LastModified)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last_modified %q: %w", r.LastModified, err)
+		}
+		if lastModified.After(newest) {
+			newest = lastModified
+		}
+	}
+
+	if nextPageToken != "" {
+		next.PageToken = nextPageToken
+		next.PendingLastModified = newest
+		return &next, nil
+	}
+
+	if newest.After(next.LastModified) {
+		next.LastModified = newest
+	}
+	next.PageToken = ""
+	next.PendingLastModified = time.Time{}
+	return &next, nil
+}
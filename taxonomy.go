@@ -0,0 +1,550 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed taxonomy.yaml
+var defaultTaxonomyYAML []byte
+
+const (
+	unmappedLabel        = "unmapped" // the bucket of the tags without a label, to review
+	minMappingConfidence = 0.6        // below it, the label proposed by the model is only a suggestion
+	maxMappingBatch      = 100        // tags mapped per Gemini request
+	maxSynonyms          = 50
+)
+
+// How a tag was mapped
+const (
+	MappingSynonym = "synonym" // the tag is the issue or one of its synonyms
+	MappingModel   = "model"   // Gemini picked the label
+	MappingManual  = "manual"  // set through the API, never remapped
+	MappingNone    = "none"    // no model answered, in the unmapped bucket until the next run maps it
+)
+
+var issueRegex = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// TaxonomyLabel is a canonical label of the taxonomy: an issue of a category (taxonomy table)
+type TaxonomyLabel struct {
+	ID          string    `bigquery:"label_id" json:"label"` // category/issue
+	Category    string    `bigquery:"category" json:"category"`
+	Issue       string    `bigquery:"issue" json:"issue"`
+	Description string    `bigquery:"description" json:"description"`
+	Synonyms    []string  `bigquery:"synonyms" json:"synonyms"`
+	UpdatedAt   time.Time `bigquery:"updated_at" json:"updated_at"`
+}
+
+// TagMapping is the label of a generated tag, shared by all apps (tag_mappings table). Tags
+// without a label are in the unmapped bucket, with the label the model suggested if any.
+type TagMapping struct {
+	Tag        string    `bigquery:"tag" json:"tag"` // in its tagKey form
+	Label      string    `bigquery:"label" json:"label"`
+	Suggestion string    `bigquery:"suggestion" json:"suggestion,omitempty"`
+	Confidence float64   `bigquery:"confidence" json:"confidence"`
+	Method     string    `bigquery:"method" json:"method"`
+	MappedAt   time.Time `bigquery:"mapped_at" json:"mapped_at"`
+}
+
+// LabelCount is the number of reviews of a version with a label
+type LabelCount struct {
+	Label string `json:"label"`
+	Count int    `json:"count"`
+}
+
+// taxonomyFile is the format of taxonomy.yaml: category, then issue
+type taxonomyFile map[string]map[string]struct {
+	Description string   `yaml:"description"`
+	Synonyms    []string `yaml:"synonyms"`
+}
+
+// parseTaxonomy reads and validates a taxonomy file
+func parseTaxonomy(data []byte) ([]TaxonomyLabel, error) {
+	var file taxonomyFile
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid taxonomy: %w", err)
+	}
+
+	var labels []TaxonomyLabel
+	for category, issues := range file {
+		for issue, l := range issues {
+			label := TaxonomyLabel{ID: category + "/" + issue, Category: category, Issue: issue, Description: l.Description, Synonyms: l.Synonyms}
+			if err := validateTaxonomyLabel(&label); err != nil {
+				return nil, fmt.Errorf("invalid taxonomy label %s: %w", label.ID, err)
+			}
+			labels = append(labels, label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].ID < labels[j].ID })
+	return labels, nil
+}
+
+// loadTaxonomyFile returns the labels of the configured taxonomy file, or of the built-in one
+func loadTaxonomyFile(path string) ([]TaxonomyLabel, error) {
+	data := defaultTaxonomyYAML
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read taxonomy file: %w", err)
+		}
+	}
+	return parseTaxonomy(data)
+}
+
+// validateTaxonomyLabel normalizes the synonyms of a label and checks it
+func validateTaxonomyLabel(l *TaxonomyLabel) error {
+	if l.Category == unspecified || !schemaAllows(analysisSchema, l.Category, "details", "category") {
+		return invalidArgument(fmt.Sprintf("unknown category %q", l.Category))
+	}
+	if len(l.Issue) > maxAppTextLength || !issueRegex.MatchString(l.Issue) {
+		return invalidArgument("an issue is made of lowercase letters, digits and dashes")
+	}
+	l.Description = strings.TrimSpace(l.Description)
+	if utf8.RuneCountInString(l.Description) > maxAppTextLength {
+		return invalidArgument(fmt.Sprintf("the description is limited to %d characters", maxAppTextLength))
+	}
+
+	seen := map[string]bool{}
+	synonyms := []string{}
+	for _, synonym := range l.Synonyms {
+		synonym = tagKey(synonym)
+		if synonym == "" || utf8.RuneCountInString(synonym) > maxAppTextLength {
+			return invalidArgument(fmt.Sprintf("synonyms must have between 1 and %d characters", maxAppTextLength))
+		}
+		if !seen[synonym] {
+			seen[synonym] = true
+			synonyms = append(synonyms, synonym)
+		}
+	}
+	if len(synonyms) > maxSynonyms {
+		return invalidArgument(fmt.Sprintf("a label has at most %d synonyms", maxSynonyms))
+	}
+	l.Synonyms = synonyms
+	return nil
+}
+
+// taxonomyLabels returns the stored taxonomy. The first call of the process applies the
+// taxonomy file: its labels replace the stored ones with the same ID, the built-in taxonomy
+// only fills an empty store. Changed labels clear the mappings, tags are mapped again.
+func (a *App) taxonomyLabels(ctx context.Context) ([]TaxonomyLabel, error) {
+	a.taxonomyMu.Lock()
+	defer a.taxonomyMu.Unlock()
+
+	labels, err := a.store.TaxonomyLabels(ctx)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read the taxonomy", err)
+	}
+	if a.taxonomyFile == nil || (a.cfg.TaxonomyFile == "" && len(labels) > 0) {
+		a.taxonomyFile = nil
+		return labels, nil
+	}
+
+	stored := map[string]TaxonomyLabel{}
+	for _, label := range labels {
+		stored[label.ID] = label
+	}
+	changed := 0
+	for _, label := range a.taxonomyFile {
+		if s, ok := stored[label.ID]; ok && s.Description == label.Description && slices.Equal(s.Synonyms, label.Synonyms) {
+			continue
+		}
+		label.UpdatedAt = time.Now().UTC()
+		if err := a.store.SaveTaxonomyLabel(ctx, &label); err != nil {
+			return nil, newError(KindStorage, "failed to save the taxonomy", err)
+		}
+		changed++
+	}
+	if changed > 0 {
+		if err := a.store.ClearTagMappings(ctx); err != nil {
+			return nil, newError(KindStorage, "failed to clear the tag mappings", err)
+		}
+		log.Printf("Applied the taxonomy file, %d labels changed", changed)
+	}
+	a.taxonomyFile = nil
+
+	labels, err = a.store.TaxonomyLabels(ctx)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read the taxonomy", err)
+	}
+	return labels, nil
+}
+
+// mapTags is the mapping stage of an analysis run: every tag of the package without a label
+// yet is mapped to the taxonomy, by its synonyms first, then by Gemini. Tags the model is not
+// confident about go to the unmapped bucket, like all of them when no model answered.
+func (a *App) mapTags(ctx context.Context, packageName string) error {
+	labels, err := a.taxonomyLabels(ctx)
+	if err != nil || len(labels) == 0 {
+		return err
+	}
+
+	tags, err := a.store.ReviewTags(ctx, packageName, "")
+	if err != nil {
+		return newError(KindStorage, "failed to list review tags", err)
+	}
+	mappings, err := a.store.TagMappings(ctx)
+	if err != nil {
+		return newError(KindStorage, "failed to list tag mappings", err)
+	}
+	mapped := map[string]bool{}
+	for _, m := range mappings {
+		mapped[m.Tag] = m.Method != MappingNone
+	}
+
+	synonyms := map[string]string{}
+	for _, label := range labels {
+		synonyms[tagKey(label.Issue)] = label.ID
+		synonyms[tagKey(strings.ReplaceAll(label.Issue, "-", " "))] = label.ID
+		for _, synonym := range label.Synonyms {
+			synonyms[synonym] = label.ID
+		}
+	}
+
+	now := time.Now().UTC()
+	var found []TagMapping
+	var remaining []string
+	for _, tag := range tags {
+		key := tagKey(tag.Tag)
+		if mapped[key] {
+			continue
+		}
+		mapped[key] = true
+		if label, ok := synonyms[key]; ok {
+			found = append(found, TagMapping{Tag: key, Label: label, Confidence: 1, Method: MappingSynonym, MappedAt: now})
+			continue
+		}
+		remaining = append(remaining, key)
+	}
+
+	// Without an answer of the model the tags still go to the unmapped bucket
+	var modelErr error
+	for start := 0; start < len(remaining); start += maxMappingBatch {
+		batch := remaining[start:min(start+maxMappingBatch, len(remaining))]
+		if a.llm != nil && modelErr == nil {
+			byModel, err := mapTagsWithModel(ctx, a.llm, labels, batch)
+			if err == nil {
+				found = append(found, byModel...)
+				continue
+			}
+			modelErr = err
+		}
+		for _, tag := range batch {
+			found = append(found, TagMapping{Tag: tag, Method: MappingNone, MappedAt: now})
+		}
+	}
+
+	if len(found) == 0 {
+		return modelErr
+	}
+	if err := a.store.SaveTagMappings(ctx, found); err != nil {
+		return newError(KindStorage, "failed to save tag mappings", err)
+	}
+	log.Printf("Mapped %d tags of %s to the taxonomy", len(found), packageName)
+	return modelErr
+}
+
+// mappingPromptIntro starts the prompt mapping tags to the taxonomy
+const mappingPromptIntro = "You map the tags of negative app reviews to a taxonomy of issues."
+
+const mappingPrompt = mappingPromptIntro + ` For each tag below, pick the label of the taxonomy that describes the same issue, with your confidence between 0 and 1. Use an empty label when no label fits. The output should be a single JSON object with a "mappings" field, an array of JSON objects each with "tag", "label" and "confidence".
+
+Taxonomy: %s
+
+Tags: %s`
+
+// mappingResponseSchema is the answer of a mappingPrompt in the form of the Gemini JSON mode
+var mappingResponseSchema = map[string]any{
+	"type": "OBJECT",
+	"properties": map[string]any{
+		"mappings": map[string]any{
+			"type": "ARRAY",
+			"items": map[string]any{
+				"type": "OBJECT",
+				"properties": map[string]any{
+					"tag":        map[string]any{"type": "STRING"},
+					"label":      map[string]any{"type": "STRING"},
+					"confidence": map[string]any{"type": "NUMBER"},
+				},
+				"required": []any{"tag", "label", "confidence"},
+			},
+		},
+	},
+	"required": []any{"mappings"},
+}
+
+// mapTagsWithModel asks the model for the labels of tags. Answers naming an unknown label or
+// leaving a tag out count as unmapped, so every tag gets a mapping.
+func mapTagsWithModel(ctx context.Context, llm LLMClient, labels []TaxonomyLabel, tags []string) ([]TagMapping, error) {
+	type promptLabel struct {
+		Label       string   `json:"label"`
+		Description string   `json:"description"`
+		Synonyms    []string `json:"synonyms"`
+	}
+	known := map[string]bool{}
+	taxonomy := make([]promptLabel, len(labels))
+	for i, l := range labels {
+		known[l.ID] = true
+		taxonomy[i] = promptLabel{Label: l.ID, Description: l.Description, Synonyms: l.Synonyms}
+	}
+	taxonomyJSON, err := json.Marshal(taxonomy)
+	if err != nil {
+		return nil, newError(KindInternal, "failed to encode the taxonomy", err)
+	}
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return nil, newError(KindInternal, "failed to encode tags", err)
+	}
+	prompt := fmt.Sprintf(mappingPrompt, taxonomyJSON, tagsJSON)
+
+	var answer string
+	if generator, ok := llm.(JSONGenerator); ok {
+		answer, err = generator.GenerateJSON(ctx, prompt, mappingResponseSchema)
+	} else {
+		answer, err = llm.Generate(ctx, prompt)
+	}
+	if err != nil {
+		return nil, newError(KindLLM, "failed to map tags", err)
+	}
+
+	var parsed struct {
+		Mappings []struct {
+			Tag        string  `json:"tag"`
+			Label      string  `json:"label"`
+			Confidence float64 `json:"confidence"`
+		} `json:"mappings"`
+	}
+	text := strings.TrimSpace(answer)
+	if start, end := strings.Index(text, "{"), strings.LastIndex(text, "}"); start >= 0 && end > start {
+		text = text[start : end+1]
+	}
+	if err := json.Unmarshal([]byte(text), &parsed); err != nil {
+		return nil, newError(KindLLM, "invalid tag mapping answer", err)
+	}
+
+	now := time.Now().UTC()
+	answers := map[string]TagMapping{}
+	for _, m := range parsed.Mappings {
+		label := strings.TrimSpace(m.Label)
+		if !known[label] || m.Confidence < 0 || m.Confidence > 1 {
+			label = ""
+		}
+		mapping := TagMapping{Tag: tagKey(m.Tag), Confidence: m.Confidence, Method: MappingModel, MappedAt: now}
+		switch {
+		case label == "":
+			mapping.Confidence = 0
+		case m.Confidence >= minMappingConfidence:
+			mapping.Label = label
+		default:
+			mapping.Suggestion = label
+		}
+		answers[mapping.Tag] = mapping
+	}
+
+	mappings := make([]TagMapping, len(tags))
+	for i, tag := range tags {
+		m, ok := answers[tag]
+		if !ok {
+			m = TagMapping{Tag: tag, Method: MappingModel, MappedAt: now}
+		}
+		mappings[i] = m
+	}
+	return mappings, nil
+}
+
+// tagLabels returns the label of every mapped tag, by tagKey. Labels removed from the
+// taxonomy since the mapping count as unmapped.
+func tagLabels(ctx context.Context, store ReviewStore) (map[string]TagMapping, error) {
+	labels, err := store.TaxonomyLabels(ctx)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to read the taxonomy", err)
+	}
+	mappings, err := store.TagMappings(ctx)
+	if err != nil {
+		return nil, newError(KindStorage, "failed to list tag mappings", err)
+	}
+
+	known := map[string]bool{}
+	for _, l := range labels {
+		known[l.ID] = true
+	}
+	byTag := map[string]TagMapping{}
+	for _, m := range mappings {
+		if m.Label != "" && known[m.Label] {
+			byTag[m.Tag] = m
+		}
+	}
+	return byTag, nil
+}
+
+func (a *App) taxonomyHandler(w http.ResponseWriter, r *http.Request) {
+	labels, err := a.taxonomyLabels(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if labels == nil {
+		labels = []TaxonomyLabel{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(labels)
+}
+
+// putTaxonomyLabelHandler creates or replaces a label. The mappings made by synonyms and by the
+// model are cleared, the next analyses map the tags again.
+func (a *App) putTaxonomyLabelHandler(w http.ResponseWriter, r *http.Request) {
+	var label TaxonomyLabel
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&label); err != nil {
+		writeError(w, invalidArgument("invalid JSON body"))
+		return
+	}
+	label.Category, label.Issue = r.PathValue("category"), r.PathValue("issue")
+	label.ID = label.Category + "/" + label.Issue
+	if err := validateTaxonomyLabel(&label); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// The file is applied first, so it does not overwrite this change later
+	if _, err := a.taxonomyLabels(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.taxonomyMu.Lock()
+	defer a.taxonomyMu.Unlock()
+
+	label.UpdatedAt = time.Now().UTC()
+	if err := a.store.SaveTaxonomyLabel(r.Context(), &label); err != nil {
+		writeError(w, newError(KindStorage, "failed to save taxonomy label", err))
+		return
+	}
+	if err := a.store.ClearTagMappings(r.Context()); err != nil {
+		writeError(w, newError(KindStorage, "label saved but the tag mappings could not be cleared", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(label)
+}
+
+func (a *App) deleteTaxonomyLabelHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.taxonomyLabels(r.Context()); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	a.taxonomyMu.Lock()
+	defer a.taxonomyMu.Unlock()
+
+	id := r.PathValue("category") + "/" + r.PathValue("issue")
+	if err := a.store.DeleteTaxonomyLabel(r.Context(), id); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			writeError(w, &AppError{Kind: KindNotFound, Message: "unknown taxonomy label"})
+			return
+		}
+		writeError(w, newError(KindStorage, "failed to delete taxonomy label", err))
+		return
+	}
+	if err := a.store.ClearTagMappings(r.Context()); err != nil {
+		writeError(w, newError(KindStorage, "label deleted but the tag mappings could not be cleared", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unmappedTagsHandler lists the unmapped bucket: the tags without a label, by tag
+func (a *App) unmappedTagsHandler(w http.ResponseWriter, r *http.Request) {
+	mappings, err := a.store.TagMappings(r.Context())
+	if err != nil {
+		writeError(w, newError(KindStorage, "failed to list tag mappings", err))
+		return
+	}
+	labels, err := tagLabels(r.Context(), a.store)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	unmapped := []TagMapping{}
+	for _, m := range mappings {
+		if _, ok := labels[m.Tag]; !ok {
+			unmapped = append(unmapped, m)
+		}
+	}
+	sort.Slice(unmapped, func(i, j int) bool { return unmapped[i].Tag < unmapped[j].Tag })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(unmapped)
+}
+
+// putTagMappingHandler maps a tag by hand, for the review of the unmapped bucket
+func (a *App) putTagMappingHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tag   string `json:"tag"`
+		Label string `json:"label"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, invalidArgument("invalid JSON body"))
+		return
+	}
+	tag := tagKey(req.Tag)
+	if tag == "" || utf8.RuneCountInString(tag) > maxAppTextLength {
+		writeError(w, invalidArgument(fmt.Sprintf("tag must have between 1 and %d characters", maxAppTextLength)))
+		return
+	}
+
+	labels, err := a.taxonomyLabels(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	known := false
+	for _, l := range labels {
+		known = known || l.ID == req.Label
+	}
+	if !known {
+		writeError(w, invalidArgument(fmt.Sprintf("unknown taxonomy label %q", req.Label)))
+		return
+	}
+
+	mapping := TagMapping{Tag: tag, Label: req.Label, Confidence: 1, Method: MappingManual, MappedAt: time.Now().UTC()}
+	if err := a.store.SaveTagMappings(r.Context(), []TagMapping{mapping}); err != nil {
+		writeError(w, newError(KindStorage, "failed to save tag mapping", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mapping)
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// Android application IDs: at least two segments, each starting with a letter
+	// (https://developer.android.com/build/configure-app-module#set-application-id)
+	packageNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_]*(\.[a-zA-Z][a-zA-Z0-9_]*)+$`)
+	// Version names are free-form in Play, but in practice use this subset
+	versionRegex = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} ._+()-]*$`)
+	// Play review IDs look like gp:AOqpTOH..., the mock API uses UUIDs
+	reviewIDRegex = regexp.MustCompile(`^[a-zA-Z0-9:_.-]+$`)
+	// BigQuery dataset and table IDs, interpolated in queries since identifiers cannot be parameters
+	datasetIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+	// BCP-47 language tags as Play takes them, e.g. en, en-US or zh-Hant-TW
+	languageRegex = regexp.MustCompile(`^[a-zA-Z]{2,3}([_-][a-zA-Z0-9]{2,8})*$`)
+	// Generated by newID
+	draftIDRegex = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+const (
+	maxPackageNameLength = 255
+	maxVersionLength     = 128
+	maxReviewIDLength    = 256
+	maxDatasetIDLength   = 1024
+	maxLanguageLength    = 35
+	maxReplyLength       = 350 // characters, the Play limit for developer replies
+)
+
+func validatePackageName(packageName string) error {
+	if len(packageName) > maxPackageNameLength || !packageNameRegex.MatchString(packageName) {
+		return invalidArgument(fmt.Sprintf("invalid package name %q", packageName))
+	}
+	return nil
+}
+
+func validateVersion(version string) error {
+	if len(version) > maxVersionLength || !versionRegex.MatchString(version) {
+		return invalidArgument(fmt.Sprintf("invalid version %q", version))
+	}
+	return nil
+}
+
+func validateReviewID(reviewID string) error {
+	if len(reviewID) > maxReviewIDLength || !reviewIDRegex.MatchString(reviewID) {
+		return invalidArgument(fmt.Sprintf("invalid comment ID %q", reviewID))
+	}
+	return nil
+}
+
+func validateDatasetID(datasetID string) error {
+	if len(datasetID) > maxDatasetIDLength || !datasetIDRegex.MatchString(datasetID) {
+		return invalidArgument(fmt.Sprintf("invalid dataset ID %q", datasetID))
+	}
+	return nil
+}
+
+func validateLanguage(language string) error {
+	if len(language) > maxLanguageLength || !languageRegex.MatchString(language) {
+		return invalidArgument(fmt.Sprintf("invalid language %q", language))
+	}
+	return nil
+}
+
+func validateDraftID(id string) error {
+	if !draftIDRegex.MatchString(id) {
+		return invalidArgument(fmt.Sprintf("invalid draft ID %q", id))
+	}
+	return nil
+}
+
+func validateReplyText(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return invalidArgument("reply text is required")
+	}
+	if n := utf8.RuneCountInString(text); n > maxReplyLength {
+		return invalidArgument(fmt.Sprintf("reply is %d characters long, Play allows at most %d", n, maxReplyLength))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// maliciousInputs are rejected by every validator
+var maliciousInputs = []struct {
+	name  string
+	input string
+}{
+	{"empty", ""},
+	{"sql injection", "com.example' OR '1'='1"},
+	{"drop table", "com.example'; DROP TABLE raw_reviews;--"},
+	{"statement terminator", "1.0;--"},
+	{"comment", "1.0 --"},
+	{"backtick", "com.example`.raw_reviews"},
+	{"identifier escape", "play`; DELETE FROM `raw_reviews"},
+	{"double quote", `com.example" OR ""="`},
+	{"single quote", "o'neil"},
+	{"union", "x UNION SELECT * FROM apps"},
+	{"newline", "com.example\nDROP TABLE apps"},
+	{"null byte", "com.example\x00"},
+	{"path traversal", "../../etc/passwd"},
+}
+
+func TestValidatorsRejectMaliciousInput(t *testing.T) {
+	validators := []struct {
+		name     string
+		validate func(string) error
+	}{
+		{"package name", validatePackageName},
+		{"version", validateVersion},
+		{"review ID", validateReviewID},
+		{"dataset ID", validateDatasetID},
+	}
+
+	for _, v := range validators {
+		for _, tc := range maliciousInputs {
+			// Versions are free-form, spaces and dashes are valid: these are plain data for them
+			if v.name == "version" && (tc.name == "comment" || tc.name == "union") {
+				continue
+			}
+			t.Run(v.name+"/"+tc.name, func(t *testing.T) {
+				err := v.validate(tc.input)
+				if err == nil {
+					t.Fatalf("%q was accepted", tc.input)
+				}
+				if kind := errorKind(err); kind != KindInvalidArgument {
+					t.Errorf("kind = %s, want %s", kind, KindInvalidArgument)
+				}
+			})
+		}
+	}
+}
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func(string) error
+		input    string
+		valid    bool
+	}{
+		{"package name", validatePackageName, "com.example.app", true},
+		{"package name with underscore", validatePackageName, "com.example.my_app2", true},
+		{"single segment package", validatePackageName, "example", false},
+		{"package segment starting with a digit", validatePackageName, "com.1example", false},
+		{"package name at the limit", validatePackageName, "com." + strings.Repeat("a", maxPackageNameLength-4), true},
+		{"package name over the limit", validatePackageName, "com." + strings.Repeat("a", maxPackageNameLength-3), false},
+
+		{"version", validateVersion, "5.3.1", true},
+		{"version with a build", validateVersion, "5.3.1 (1234)-beta+rc", true},
+		{"version starting with a dot", validateVersion, ".5", false},
+		{"version with a quote", validateVersion, "5.3'", false},
+		{"version with a backtick", validateVersion, "5.3`", false},
+		{"version with a semicolon", validateVersion, "5.3;--", false},
+		{"version at the limit", validateVersion, strings.Repeat("1", maxVersionLength), true},
+		{"version over the limit", validateVersion, strings.Repeat("1", maxVersionLength+1), false},
+
+		{"review ID", validateReviewID, "gp:AOqpTOH2xZ-4_b.c", true},
+		{"review ID UUID", validateReviewID, "123e4567-e89b-12d3-a456-426614174000", true},
+		{"review ID with a space", validateReviewID, "gp:AOqp TOH", false},
+		{"review ID with a quote", validateReviewID, "gp:AOqp'--", false},
+		{"review ID at the limit", validateReviewID, strings.Repeat("a", maxReviewIDLength), true},
+		{"review ID over the limit", validateReviewID, strings.Repeat("a", maxReviewIDLength+1), false},
+
+		{"dataset ID", validateDatasetID, "play_store_reviews_demo", true},
+		{"dataset ID with a dot", validateDatasetID, "project.dataset", false},
+		{"dataset ID with a dash", validateDatasetID, "play-reviews", false},
+		{"dataset ID with a backtick", validateDatasetID, "reviews`", false},
+		{"dataset ID at the limit", validateDatasetID, strings.Repeat("a", maxDatasetIDLength), true},
+		{"dataset ID over the limit", validateDatasetID, strings.Repeat("a", maxDatasetIDLength+1), false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.validate(tc.input)
+			if tc.valid && err != nil {
+				t.Errorf("%q was rejected: %v", tc.input, err)
+			}
+			if !tc.valid && err == nil {
+				t.Errorf("%q was accepted", tc.input)
+			}
+		})
+	}
+}